@@ -0,0 +1,121 @@
+package sand
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//Authorize checks locally if the decoded claims of a token, e.g., of a JWT whose
+//signature was already verified, allow the access described by opt, without calling
+//SAND. The access is allowed if:
+//1. The "exp" claim, if present, is in the future
+//2. The "nbf" claim, if present, is not in the future
+//3. The claims grant all the TargetScopes in the "scope" claim, which is a space
+//   separated string, or in the "scopes" or "scp" claim, which is a list of strings
+//4. The "aud" claim contains the Resource
+//5. The "actions" claim contains the Action or "*" if the Action is not empty
+//The ExpectedIssuer and ExpectedAudience of the service are also checked, and a
+//mismatch is returned as an error. Resource defaults to the service's Resource.
+func (s *Service) Authorize(claims map[string]interface{}, opt VerificationOption) (bool, error) {
+	if len(claims) == 0 {
+		return false, nil
+	}
+	s.buildOption(&opt)
+
+	if exp, ok := claims["exp"]; ok {
+		expiry, err := claimTime(exp)
+		if err != nil {
+			return false, AuthenticationError{fmt.Sprintf("Invalid exp claim: %v", err)}
+		}
+		if !expiry.After(time.Now()) {
+			return false, nil
+		}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		notBefore, err := claimTime(nbf)
+		if err != nil {
+			return false, AuthenticationError{fmt.Sprintf("Invalid nbf claim: %v", err)}
+		}
+		if notBefore.After(time.Now()) {
+			return false, nil
+		}
+	}
+	if err := s.validateClaims(claims); err != nil {
+		return false, err
+	}
+	granted := claimScopes(claims)
+	for _, scope := range opt.TargetScopes {
+		if !contains(granted, scope) {
+			return false, nil
+		}
+	}
+	if opt.Resource != "" && !hasAudience(claims["aud"], opt.Resource) {
+		return false, nil
+	}
+	if opt.Action != "" {
+		actions := claimStrings(claims["actions"])
+		if !contains(actions, opt.Action) && !contains(actions, "*") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+//claimTime converts the "exp" or "nbf" claim, which is either the seconds since the epoch
+//or a time string in the format returned by SAND, to a time.
+func claimTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case float64:
+		return time.Unix(int64(v), 0), nil
+	case int64:
+		return time.Unix(v, 0), nil
+	case int:
+		return time.Unix(int64(v), 0), nil
+	case json.Number:
+		seconds, err := v.Int64()
+		return time.Unix(seconds, 0), err
+	case string:
+		return time.Parse(iso8601, v)
+	}
+	return time.Time{}, fmt.Errorf("unexpected type %T", value)
+}
+
+//claimScopes returns the scopes granted by the "scope", "scopes" and "scp" claims
+func claimScopes(claims map[string]interface{}) []string {
+	var scopes []string
+	for _, name := range []string{"scope", "scopes", "scp"} {
+		scopes = append(scopes, claimStrings(claims[name])...)
+	}
+	return scopes
+}
+
+//claimStrings converts a claim that is either a space separated string or a list
+//of strings to a list of strings.
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []string:
+		return v
+	case []interface{}:
+		rv := make([]string, 0, len(v))
+		for _, s := range v {
+			if str, ok := s.(string); ok {
+				rv = append(rv, str)
+			}
+		}
+		return rv
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package sand
+
+import (
+	"time"
+
+	"github.com/coupa/sand-go/cache"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Authorize", func() {
+	var (
+		service *Service
+		claims  map[string]interface{}
+	)
+
+	BeforeEach(func() {
+		caches = map[time.Duration]cache.Cache{}
+		service, _ = NewService("i", "s", "u", "r", "/v", []string{"scope"})
+		claims = map[string]interface{}{
+			"sub":     "client",
+			"aud":     []interface{}{"r", "other"},
+			"scope":   "s1 s2",
+			"actions": []interface{}{"read"},
+			"exp":     float64(time.Now().Add(time.Hour).Unix()),
+		}
+	})
+
+	Context("with the required scopes granted", func() {
+		It("allows the access", func() {
+			for _, scopes := range [][]string{nil, {"s1"}, {"s2", "s1"}} {
+				allowed, err := service.Authorize(claims, VerificationOption{TargetScopes: scopes})
+				Expect(err).To(BeNil())
+				Expect(allowed).To(BeTrue())
+			}
+		})
+
+		It("allows the access with the scopes in the scp claim", func() {
+			delete(claims, "scope")
+			claims["scp"] = []interface{}{"s1", "s3"}
+			allowed, err := service.Authorize(claims, VerificationOption{TargetScopes: []string{"s1", "s3"}})
+			Expect(err).To(BeNil())
+			Expect(allowed).To(BeTrue())
+		})
+	})
+
+	Context("with a required scope not granted", func() {
+		It("denies the access", func() {
+			allowed, err := service.Authorize(claims, VerificationOption{TargetScopes: []string{"s1", "s3"}})
+			Expect(err).To(BeNil())
+			Expect(allowed).To(BeFalse())
+
+			delete(claims, "scope")
+			allowed, err = service.Authorize(claims, VerificationOption{TargetScopes: []string{"s1"}})
+			Expect(err).To(BeNil())
+			Expect(allowed).To(BeFalse())
+		})
+	})
+
+	Context("with a resource", func() {
+		It("allows the access only if the resource is in the audience", func() {
+			allowed, _ := service.Authorize(claims, VerificationOption{Resource: "other"})
+			Expect(allowed).To(BeTrue())
+
+			allowed, _ = service.Authorize(claims, VerificationOption{Resource: "unknown"})
+			Expect(allowed).To(BeFalse())
+
+			claims["aud"] = "unknown"
+			allowed, _ = service.Authorize(claims, VerificationOption{})
+			Expect(allowed).To(BeFalse())
+		})
+	})
+
+	Context("with an action", func() {
+		It("allows the access only if the action is granted", func() {
+			allowed, _ := service.Authorize(claims, VerificationOption{Action: "read"})
+			Expect(allowed).To(BeTrue())
+
+			allowed, _ = service.Authorize(claims, VerificationOption{Action: "write"})
+			Expect(allowed).To(BeFalse())
+
+			claims["actions"] = "*"
+			allowed, _ = service.Authorize(claims, VerificationOption{Action: "write"})
+			Expect(allowed).To(BeTrue())
+		})
+	})
+
+	Context("with an expired token", func() {
+		It("denies the access", func() {
+			claims["exp"] = float64(time.Now().Add(-time.Minute).Unix())
+			allowed, err := service.Authorize(claims, VerificationOption{})
+			Expect(err).To(BeNil())
+			Expect(allowed).To(BeFalse())
+
+			claims["exp"] = time.Now().Add(-time.Minute).Format(iso8601)
+			allowed, err = service.Authorize(claims, VerificationOption{})
+			Expect(err).To(BeNil())
+			Expect(allowed).To(BeFalse())
+		})
+
+		It("returns an error with an invalid exp", func() {
+			claims["exp"] = "tomorrow"
+			allowed, err := service.Authorize(claims, VerificationOption{})
+			Expect(err).To(HaveOccurred())
+			Expect(allowed).To(BeFalse())
+		})
+	})
+
+	Context("with a token that is not valid yet", func() {
+		It("denies the access", func() {
+			claims["nbf"] = float64(time.Now().Add(time.Minute).Unix())
+			allowed, err := service.Authorize(claims, VerificationOption{})
+			Expect(err).To(BeNil())
+			Expect(allowed).To(BeFalse())
+
+			claims["nbf"] = float64(time.Now().Add(-time.Minute).Unix())
+			allowed, err = service.Authorize(claims, VerificationOption{})
+			Expect(err).To(BeNil())
+			Expect(allowed).To(BeTrue())
+		})
+
+		It("returns an error with an invalid nbf", func() {
+			claims["nbf"] = "yesterday"
+			allowed, err := service.Authorize(claims, VerificationOption{})
+			Expect(err).To(HaveOccurred())
+			Expect(allowed).To(BeFalse())
+		})
+	})
+
+	Context("with an unexpected issuer", func() {
+		It("returns an error", func() {
+			service.ExpectedIssuer = "https://oauth.example.com"
+			claims["iss"] = "https://evil.example.com"
+			allowed, err := service.Authorize(claims, VerificationOption{})
+			_, yes := err.(AuthenticationError)
+			Expect(yes).To(BeTrue())
+			Expect(allowed).To(BeFalse())
+		})
+	})
+
+	Context("without claims", func() {
+		It("denies the access", func() {
+			allowed, err := service.Authorize(nil, VerificationOption{})
+			Expect(err).To(BeNil())
+			Expect(allowed).To(BeFalse())
+		})
+	})
+})
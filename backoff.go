@@ -0,0 +1,32 @@
+package sand
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//randLock guards the Rand of the clients, which is not safe for concurrent use
+var randLock sync.Mutex
+
+//backoff returns how long to wait before the retry, which is 1, 2, 4, 8,... seconds
+//plus the jitter.
+func (c *Client) backoff(retry int) time.Duration {
+	sleep := time.Duration(math.Pow(2, float64(retry))) * time.Second
+	if c.BackoffJitter > 0 {
+		sleep += time.Duration(c.randFloat64() * c.BackoffJitter * float64(sleep))
+	}
+	return sleep
+}
+
+//randFloat64 returns a random number in [0.0, 1.0) from Rand, or from math/rand if
+//Rand is nil.
+func (c *Client) randFloat64() float64 {
+	if c.Rand == nil {
+		return rand.Float64()
+	}
+	randLock.Lock()
+	defer randLock.Unlock()
+	return c.Rand.Float64()
+}
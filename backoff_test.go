@@ -0,0 +1,49 @@
+package sand
+
+import (
+	"math/rand"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backoff", func() {
+	var client *Client
+
+	BeforeEach(func() {
+		client, _ = NewClientWithCache("i", "s", "u", nil)
+	})
+
+	Context("without jitter", func() {
+		It("doubles the backoff on every retry", func() {
+			for retry, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+				Expect(client.backoff(retry)).To(Equal(expected))
+			}
+		})
+	})
+
+	Context("with jitter", func() {
+		It("returns the same schedule with the same seed", func() {
+			client.BackoffJitter = 0.5
+			client.Rand = rand.New(rand.NewSource(42))
+			var schedule []time.Duration
+			for retry := 0; retry < 4; retry++ {
+				schedule = append(schedule, client.backoff(retry))
+			}
+
+			r := rand.New(rand.NewSource(42))
+			for retry, sleep := range schedule {
+				base := time.Duration(1<<uint(retry)) * time.Second
+				Expect(sleep).To(Equal(base + time.Duration(r.Float64()*0.5*float64(base))))
+				Expect(sleep).To(BeNumerically(">=", base))
+				Expect(sleep).To(BeNumerically("<", base+base/2))
+			}
+
+			client.Rand = rand.New(rand.NewSource(42))
+			for retry := 0; retry < 4; retry++ {
+				Expect(client.backoff(retry)).To(Equal(schedule[retry]))
+			}
+		})
+	})
+})
@@ -0,0 +1,45 @@
+package sand
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+//sharedAccessTokenKey is the context key of the service access token shared by the
+//verifications of a batch
+type sharedAccessTokenKey struct{}
+
+//sharedAccessToken is the service access token fetched once for a batch
+type sharedAccessToken struct {
+	once  sync.Once
+	token string
+	err   error
+}
+
+//VerifyTokensWithCache verifies the tokens concurrently with VerifyTokenWithCache
+//and the same option, and returns the responses and errors in the order of the
+//tokens. The service access token is fetched at most once for the whole batch
+//and shared by its verifications, so that a cold cache doesn't make them all
+//request a token. If fetching the service access token fails, the error is returned
+//for all the tokens that are not cached.
+func (s *Service) VerifyTokensWithCache(tokens []string, opt VerificationOption) ([]map[string]interface{}, []error) {
+	parent := opt.RequestContext
+	if parent == nil {
+		parent = context.Background()
+	}
+	opt.RequestContext = context.WithValue(parent, sharedAccessTokenKey{}, &sharedAccessToken{})
+
+	responses := make([]map[string]interface{}, len(tokens))
+	errs := make([]error, len(tokens))
+	var wg sync.WaitGroup
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			responses[i], errs[i] = s.VerifyTokenWithCache(token, opt)
+		}(i, token)
+	}
+	wg.Wait()
+	return responses, errs
+}
@@ -0,0 +1,84 @@
+package sand
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/coupa/sand-go/cache"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("VerifyTokensWithCache", func() {
+	var (
+		service       *Service
+		ts            *httptest.Server
+		mutex         sync.Mutex
+		tokenRequests int
+		verifications int
+		tokenStatus   int
+	)
+
+	BeforeEach(func() {
+		caches = map[time.Duration]cache.Cache{}
+		client, _ := NewClientWithCache("i", "s", "u", cache.NewGoCache(time.Hour, time.Hour))
+		client.DefaultRetryCount = 0
+		service, _ = NewServiceFromClient(client, "r", "/v", []string{"scope"})
+		tokenRequests, verifications, tokenStatus = 0, 0, http.StatusOK
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			mutex.Lock()
+			defer mutex.Unlock()
+			if r.RequestURI == "/" {
+				tokenRequests++
+				//Let the other verifications of the batch reach the token fetch
+				time.Sleep(50 * time.Millisecond)
+				w.WriteHeader(tokenStatus)
+				fmt.Fprintf(w, `{"access_token":"def","expires_in":3600}`)
+			} else if r.RequestURI == "/v" {
+				verifications++
+				Expect(r.Header.Get("Authorization")).To(Equal("Bearer def"))
+				var body map[string]interface{}
+				json.NewDecoder(r.Body).Decode(&body)
+				fmt.Fprintf(w, `{"allowed":%v}`, body["token"] != "denied")
+			}
+		}))
+		service.TokenURL = ts.URL
+		service.TokenVerifyURL = ts.URL + "/v"
+	})
+	AfterEach(func() {
+		ts.Close()
+		service.Close()
+	})
+
+	It("fetches the service access token once for the batch", func() {
+		tokens := make([]string, 10)
+		for i := range tokens {
+			tokens[i] = fmt.Sprintf("token-%d", i)
+		}
+		tokens[3] = "denied"
+		responses, errs := service.VerifyTokensWithCache(tokens, VerificationOption{})
+		Expect(tokenRequests).To(Equal(1))
+		Expect(verifications).To(Equal(10))
+		for i := range tokens {
+			Expect(errs[i]).To(BeNil())
+			Expect(responses[i]["allowed"]).To(Equal(i != 3))
+		}
+	})
+
+	It("returns the failure of the service access token for all the tokens", func() {
+		tokenStatus = http.StatusBadRequest
+		responses, errs := service.VerifyTokensWithCache([]string{"a", "b", "c"}, VerificationOption{})
+		Expect(verifications).To(Equal(0))
+		for i := range responses {
+			_, yes := errs[i].(AuthenticationError)
+			Expect(yes).To(BeTrue())
+			Expect(responses[i]).To(Equal(notAllowedResponse))
+		}
+	})
+})
@@ -9,3 +9,26 @@ type Cache interface {
 	Delete(string)
 	Clear()
 }
+
+//ErrorReader can be implemented by caches that can report failures when reading,
+//e.g., when the cache server is unavailable.
+type ErrorReader interface {
+	ReadWithError(string) (interface{}, error)
+}
+
+//Stopper can be implemented by caches that run in the background, e.g., to delete
+//the expired items, so that they can be stopped when they are no longer used.
+type Stopper interface {
+	Stop()
+}
+
+//Sizer can be implemented by caches that can count their items
+type Sizer interface {
+	ItemCount() int
+}
+
+//AgeReader can be implemented by caches that know when the items were written, so
+//that the age of a cached item can be reported.
+type AgeReader interface {
+	Age(string) (time.Duration, bool)
+}
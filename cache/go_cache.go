@@ -1,6 +1,8 @@
 package cache
 
 import (
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
@@ -8,27 +10,128 @@ import (
 
 type GoCache struct {
 	cache.Cache
+
+	//DeleteExpiredOnRead deletes an item when a read finds it expired instead of
+	//keeping it until the next cleanup, e.g., for a memory constrained sidecar with a
+	//long cleanup interval. A write of the same key between the read and the
+	//deletion may be deleted too, which is only a cache miss.
+	DeleteExpiredOnRead bool
+
+	cleanupInterval time.Duration
+	stop            chan struct{}
+	stopOnce        sync.Once
+	writeTimes      *writeTimes
+}
+
+//writeTimes keeps the times when the items were written
+type writeTimes struct {
+	sync.Mutex
+	times map[string]time.Time
 }
 
-//NewGoCache creates a new GoCache.
+//NewGoCache creates a new GoCache. The expired items are deleted from the cache
+//every cleanupInterval until Stop is called.
 func NewGoCache(defaultExpiration, cleanupInterval time.Duration) *GoCache {
-	return &GoCache{*cache.New(defaultExpiration, cleanupInterval)}
+	//The go-cache janitor cannot be stopped, so the cache is created without it
+	//and the expired items are deleted by the janitor of GoCache instead.
+	c := &GoCache{
+		Cache:           *cache.New(defaultExpiration, 0),
+		cleanupInterval: cleanupInterval,
+		stop:            make(chan struct{}),
+		writeTimes:      &writeTimes{times: map[string]time.Time{}},
+	}
+	//The callback must not reference the GoCache for the same reason as the janitor
+	times := c.writeTimes
+	c.OnEvicted(func(key string, _ interface{}) {
+		times.Lock()
+		delete(times.times, key)
+		times.Unlock()
+	})
+	if cleanupInterval > 0 {
+		//The janitor only references a copy of the go-cache, which shares its items,
+		//so that an unused GoCache can still be garbage collected, which stops the
+		//janitor.
+		go runJanitor(c.Cache, cleanupInterval, c.stop)
+		runtime.SetFinalizer(c, (*GoCache).Stop)
+	}
+	return c
+}
+
+//runJanitor deletes the expired items from the cache every interval until stop is closed.
+func runJanitor(c cache.Cache, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.DeleteExpired()
+		case <-stop:
+			return
+		}
+	}
+}
+
+//CleanupInterval returns the interval at which the expired items are deleted.
+func (c *GoCache) CleanupInterval() time.Duration {
+	return c.cleanupInterval
+}
+
+//Stop stops deleting the expired items in the background. The cache can still be
+//used after it is stopped, and the expired items are still not returned.
+func (c *GoCache) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
 }
 
 func (c *GoCache) Read(key string) interface{} {
-	item, _ := c.Get(key)
+	item, found := c.Get(key)
+	if !found && c.DeleteExpiredOnRead {
+		c.deleteIfWritten(key)
+	}
 	return item
 }
 
+//deleteIfWritten deletes the key if it is still in the cache, i.e., it expired
+func (c *GoCache) deleteIfWritten(key string) {
+	c.writeTimes.Lock()
+	_, written := c.writeTimes.times[key]
+	c.writeTimes.Unlock()
+	if written {
+		c.Delete(key)
+	}
+}
+
 //For oauth2, exp being 0 means no expiration
 func (c *GoCache) Write(key string, item interface{}, exp time.Duration) error {
 	if exp == cache.DefaultExpiration {
 		exp = cache.NoExpiration
 	}
+	c.writeTimes.Lock()
+	c.writeTimes.times[key] = time.Now()
+	c.writeTimes.Unlock()
 	c.Set(key, item, exp)
 	return nil
 }
 
+//Age returns how long ago the item of the key was written, and false if the item is
+//not in the cache.
+func (c *GoCache) Age(key string) (time.Duration, bool) {
+	if _, found := c.Get(key); !found {
+		return 0, false
+	}
+	c.writeTimes.Lock()
+	defer c.writeTimes.Unlock()
+	written, ok := c.writeTimes.times[key]
+	if !ok {
+		return 0, false
+	}
+	return time.Since(written), true
+}
+
 func (c *GoCache) Clear() {
 	c.Flush()
+	c.writeTimes.Lock()
+	c.writeTimes.times = map[string]time.Time{}
+	c.writeTimes.Unlock()
 }
@@ -1,6 +1,7 @@
 package cache_test
 
 import (
+	"runtime"
 	"time"
 
 	. "github.com/coupa/sand-go/cache"
@@ -29,6 +30,28 @@ var _ = Describe("GoCache", func() {
 		})
 	})
 
+	Describe("DeleteExpiredOnRead", func() {
+		It("deletes an expired item when it is read", func() {
+			goCache.DeleteExpiredOnRead = true
+			goCache.Write("test", "hello", 1*time.Millisecond)
+			goCache.Write("test2", "hello2", time.Duration(0))
+			time.Sleep(10 * time.Millisecond)
+			Expect(goCache.ItemCount()).To(Equal(2))
+
+			Expect(goCache.Read("test")).To(BeNil())
+			Expect(goCache.ItemCount()).To(Equal(1))
+			Expect(goCache.Items()).NotTo(HaveKey("test"))
+			Expect(goCache.Read("test2")).To(Equal("hello2"))
+		})
+
+		It("keeps an expired item until the cleanup by default", func() {
+			goCache.Write("test", "hello", 1*time.Millisecond)
+			time.Sleep(10 * time.Millisecond)
+			Expect(goCache.Read("test")).To(BeNil())
+			Expect(goCache.ItemCount()).To(Equal(1))
+		})
+	})
+
 	Describe("Write", func() {
 		It("setting expiry time 0 means no expiration and not default expiration time", func() {
 			goCache = NewGoCache(10*time.Millisecond, 1*time.Millisecond)
@@ -43,6 +66,86 @@ var _ = Describe("GoCache", func() {
 		})
 	})
 
+	Describe("CleanupInterval", func() {
+		It("returns the cleanup interval", func() {
+			Expect(goCache.CleanupInterval()).To(Equal(1 * time.Second))
+		})
+
+		It("deletes the expired items within the cleanup interval", func() {
+			goCache = NewGoCache(time.Hour, 10*time.Millisecond)
+			goCache.Write("test", "hello", 1*time.Millisecond)
+			goCache.Write("test2", "hello2", time.Duration(0))
+			Expect(goCache.ItemCount()).To(Equal(2))
+			Eventually(goCache.ItemCount, 100*time.Millisecond).Should(Equal(1))
+			Expect(goCache.Read("test2")).To(Equal("hello2"))
+		})
+	})
+
+	Describe("Age", func() {
+		It("returns how long ago the item was written", func() {
+			_, ok := goCache.Age("test")
+			Expect(ok).To(BeFalse())
+
+			goCache.Write("test", "hello", time.Duration(0))
+			time.Sleep(10 * time.Millisecond)
+			age, ok := goCache.Age("test")
+			Expect(ok).To(BeTrue())
+			Expect(age).To(BeNumerically(">=", 10*time.Millisecond))
+
+			time.Sleep(10 * time.Millisecond)
+			older, _ := goCache.Age("test")
+			Expect(older).To(BeNumerically(">=", age+10*time.Millisecond))
+
+			goCache.Write("test", "hello", time.Duration(0))
+			newer, _ := goCache.Age("test")
+			Expect(newer).To(BeNumerically("<", age))
+		})
+
+		It("forgets the items that are deleted or expired", func() {
+			goCache = NewGoCache(time.Hour, 5*time.Millisecond)
+			goCache.Write("test", "hello", time.Duration(0))
+			goCache.Write("test2", "hello2", time.Millisecond)
+			goCache.Delete("test")
+			_, ok := goCache.Age("test")
+			Expect(ok).To(BeFalse())
+			Eventually(func() bool {
+				_, ok := goCache.Age("test2")
+				return ok
+			}).Should(BeFalse())
+
+			goCache.Write("test", "hello", time.Duration(0))
+			goCache.Clear()
+			_, ok = goCache.Age("test")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("Stop", func() {
+		It("stops deleting the expired items", func() {
+			goCache = NewGoCache(time.Hour, 10*time.Millisecond)
+			goCache.Stop()
+			goCache.Write("test", "hello", 1*time.Millisecond)
+			time.Sleep(50 * time.Millisecond)
+			Expect(goCache.ItemCount()).To(Equal(1))
+			Expect(goCache.Read("test")).To(BeNil())
+		})
+
+		It("can be called more than once", func() {
+			goCache.Stop()
+			goCache.Stop()
+		})
+
+		It("does not leak goroutines", func() {
+			goCache.Stop()
+			before := runtime.NumGoroutine()
+			for i := 0; i < 100; i++ {
+				c := NewGoCache(time.Hour, time.Millisecond)
+				c.Stop()
+			}
+			Eventually(runtime.NumGoroutine).Should(BeNumerically("<=", before))
+		})
+	})
+
 	Describe("Delete", func() {
 		It("deletes an item from the cache", func() {
 			goCache.Write("test", "hello", time.Duration(0))
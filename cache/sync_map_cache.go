@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+//SyncMapCache is a cache over sync.Map for immutable data, e.g., JWKS or
+//configuration fetched once. The items never expire, so there is no background
+//cleanup, and the expiration times given to Write are ignored.
+type SyncMapCache struct {
+	items sync.Map
+}
+
+//NewSyncMapCache creates a new SyncMapCache
+func NewSyncMapCache() *SyncMapCache {
+	return &SyncMapCache{}
+}
+
+func (c *SyncMapCache) Read(key string) interface{} {
+	item, _ := c.items.Load(key)
+	return item
+}
+
+//Write stores the item without expiration regardless of exp
+func (c *SyncMapCache) Write(key string, item interface{}, exp time.Duration) error {
+	c.items.Store(key, item)
+	return nil
+}
+
+func (c *SyncMapCache) Delete(key string) {
+	c.items.Delete(key)
+}
+
+func (c *SyncMapCache) Clear() {
+	c.items.Range(func(key, _ interface{}) bool {
+		c.items.Delete(key)
+		return true
+	})
+}
+
+//ItemCount returns the number of items in the cache
+func (c *SyncMapCache) ItemCount() int {
+	count := 0
+	c.items.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
@@ -0,0 +1,89 @@
+package cache_test
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/coupa/sand-go/cache"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SyncMapCache", func() {
+	var syncMapCache *SyncMapCache
+	BeforeEach(func() {
+		syncMapCache = NewSyncMapCache()
+	})
+
+	Describe("Read", func() {
+		It("reads values from the cache", func() {
+			Expect(syncMapCache.Read("test")).To(BeNil())
+
+			syncMapCache.Write("test", "hello", time.Duration(0))
+			Expect(syncMapCache.Read("test")).To(Equal("hello"))
+			Expect(syncMapCache.Read("test2")).To(BeNil())
+		})
+	})
+
+	Describe("Write", func() {
+		It("ignores the expiry time", func() {
+			syncMapCache.Write("test", "hello", time.Millisecond)
+			time.Sleep(10 * time.Millisecond)
+			Expect(syncMapCache.Read("test")).To(Equal("hello"))
+		})
+	})
+
+	Describe("Delete", func() {
+		It("deletes the value", func() {
+			syncMapCache.Write("test", "hello", time.Duration(0))
+			syncMapCache.Write("test2", "hello2", time.Duration(0))
+			syncMapCache.Delete("test")
+			Expect(syncMapCache.Read("test")).To(BeNil())
+			Expect(syncMapCache.Read("test2")).To(Equal("hello2"))
+		})
+	})
+
+	Describe("Clear", func() {
+		It("deletes all the values", func() {
+			syncMapCache.Write("test", "hello", time.Duration(0))
+			syncMapCache.Write("test2", "hello2", time.Duration(0))
+			syncMapCache.Clear()
+			Expect(syncMapCache.Read("test")).To(BeNil())
+			Expect(syncMapCache.Read("test2")).To(BeNil())
+			Expect(syncMapCache.ItemCount()).To(Equal(0))
+		})
+	})
+
+	Describe("concurrent access", func() {
+		It("is safe for concurrent Read, Write, Delete and Clear", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					for j := 0; j < 100; j++ {
+						key := fmt.Sprintf("key-%d", j%10)
+						syncMapCache.Write(key, i, time.Duration(0))
+						if value := syncMapCache.Read(key); value != nil {
+							Expect(value).To(BeNumerically(">=", 0))
+						}
+						if j%7 == 0 {
+							syncMapCache.Delete(key)
+						}
+						if j%50 == 0 {
+							syncMapCache.Clear()
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			syncMapCache.Write("final", "value", time.Duration(0))
+			Expect(syncMapCache.Read("final")).To(Equal("value"))
+			Expect(syncMapCache.ItemCount()).To(BeNumerically("<=", 11))
+		})
+	})
+})
@@ -0,0 +1,59 @@
+package sand
+
+import (
+	"expvar"
+	"sync/atomic"
+
+	"github.com/coupa/sand-go/cache"
+)
+
+//CacheStats is a snapshot of the cache usage of a client or service
+type CacheStats struct {
+	//Hits is the number of cache reads that found a value
+	Hits int64 `json:"hits"`
+	//Misses is the number of cache reads that found no value or failed
+	Misses int64 `json:"misses"`
+	//Size is the number of items in the cache, which may be shared with other clients,
+	//or -1 if the cache does not implement cache.Sizer.
+	Size int `json:"size"`
+}
+
+//cacheCounters counts the cache reads of a client
+type cacheCounters struct {
+	hits   int64
+	misses int64
+}
+
+func (c *Client) countCacheRead(hit bool) {
+	if c.counters == nil {
+		return
+	}
+	if hit {
+		atomic.AddInt64(&c.counters.hits, 1)
+	} else {
+		atomic.AddInt64(&c.counters.misses, 1)
+	}
+}
+
+//CacheStats returns the cache hits and misses of the client since it was created,
+//and the current size of its cache.
+func (c *Client) CacheStats() CacheStats {
+	stats := CacheStats{Size: -1}
+	if c.counters != nil {
+		stats.Hits = atomic.LoadInt64(&c.counters.hits)
+		stats.Misses = atomic.LoadInt64(&c.counters.misses)
+	}
+	if sizer, ok := c.Cache.(cache.Sizer); ok {
+		stats.Size = sizer.ItemCount()
+	}
+	return stats
+}
+
+//PublishExpvar publishes the CacheStats of the client with expvar under the name,
+//e.g., "sand.client", so that they are served at /debug/vars with the
+//expvar handler. Like expvar.Publish, it panics if the name is already published.
+func (c *Client) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return c.CacheStats()
+	}))
+}
@@ -0,0 +1,64 @@
+package sand
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/coupa/sand-go/cache"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CacheStats", func() {
+	var (
+		client *Client
+		ts     *httptest.Server
+	)
+
+	BeforeEach(func() {
+		client, _ = NewClientWithCache("i", "s", "u", cache.NewGoCache(time.Hour, time.Hour))
+		client.DefaultRetryCount = 0
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":"abc","expires_in":3600}`)
+		}))
+		client.TokenURL = ts.URL
+	})
+	AfterEach(func() {
+		ts.Close()
+		client.Close()
+	})
+
+	It("counts the cache hits and misses", func() {
+		Expect(client.CacheStats()).To(Equal(CacheStats{Size: 0}))
+		for i := 0; i < 3; i++ {
+			_, err := client.Token("resource", []string{"scope"}, -1)
+			Expect(err).To(BeNil())
+		}
+		Expect(client.CacheStats()).To(Equal(CacheStats{Hits: 2, Misses: 1, Size: 1}))
+	})
+
+	It("reports an unknown size for caches that cannot count their items", func() {
+		client.Cache = &ttlCache{}
+		Expect(client.CacheStats().Size).To(Equal(-1))
+	})
+
+	Describe("#PublishExpvar", func() {
+		It("publishes the stats with expvar", func() {
+			client.PublishExpvar("sand.test.client")
+			_, err := client.Token("resource", []string{"scope"}, -1)
+			Expect(err).To(BeNil())
+
+			v := expvar.Get("sand.test.client")
+			Expect(v).NotTo(BeNil())
+			var stats map[string]int
+			Expect(json.Unmarshal([]byte(v.String()), &stats)).To(Succeed())
+			Expect(stats).To(Equal(map[string]int{"hits": 0, "misses": 1, "size": 1}))
+		})
+	})
+})
@@ -0,0 +1,162 @@
+package sand
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//ServiceConfig is the configuration of a Service for NewServiceFromConfig, e.g.,
+//loaded from a YAML file or the environment. The fields are described on Client and
+//Service. Zero values keep the defaults of NewService, and the functions, caches and
+//transports are set on the returned Service.
+type ServiceConfig struct {
+	//Required fields
+	ClientID       string
+	ClientSecret   string
+	TokenURL       string
+	Resource       string
+	TokenVerifyURL string
+
+	Scopes         []string
+	Context        map[string]interface{}
+	DefaultExpTime int
+
+	//DefaultRetryCount and MaxRetryCount are pointers so that 0 can be set.
+	//Default is nil, which keeps the defaults of NewService.
+	DefaultRetryCount *int
+	MaxRetryCount     *int
+
+	RefreshRetryCount          int
+	OperationTimeout           time.Duration
+	BackoffJitter              float64
+	ExpirySkew                 time.Duration
+	SSLMinVersion              uint16
+	SupersetScopes             []string
+	OmitScopesFromTokenRequest bool
+	MaxConcurrentTokenFetches  int
+	CacheErrorPolicy           CacheErrorPolicy
+	ExpiredTokenBehavior       ExpiredTokenBehavior
+	ResponseHeaders            []string
+	CacheRoot                  string
+	CorrelationIDHeader        string
+	AuthorizationScheme        string
+
+	ExpectedIssuer            string
+	ExpectedAudience          string
+	DenialCaching             DenialCaching
+	EmptyScopeBehavior        EmptyScopeBehavior
+	VerifyEncoding            VerifyEncoding
+	UseNonce                  bool
+	StrictAuthorizationHeader bool
+	RequestFieldNames         map[string]string
+	TrustedTokens             map[string]map[string]interface{}
+	ExpiredTokenGrace         time.Duration
+	VerifyHeaders             http.Header
+	RetryVerifyStatuses       []int
+	VolatileResponseFields    []string
+	AccessTokenCacheID        string
+	ClientIPKey               string
+	UserAgentKey              string
+	TrustedProxies            int
+	JWKSURL                   string
+}
+
+//NewServiceFromConfig returns a Service with the configuration. A missing required
+//field or a malformed URL returns a ValidationError of kind InvalidConfig. The URLs
+//are normalized like in NewValidatedService.
+func NewServiceFromConfig(config ServiceConfig) (*Service, error) {
+	if err := config.checkRequired(); err != nil {
+		return nil, err
+	}
+	service, err := NewValidatedService(config.ClientID, config.ClientSecret, config.TokenURL,
+		config.Resource, config.TokenVerifyURL, config.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	if config.JWKSURL != "" {
+		if service.JWKSURL, err = normalizeEndpointURL("JWKSURL", config.JWKSURL); err != nil {
+			return nil, err
+		}
+	}
+	config.apply(service)
+	return service, nil
+}
+
+//checkRequired returns a ValidationError listing the missing required fields
+func (config ServiceConfig) checkRequired() error {
+	var missing []string
+	for _, field := range []struct{ name, value string }{
+		{"ClientID", config.ClientID},
+		{"ClientSecret", config.ClientSecret},
+		{"TokenURL", config.TokenURL},
+		{"Resource", config.Resource},
+		{"TokenVerifyURL", config.TokenVerifyURL},
+	} {
+		if strings.TrimSpace(field.value) == "" {
+			missing = append(missing, field.name)
+		}
+	}
+	if len(missing) > 0 {
+		return ValidationError{InvalidConfig, fmt.Sprintf("missing required field(s): %s", strings.Join(missing, ", "))}
+	}
+	return nil
+}
+
+//apply sets the optional fields of the configuration that are not zero on the service
+func (config ServiceConfig) apply(s *Service) {
+	if len(config.Context) > 0 {
+		s.Context = config.Context
+	}
+	if config.DefaultExpTime != 0 {
+		s.DefaultExpTime = config.DefaultExpTime
+	}
+	if config.DefaultRetryCount != nil {
+		s.DefaultRetryCount = *config.DefaultRetryCount
+	}
+	if config.MaxRetryCount != nil {
+		s.MaxRetryCount = *config.MaxRetryCount
+	}
+	if config.SSLMinVersion != 0 {
+		s.SSLMinVersion = config.SSLMinVersion
+	}
+	if config.CacheRoot != "" {
+		s.CacheRoot = config.CacheRoot
+	}
+	if config.CorrelationIDHeader != "" {
+		s.CorrelationIDHeader = config.CorrelationIDHeader
+	}
+	if config.AuthorizationScheme != "" {
+		s.AuthorizationScheme = config.AuthorizationScheme
+	}
+	//The defaults of the rest are their zero values
+	s.RefreshRetryCount = config.RefreshRetryCount
+	s.OperationTimeout = config.OperationTimeout
+	s.BackoffJitter = config.BackoffJitter
+	s.ExpirySkew = config.ExpirySkew
+	s.SupersetScopes = config.SupersetScopes
+	s.OmitScopesFromTokenRequest = config.OmitScopesFromTokenRequest
+	s.MaxConcurrentTokenFetches = config.MaxConcurrentTokenFetches
+	s.CacheErrorPolicy = config.CacheErrorPolicy
+	s.ExpiredTokenBehavior = config.ExpiredTokenBehavior
+	s.ResponseHeaders = config.ResponseHeaders
+
+	s.ExpectedIssuer = config.ExpectedIssuer
+	s.ExpectedAudience = config.ExpectedAudience
+	s.DenialCaching = config.DenialCaching
+	s.EmptyScopeBehavior = config.EmptyScopeBehavior
+	s.VerifyEncoding = config.VerifyEncoding
+	s.UseNonce = config.UseNonce
+	s.StrictAuthorizationHeader = config.StrictAuthorizationHeader
+	s.RequestFieldNames = config.RequestFieldNames
+	s.TrustedTokens = config.TrustedTokens
+	s.ExpiredTokenGrace = config.ExpiredTokenGrace
+	s.VerifyHeaders = config.VerifyHeaders
+	s.RetryVerifyStatuses = config.RetryVerifyStatuses
+	s.VolatileResponseFields = config.VolatileResponseFields
+	s.AccessTokenCacheID = config.AccessTokenCacheID
+	s.ClientIPKey = config.ClientIPKey
+	s.UserAgentKey = config.UserAgentKey
+	s.TrustedProxies = config.TrustedProxies
+}
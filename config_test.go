@@ -0,0 +1,148 @@
+package sand
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/coupa/sand-go/cache"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NewServiceFromConfig", func() {
+	var config ServiceConfig
+
+	BeforeEach(func() {
+		caches = map[time.Duration]cache.Cache{}
+		config = ServiceConfig{
+			ClientID:       "i",
+			ClientSecret:   "s",
+			TokenURL:       " https://OAuth.example.com/token ",
+			Resource:       "r",
+			TokenVerifyURL: "https://oauth.example.com/warden/token/allowed",
+			Scopes:         []string{"scope"},
+		}
+	})
+
+	It("constructs the service with a complete config", func() {
+		zero := 0
+		config.Context = map[string]interface{}{"region": "us"}
+		config.DefaultExpTime = 60
+		config.DefaultRetryCount = &zero
+		config.MaxRetryCount = &zero
+		config.RefreshRetryCount = 1
+		config.OperationTimeout = 10 * time.Second
+		config.BackoffJitter = 0.5
+		config.ExpirySkew = time.Minute
+		config.SSLMinVersion = tls.VersionTLS13
+		config.SupersetScopes = []string{"scope", "other"}
+		config.OmitScopesFromTokenRequest = true
+		config.MaxConcurrentTokenFetches = 2
+		config.CacheErrorPolicy = FailClosed
+		config.ExpiredTokenBehavior = FailOnExpiredToken
+		config.ResponseHeaders = []string{"X-RateLimit-Remaining"}
+		config.CacheRoot = "root"
+		config.CorrelationIDHeader = "X-Correlation-ID"
+		config.AuthorizationScheme = "Token"
+		config.ExpectedIssuer = "https://oauth.example.com"
+		config.ExpectedAudience = "r"
+		config.DenialCaching = DoNotCacheDenials
+		config.EmptyScopeBehavior = EmptyScopesOmitted
+		config.VerifyEncoding = VerifyAsForm
+		config.UseNonce = true
+		config.StrictAuthorizationHeader = true
+		config.RequestFieldNames = map[string]string{"token": "client_token"}
+		config.TrustedTokens = map[string]map[string]interface{}{"internal": {"sub": "job"}}
+		config.ExpiredTokenGrace = 30 * time.Second
+		config.VerifyHeaders = http.Header{"X-Gateway": {"sand"}}
+		config.RetryVerifyStatuses = []int{http.StatusServiceUnavailable}
+		config.VolatileResponseFields = []string{"jti"}
+		config.AccessTokenCacheID = "service"
+		config.ClientIPKey = DefaultClientIPKey
+		config.UserAgentKey = "user_agent"
+		config.TrustedProxies = 1
+		config.JWKSURL = "https://OAuth.example.com/jwks"
+
+		service, err := NewServiceFromConfig(config)
+		Expect(err).To(BeNil())
+		Expect(service.ClientID).To(Equal("i"))
+		Expect(service.ClientSecret).To(Equal("s"))
+		Expect(service.TokenURL).To(Equal("https://oauth.example.com/token"))
+		Expect(service.Resource).To(Equal("r"))
+		Expect(service.TokenVerifyURL).To(Equal("https://oauth.example.com/warden/token/allowed"))
+		Expect(service.Scopes).To(Equal([]string{"scope"}))
+		Expect(service.Context).To(Equal(config.Context))
+		Expect(service.DefaultExpTime).To(Equal(60))
+		Expect(service.DefaultRetryCount).To(Equal(0))
+		Expect(service.MaxRetryCount).To(Equal(0))
+		Expect(service.RefreshRetryCount).To(Equal(1))
+		Expect(service.OperationTimeout).To(Equal(10 * time.Second))
+		Expect(service.BackoffJitter).To(Equal(0.5))
+		Expect(service.ExpirySkew).To(Equal(time.Minute))
+		Expect(service.SSLMinVersion).To(Equal(uint16(tls.VersionTLS13)))
+		Expect(service.SupersetScopes).To(Equal([]string{"scope", "other"}))
+		Expect(service.OmitScopesFromTokenRequest).To(BeTrue())
+		Expect(service.MaxConcurrentTokenFetches).To(Equal(2))
+		Expect(service.CacheErrorPolicy).To(Equal(FailClosed))
+		Expect(service.ExpiredTokenBehavior).To(Equal(FailOnExpiredToken))
+		Expect(service.ResponseHeaders).To(Equal([]string{"X-RateLimit-Remaining"}))
+		Expect(service.CacheRoot).To(Equal("root"))
+		Expect(service.CorrelationIDHeader).To(Equal("X-Correlation-ID"))
+		Expect(service.AuthorizationScheme).To(Equal("Token"))
+		Expect(service.ExpectedIssuer).To(Equal("https://oauth.example.com"))
+		Expect(service.ExpectedAudience).To(Equal("r"))
+		Expect(service.DenialCaching).To(Equal(DoNotCacheDenials))
+		Expect(service.EmptyScopeBehavior).To(Equal(EmptyScopesOmitted))
+		Expect(service.VerifyEncoding).To(Equal(VerifyAsForm))
+		Expect(service.UseNonce).To(BeTrue())
+		Expect(service.StrictAuthorizationHeader).To(BeTrue())
+		Expect(service.RequestFieldNames).To(Equal(config.RequestFieldNames))
+		Expect(service.TrustedTokens).To(Equal(config.TrustedTokens))
+		Expect(service.ExpiredTokenGrace).To(Equal(30 * time.Second))
+		Expect(service.VerifyHeaders).To(Equal(config.VerifyHeaders))
+		Expect(service.RetryVerifyStatuses).To(Equal([]int{http.StatusServiceUnavailable}))
+		Expect(service.VolatileResponseFields).To(Equal([]string{"jti"}))
+		Expect(service.AccessTokenCacheID).To(Equal("service"))
+		Expect(service.ClientIPKey).To(Equal(DefaultClientIPKey))
+		Expect(service.UserAgentKey).To(Equal("user_agent"))
+		Expect(service.TrustedProxies).To(Equal(1))
+		Expect(service.JWKSURL).To(Equal("https://oauth.example.com/jwks"))
+	})
+
+	It("keeps the defaults of NewService for the zero values", func() {
+		service, err := NewServiceFromConfig(config)
+		Expect(err).To(BeNil())
+		defaults, _ := NewService("i", "s", "https://oauth.example.com/token", "r", "https://oauth.example.com/warden/token/allowed", []string{"scope"})
+		Expect(service.Context).To(Equal(defaults.Context))
+		Expect(service.DefaultExpTime).To(Equal(DefaultServiceExpTime))
+		Expect(service.DefaultRetryCount).To(Equal(defaults.DefaultRetryCount))
+		Expect(service.MaxRetryCount).To(Equal(DefaultMaxRetryCount))
+		Expect(service.SSLMinVersion).To(Equal(defaults.SSLMinVersion))
+		Expect(service.CacheRoot).To(Equal("sand"))
+		Expect(service.CorrelationIDHeader).To(Equal(defaults.CorrelationIDHeader))
+		Expect(service.AuthorizationScheme).To(Equal("Bearer"))
+		Expect(service.Cache).To(Equal(defaults.Cache))
+	})
+
+	It("returns the missing required fields", func() {
+		_, err := NewServiceFromConfig(ServiceConfig{ClientID: "i", Resource: " "})
+		Expect(err).To(MatchError(ValidationError{InvalidConfig, "missing required field(s): ClientSecret, TokenURL, Resource, TokenVerifyURL"}))
+
+		config.TokenVerifyURL = ""
+		_, err = NewServiceFromConfig(config)
+		Expect(err).To(MatchError(ValidationError{InvalidConfig, "missing required field(s): TokenVerifyURL"}))
+	})
+
+	It("returns the malformed URLs", func() {
+		config.TokenVerifyURL = "/v"
+		_, err := NewServiceFromConfig(config)
+		Expect(err).To(MatchError(ValidationError{InvalidConfig, `invalid TokenVerifyURL "/v": must be an absolute http(s) URL`}))
+
+		config.TokenVerifyURL = "https://oauth.example.com/v"
+		config.JWKSURL = "jwks"
+		_, err = NewServiceFromConfig(config)
+		Expect(err).To(MatchError(ValidationError{InvalidConfig, `invalid JWKSURL "jwks": must be an absolute http(s) URL`}))
+	})
+})
@@ -0,0 +1,55 @@
+package sand
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+//headerTransport sets a header on every request before sending it with the base transport
+type headerTransport struct {
+	base   http.RoundTripper
+	header string
+	value  string
+}
+
+func (t *headerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	//A RoundTripper must not modify the request, so set the header on a copy
+	r = r.Clone(r.Context())
+	r.Header.Set(t.header, t.value)
+	return t.base.RoundTrip(r)
+}
+
+//correlationID returns the correlation ID in ctx, or an empty string if there is none.
+func (c *Client) correlationID(ctx context.Context) string {
+	if c.CorrelationIDKey == nil || ctx == nil {
+		return ""
+	}
+	switch id := ctx.Value(c.CorrelationIDKey).(type) {
+	case nil:
+		return ""
+	case string:
+		return id
+	default:
+		return fmt.Sprint(id)
+	}
+}
+
+//correlationHeader returns the header for sending the correlation ID.
+func (c *Client) correlationHeader() string {
+	if c.CorrelationIDHeader == "" {
+		return "X-Request-ID"
+	}
+	return c.CorrelationIDHeader
+}
+
+//correlationTransport wraps the transport so that the correlation ID in ctx is
+//sent with every request. The transport is returned as is without a correlation ID.
+func (c *Client) correlationTransport(ctx context.Context, transport http.RoundTripper) http.RoundTripper {
+	id := c.correlationID(ctx)
+	if id == "" {
+		return transport
+	}
+	return &headerTransport{base: transport, header: c.correlationHeader(), value: id}
+}
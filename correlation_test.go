@@ -0,0 +1,82 @@
+package sand
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/coupa/sand-go/cache"
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type correlationKey struct{}
+
+var _ = Describe("Correlation", func() {
+	var (
+		service *Service
+		ts      *httptest.Server
+		ids     map[string]string
+	)
+
+	BeforeEach(func() {
+		caches = map[time.Duration]cache.Cache{}
+		service, _ = NewService("i", "s", "u", "r", "/v", []string{"scope"})
+		service.DefaultRetryCount = 0
+		service.Cache = nil
+		service.CorrelationIDKey = correlationKey{}
+		ids = map[string]string{}
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			ids[r.RequestURI] = r.Header.Get("X-Request-ID")
+			if r.RequestURI == "/" {
+				fmt.Fprintf(w, `{"access_token":"def"}`)
+			} else if r.RequestURI == "/v" {
+				fmt.Fprintf(w, `{"allowed":true}`)
+			}
+		}))
+		service.TokenURL = ts.URL
+		service.TokenVerifyURL = ts.URL + "/v"
+	})
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	Context("with a correlation ID in the context", func() {
+		It("sends the correlation ID to SAND", func() {
+			ctx := context.WithValue(context.Background(), correlationKey{}, "req-1")
+			t, err := service.VerifyTokenWithCache("abc", VerificationOption{RequestContext: ctx})
+			Expect(err).To(BeNil())
+			Expect(t["allowed"]).To(Equal(true))
+			Expect(ids).To(Equal(map[string]string{"/": "req-1", "/v": "req-1"}))
+		})
+
+		It("uses the context of the incoming request", func() {
+			r, _ := http.NewRequest("GET", "/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), correlationKey{}, "req-2"))
+			r.Header.Set("Authorization", "Bearer abc")
+			service.CorrelationIDHeader = "X-Correlation-ID"
+			_, err := service.VerifyRequest(r, VerificationOption{})
+			Expect(err).To(BeNil())
+			Expect(ids).To(Equal(map[string]string{"/": "", "/v": ""}))
+
+			ids = map[string]string{}
+			service.CorrelationIDHeader = "X-Request-ID"
+			_, err = service.VerifyRequest(r, VerificationOption{})
+			Expect(err).To(BeNil())
+			Expect(ids).To(Equal(map[string]string{"/": "req-2", "/v": "req-2"}))
+		})
+	})
+
+	Context("without a correlation ID", func() {
+		It("sends no correlation ID", func() {
+			t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+			Expect(err).To(BeNil())
+			Expect(t["allowed"]).To(Equal(true))
+			Expect(ids).To(Equal(map[string]string{"/": "", "/v": ""}))
+		})
+	})
+})
@@ -9,3 +9,72 @@ type AuthenticationError struct {
 func (e AuthenticationError) Error() string {
 	return e.Message
 }
+
+//ConnectionError is returned when the OAuth2 server or the token verification endpoint
+//cannot be reached, e.g., the connection is refused or a proxy rejects the request,
+//or when Client.HealthCheck gets an unhealthy response.
+//Services should respond with 502 on ConnectionError, see Service.ErrorCode.
+type ConnectionError struct {
+	Message string `json:"message"`
+	//StatusCode is the HTTP status code of the proxy response, or 0 if there is no response
+	StatusCode int `json:"status_code"`
+}
+
+func (e ConnectionError) Error() string {
+	return e.Message
+}
+
+//UnavailableError is returned when the OAuth2 server or the token verification endpoint
+//responds that it is rate limiting the requests (429) or temporarily unavailable (503).
+//Services should respond with 503 on UnavailableError, see Service.ErrorCode.
+type UnavailableError struct {
+	Message string `json:"message"`
+	//StatusCode is the HTTP status code of the response
+	StatusCode int `json:"status_code"`
+}
+
+func (e UnavailableError) Error() string {
+	return e.Message
+}
+
+//InvalidRequestError is returned when an incoming request to a service is malformed,
+//e.g., it has more than one Authorization header with StrictAuthorizationHeader.
+//Services should respond with 400 on InvalidRequestError, see Service.ErrorCode.
+type InvalidRequestError struct {
+	Message string `json:"message"`
+}
+
+func (e InvalidRequestError) Error() string {
+	return e.Message
+}
+
+//CacheError is returned when the cache fails and the CacheErrorPolicy is FailClosed
+type CacheError struct {
+	Message string `json:"message"`
+}
+
+func (e CacheError) Error() string {
+	return e.Message
+}
+
+//ValidationErrorKind is the class of failure found by Client.Validate
+type ValidationErrorKind string
+
+const (
+	//InvalidConfig means that the client configuration is invalid, e.g., a bad TokenURL
+	InvalidConfig ValidationErrorKind = "invalid_config"
+	//Unreachable means that the OAuth2 server could not be connected
+	Unreachable ValidationErrorKind = "unreachable"
+	//AuthenticationFailed means that the OAuth2 server did not issue a token
+	AuthenticationFailed ValidationErrorKind = "authentication_failed"
+)
+
+//ValidationError is returned by Client.Validate when the client is misconfigured
+type ValidationError struct {
+	Kind    ValidationErrorKind `json:"kind"`
+	Message string              `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return string(e.Kind) + ": " + e.Message
+}
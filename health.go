@@ -0,0 +1,37 @@
+package sand
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+//HealthCheck checks the health endpoint of the OAuth2 server at healthURL, e.g.,
+//"https://oauth.example.com/health", with a GET request, so that readiness probes
+//don't use up the rate limit of the token endpoint. It returns nil on a 2xx response,
+//an UnavailableError on a 429 or 503 response, and a ConnectionError if the server
+//cannot be reached or responds with any other status. The request is canceled when
+//ctx is done.
+func (c *Client) HealthCheck(ctx context.Context, healthURL string) error {
+	if ctx == nil {
+		ctx = context.TODO()
+	}
+	req, err := http.NewRequest("GET", healthURL, nil)
+	if err != nil {
+		return ConnectionError{Message: "Invalid health URL: " + err.Error()}
+	}
+	resp, err := c.httpClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return ConnectionError{Message: "Failed to check the health: " + err.Error()}
+	}
+	defer closeBody(resp)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	message := fmt.Sprintf("Unhealthy response from the authentication service: %d", resp.StatusCode)
+	if isUnavailableStatus(resp.StatusCode) {
+		return UnavailableError{Message: message, StatusCode: resp.StatusCode}
+	}
+	return ConnectionError{Message: message, StatusCode: resp.StatusCode}
+}
@@ -0,0 +1,76 @@
+package sand
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/coupa/sand-go/cache"
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HealthCheck", func() {
+	var (
+		client *Client
+		ts     *httptest.Server
+		status int
+		method string
+	)
+
+	BeforeEach(func() {
+		caches = map[time.Duration]cache.Cache{}
+		client, _ = NewClient("i", "s", "u")
+		status = http.StatusOK
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method = r.Method
+			w.WriteHeader(status)
+		}))
+	})
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	Context("with a healthy server", func() {
+		It("returns nil", func() {
+			Expect(client.HealthCheck(context.Background(), ts.URL+"/health")).To(Succeed())
+			Expect(method).To(Equal("GET"))
+
+			status = http.StatusNoContent
+			Expect(client.HealthCheck(nil, ts.URL+"/health")).To(Succeed())
+		})
+	})
+
+	Context("with an unhealthy status", func() {
+		It("returns a ConnectionError with the status", func() {
+			status = http.StatusInternalServerError
+			err := client.HealthCheck(context.Background(), ts.URL+"/health")
+			Expect(err).To(Equal(ConnectionError{Message: "Unhealthy response from the authentication service: 500", StatusCode: 500}))
+		})
+
+		It("returns an UnavailableError when the server is unavailable", func() {
+			status = http.StatusServiceUnavailable
+			err := client.HealthCheck(context.Background(), ts.URL+"/health")
+			Expect(err).To(Equal(UnavailableError{Message: "Unhealthy response from the authentication service: 503", StatusCode: 503}))
+		})
+	})
+
+	Context("with an unreachable server", func() {
+		It("returns a ConnectionError", func() {
+			ts.Close()
+			err := client.HealthCheck(context.Background(), ts.URL+"/health")
+			connErr, yes := err.(ConnectionError)
+			Expect(yes).To(BeTrue())
+			Expect(connErr.StatusCode).To(Equal(0))
+		})
+
+		It("returns a ConnectionError when the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, yes := client.HealthCheck(ctx, ts.URL+"/health").(ConnectionError)
+			Expect(yes).To(BeTrue())
+		})
+	})
+})
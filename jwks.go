@@ -0,0 +1,270 @@
+package sand
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+//VerifyHybrid verifies the token locally if it is a JWT signed by a key in the JWKS
+//at JWKSURL, and with SAND otherwise, e.g., for opaque tokens, so that most
+//verifications don't call SAND. A JWT with a valid signature is allowed by the
+//claims as described in Authorize, and an invalid signature is denied. The token is
+//verified with VerifyTokenWithResult if:
+//1. JWKSURL is not set or the JWKS cannot be fetched
+//2. The token is not a JWT, or is signed with an algorithm other than RS256, RS384,
+//   RS512, ES256, ES384 or ES512
+//3. The JWT has no "exp" claim, so that a token without an expiry is not trusted forever
+//4. The "kid" of the JWT is not in the JWKS
+//The JWKS is kept in the cache for DefaultExpTime as its JSON, so that it can be kept
+//in any cache, and a new key is only used after the cached JWKS expires. The results
+//of the local verification are not cached.
+func (s *Service) VerifyHybrid(token string, opt VerificationOption) (*VerificationResult, error) {
+	s.buildOption(&opt)
+	if token == "" || opt.Resource == "" || s.JWKSURL == "" {
+		return s.VerifyTokenWithResult(token, opt)
+	}
+	jwt, ok := parseJWT(token)
+	if !ok {
+		return s.VerifyTokenWithResult(token, opt)
+	}
+	if _, ok = jwt.claims["exp"]; !ok {
+		log.Debugf("Sand JWKS: verifying the token with SAND because it has no exp claim")
+		return s.VerifyTokenWithResult(token, opt)
+	}
+	keys, err := s.jwks(opt.RequestContext)
+	if err != nil {
+		log.Warnf("Sand JWKS: verifying the token with SAND because the JWKS failed to be fetched: %v", err)
+		return s.VerifyTokenWithResult(token, opt)
+	}
+	key, ok := keys[jwt.header.Kid]
+	if !ok {
+		log.Debugf("Sand JWKS: verifying the token with SAND because the key %q is unknown", jwt.header.Kid)
+		return s.VerifyTokenWithResult(token, opt)
+	}
+	if err = jwt.verify(key); err != nil {
+		return &VerificationResult{Response: denialResponse(err.Error()), Reason: err.Error()}, nil
+	}
+	allowed, err := s.Authorize(jwt.claims, opt)
+	if err != nil {
+		return &VerificationResult{Response: notAllowedResponse}, err
+	}
+	if !allowed {
+		return &VerificationResult{Response: notAllowedResponse}, nil
+	}
+	resp := make(map[string]interface{}, len(jwt.claims)+1)
+	for name, value := range jwt.claims {
+		resp[name] = value
+	}
+	resp["allowed"] = true
+	return &VerificationResult{Response: resp, Expiry: responseExpiry(resp)}, nil
+}
+
+//jwtHeader is the JOSE header of a JWT
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+//parsedJWT is a JWT whose signature is not verified yet
+type parsedJWT struct {
+	header    jwtHeader
+	claims    map[string]interface{}
+	signed    string
+	signature []byte
+}
+
+//parseJWT decodes the token as a JWT. It returns false if the token is not a JWT or
+//its algorithm is not supported, so that it is verified with SAND.
+func parseJWT(token string) (*parsedJWT, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	rv := &parsedJWT{signed: parts[0] + "." + parts[1]}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(header, &rv.header) != nil || jwtHash(rv.header.Alg) == 0 {
+		return nil, false
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(claims))
+	decoder.UseNumber()
+	if decoder.Decode(&rv.claims) != nil {
+		return nil, false
+	}
+	if rv.signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, false
+	}
+	return rv, true
+}
+
+//jwtHash returns the hash of the signature algorithm, or 0 if it is not supported
+func jwtHash(alg string) crypto.Hash {
+	switch alg {
+	case "RS256", "ES256":
+		return crypto.SHA256
+	case "RS384", "ES384":
+		return crypto.SHA384
+	case "RS512", "ES512":
+		return crypto.SHA512
+	}
+	return 0
+}
+
+//verify checks the signature of the JWT with the key
+func (t *parsedJWT) verify(key crypto.PublicKey) error {
+	hash := jwtHash(t.header.Alg)
+	h := hash.New()
+	h.Write([]byte(t.signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(t.header.Alg, "RS") && rsa.VerifyPKCS1v15(k, hash, digest, t.signature) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(t.header.Alg, "ES") && len(t.signature) == 2*size {
+			r := new(big.Int).SetBytes(t.signature[:size])
+			sig := new(big.Int).SetBytes(t.signature[size:])
+			if ecdsa.Verify(k, digest, r, sig) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("invalid token signature")
+}
+
+//jsonWebKey is a key of a JWKS. Only the RSA and EC keys are supported.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+//publicKey converts the JWK to a public key
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+//jwks returns the keys of the JWKS at JWKSURL by their kid, from the cache or by
+//fetching the JWKS. The JSON of the JWKS is cached instead of the keys, which are not
+//serializable.
+func (s *Service) jwks(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var ckey string
+	if s.Cache != nil {
+		ckey = s.cacheKey("jwks:"+s.JWKSURL, nil, "")
+		if cached, _ := s.readCache(ckey); cached != nil {
+			if body, ok := cached.(string); ok {
+				if keys, err := parseJWKS([]byte(body)); err == nil {
+					return keys, nil
+				}
+			}
+		}
+	}
+	body, err := s.fetchJWKS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(body)
+	if err != nil {
+		return nil, err
+	}
+	if s.Cache != nil {
+		s.writeCache(ckey, string(body), time.Duration(s.DefaultExpTime)*time.Second)
+	}
+	return keys, nil
+}
+
+//fetchJWKS gets the JSON of the JWKS from JWKSURL
+func (s *Service) fetchJWKS(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequest("GET", s.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.httpClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("error response from %s: %d - %s", s.JWKSURL, resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+//parseJWKS returns the keys of the JWKS by their kid. The keys that are not supported
+//are skipped.
+func parseJWKS(body []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			log.Debugf("Sand JWKS: skipping the key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
@@ -0,0 +1,195 @@
+package sand
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/coupa/sand-go/cache"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+//signJWT signs the claims with the key as an RS256 JWT with the kid
+func signJWT(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := crypto.SHA256.New()
+	h.Write([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h.Sum(nil))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+var _ = Describe("VerifyHybrid", func() {
+	var (
+		service     *Service
+		ts          *httptest.Server
+		key         *rsa.PrivateKey
+		jwksCalls   int
+		verifyCalls int
+		exp         int64
+	)
+
+	BeforeEach(func() {
+		caches = map[time.Duration]cache.Cache{}
+		jwksCalls, verifyCalls = 0, 0
+		exp = time.Now().Add(time.Hour).Unix()
+		if key == nil {
+			key, _ = rsa.GenerateKey(rand.Reader, 2048)
+		}
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch r.RequestURI {
+			case "/":
+				fmt.Fprintf(w, `{"access_token":"def"}`)
+			case "/v":
+				verifyCalls++
+				fmt.Fprintf(w, `{"allowed":true,"sub":"remote"}`)
+			case "/jwks":
+				jwksCalls++
+				e := big.NewInt(int64(key.E)).Bytes()
+				fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"k1","n":%q,"e":%q},{"kty":"oct","kid":"k2"}]}`,
+					base64.RawURLEncoding.EncodeToString(key.N.Bytes()), base64.RawURLEncoding.EncodeToString(e))
+			}
+		}))
+		service, _ = NewService("i", "s", ts.URL, "r", ts.URL+"/v", []string{"scope"})
+		service.JWKSURL = ts.URL + "/jwks"
+	})
+	AfterEach(func() {
+		ts.Close()
+		service.Close()
+	})
+
+	It("verifies a JWT locally with the cached JWKS", func() {
+		token := signJWT(key, "k1", map[string]interface{}{"sub": "local", "scope": "read", "aud": "r", "exp": exp})
+		for i := 0; i < 2; i++ {
+			result, err := service.VerifyHybrid(token, VerificationOption{TargetScopes: []string{"read"}})
+			Expect(err).To(BeNil())
+			Expect(result.Allowed()).To(BeTrue())
+			Expect(result.Response["sub"]).To(Equal("local"))
+			Expect(result.Expiry).To(Equal(time.Unix(exp, 0)))
+		}
+		Expect(jwksCalls).To(Equal(1))
+		Expect(verifyCalls).To(Equal(0))
+	})
+
+	It("denies a JWT by its claims", func() {
+		token := signJWT(key, "k1", map[string]interface{}{"scope": "read", "aud": "r", "exp": exp})
+		result, err := service.VerifyHybrid(token, VerificationOption{TargetScopes: []string{"write"}})
+		Expect(err).To(BeNil())
+		Expect(result.Allowed()).To(BeFalse())
+
+		token = signJWT(key, "k1", map[string]interface{}{"scope": "read", "aud": "r", "exp": time.Now().Add(-time.Minute).Unix()})
+		result, err = service.VerifyHybrid(token, VerificationOption{TargetScopes: []string{"read"}})
+		Expect(err).To(BeNil())
+		Expect(result.Allowed()).To(BeFalse())
+		Expect(verifyCalls).To(Equal(0))
+	})
+
+	It("denies a JWT that is not valid yet", func() {
+		token := signJWT(key, "k1", map[string]interface{}{"scope": "read", "aud": "r", "exp": exp, "nbf": time.Now().Add(time.Minute).Unix()})
+		result, err := service.VerifyHybrid(token, VerificationOption{TargetScopes: []string{"read"}})
+		Expect(err).To(BeNil())
+		Expect(result.Allowed()).To(BeFalse())
+		Expect(verifyCalls).To(Equal(0))
+	})
+
+	It("caches the JWKS as JSON for the caches that serialize their items", func() {
+		service.Cache = &jsonCache{cache.NewGoCache(time.Hour, 0)}
+		token := signJWT(key, "k1", map[string]interface{}{"scope": "read", "aud": "r", "exp": exp})
+		for i := 0; i < 2; i++ {
+			result, err := service.VerifyHybrid(token, VerificationOption{TargetScopes: []string{"read"}})
+			Expect(err).To(BeNil())
+			Expect(result.Allowed()).To(BeTrue())
+		}
+		Expect(jwksCalls).To(Equal(1))
+		Expect(verifyCalls).To(Equal(0))
+	})
+
+	It("denies a JWT with an invalid signature", func() {
+		other, _ := rsa.GenerateKey(rand.Reader, 1024)
+		token := signJWT(other, "k1", map[string]interface{}{"scope": "read", "aud": "r", "exp": exp})
+		result, err := service.VerifyHybrid(token, VerificationOption{TargetScopes: []string{"read"}})
+		Expect(err).To(BeNil())
+		Expect(result.Allowed()).To(BeFalse())
+		Expect(result.Reason).To(Equal("invalid token signature"))
+		Expect(verifyCalls).To(Equal(0))
+	})
+
+	It("falls back to SAND for an opaque token", func() {
+		result, err := service.VerifyHybrid("opaque", VerificationOption{TargetScopes: []string{"read"}})
+		Expect(err).To(BeNil())
+		Expect(result.Allowed()).To(BeTrue())
+		Expect(result.Response["sub"]).To(Equal("remote"))
+		Expect(jwksCalls).To(Equal(0))
+		Expect(verifyCalls).To(Equal(1))
+	})
+
+	It("falls back to SAND for a JWT without exp", func() {
+		token := signJWT(key, "k1", map[string]interface{}{"scope": "read", "aud": "r"})
+		result, err := service.VerifyHybrid(token, VerificationOption{TargetScopes: []string{"read"}})
+		Expect(err).To(BeNil())
+		Expect(result.Response["sub"]).To(Equal("remote"))
+		Expect(jwksCalls).To(Equal(0))
+		Expect(verifyCalls).To(Equal(1))
+	})
+
+	It("falls back to SAND for an unknown kid", func() {
+		token := signJWT(key, "unknown", map[string]interface{}{"scope": "read", "aud": "r", "exp": exp})
+		result, err := service.VerifyHybrid(token, VerificationOption{TargetScopes: []string{"read"}})
+		Expect(err).To(BeNil())
+		Expect(result.Allowed()).To(BeTrue())
+		Expect(result.Response["sub"]).To(Equal("remote"))
+		Expect(verifyCalls).To(Equal(1))
+	})
+
+	It("falls back to SAND if the JWKS cannot be fetched", func() {
+		service.JWKSURL = ts.URL + "/missing"
+		token := signJWT(key, "k1", map[string]interface{}{"scope": "read", "aud": "r", "exp": exp})
+		result, err := service.VerifyHybrid(token, VerificationOption{TargetScopes: []string{"read"}})
+		Expect(err).To(BeNil())
+		Expect(result.Response["sub"]).To(Equal("remote"))
+		Expect(verifyCalls).To(Equal(1))
+	})
+
+	It("verifies with SAND without JWKSURL", func() {
+		service.JWKSURL = ""
+		token := signJWT(key, "k1", map[string]interface{}{"scope": "read", "aud": "r", "exp": exp})
+		result, err := service.VerifyHybrid(token, VerificationOption{TargetScopes: []string{"read"}})
+		Expect(err).To(BeNil())
+		Expect(result.Response["sub"]).To(Equal("remote"))
+		Expect(jwksCalls).To(Equal(0))
+	})
+})
+
+//jsonCache keeps the items as JSON like the caches that are shared between processes
+type jsonCache struct {
+	cache.Cache
+}
+
+func (c *jsonCache) Read(key string) interface{} {
+	data, ok := c.Cache.Read(key).([]byte)
+	if !ok {
+		return nil
+	}
+	var item interface{}
+	json.Unmarshal(data, &item)
+	return item
+}
+
+func (c *jsonCache) Write(key string, item interface{}, exp time.Duration) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return c.Cache.Write(key, data, exp)
+}
@@ -0,0 +1,72 @@
+package sand
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	//DefaultClientIPKey is a suggested ClientIPKey of the service
+	DefaultClientIPKey = "client_ip"
+	//DefaultUserAgentKey is a suggested UserAgentKey of the service
+	DefaultUserAgentKey = "user_agent"
+)
+
+//requestContext returns the verification context with the client IP and the
+//user agent of the incoming request added under the ClientIPKey and UserAgentKey.
+//The context is copied, and the values already in it are not replaced.
+func (s *Service) requestContext(r *http.Request, context map[string]interface{}) map[string]interface{} {
+	if s.ClientIPKey == "" && s.UserAgentKey == "" {
+		return context
+	}
+	if len(context) == 0 {
+		context = s.Context
+	}
+	rv := make(map[string]interface{}, len(context)+2)
+	for k, v := range context {
+		rv[k] = v
+	}
+	addContextValue(rv, s.ClientIPKey, s.clientIP(r))
+	addContextValue(rv, s.UserAgentKey, r.UserAgent())
+	return rv
+}
+
+func addContextValue(context map[string]interface{}, key, value string) {
+	if key == "" || value == "" {
+		return
+	}
+	if _, ok := context[key]; !ok {
+		context[key] = value
+	}
+}
+
+//clientIP returns the IP of the client of the incoming request. With TrustedProxies,
+//it is the address in the X-Forwarded-For header added by the outermost trusted
+//proxy, otherwise the remote address of the connection.
+func (s *Service) clientIP(r *http.Request) string {
+	if s.TrustedProxies > 0 {
+		var forwarded []string
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, ip := range strings.Split(value, ",") {
+				if ip = strings.TrimSpace(ip); ip != "" {
+					forwarded = append(forwarded, ip)
+				}
+			}
+		}
+		if len(forwarded) > 0 {
+			//Each proxy appends the address it received the request from, so the
+			//client is the last address added by the outermost trusted proxy
+			i := len(forwarded) - s.TrustedProxies
+			if i < 0 {
+				i = 0
+			}
+			return forwarded[i]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
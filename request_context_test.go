@@ -0,0 +1,145 @@
+package sand
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/coupa/sand-go/cache"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request context", func() {
+	var (
+		service *Service
+		ts      *httptest.Server
+		context map[string]interface{}
+		r       *http.Request
+	)
+
+	BeforeEach(func() {
+		caches = map[time.Duration]cache.Cache{}
+		context = nil
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.RequestURI == "/" {
+				fmt.Fprintf(w, `{"access_token":"def"}`)
+			} else if r.RequestURI == "/v" {
+				var body map[string]interface{}
+				json.NewDecoder(r.Body).Decode(&body)
+				context, _ = body["context"].(map[string]interface{})
+				fmt.Fprintf(w, `{"allowed":true}`)
+			}
+		}))
+		service, _ = NewService("i", "s", ts.URL, "res", ts.URL+"/v", []string{"s"})
+		service.ClientIPKey = DefaultClientIPKey
+		service.UserAgentKey = DefaultUserAgentKey
+
+		r, _ = http.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer abc")
+		r.Header.Set("User-Agent", "agent/1.0")
+		r.RemoteAddr = "10.0.0.3:1234"
+	})
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	Describe("#VerifyRequest", func() {
+		It("sends the client IP and the user agent in the context", func() {
+			_, err := service.VerifyRequest(r, VerificationOption{})
+			Expect(err).To(BeNil())
+			Expect(context).To(Equal(map[string]interface{}{"client_ip": "10.0.0.3", "user_agent": "agent/1.0"}))
+		})
+
+		It("keeps the given context and its values", func() {
+			opt := VerificationOption{Context: map[string]interface{}{"tenant": "t", "client_ip": "1.2.3.4"}}
+			_, err := service.VerifyRequest(r, opt)
+			Expect(err).To(BeNil())
+			Expect(context).To(Equal(map[string]interface{}{"tenant": "t", "client_ip": "1.2.3.4", "user_agent": "agent/1.0"}))
+			Expect(opt.Context).To(HaveLen(2))
+		})
+
+		It("adds to the default context of the service without changing it", func() {
+			service.Context = map[string]interface{}{"tenant": "t"}
+			_, err := service.VerifyRequest(r, VerificationOption{})
+			Expect(err).To(BeNil())
+			Expect(context).To(Equal(map[string]interface{}{"tenant": "t", "client_ip": "10.0.0.3", "user_agent": "agent/1.0"}))
+			Expect(service.Context).To(Equal(map[string]interface{}{"tenant": "t"}))
+		})
+
+		It("uses the configured keys", func() {
+			service.ClientIPKey = "ip"
+			service.UserAgentKey = ""
+			_, err := service.VerifyRequest(r, VerificationOption{})
+			Expect(err).To(BeNil())
+			Expect(context).To(Equal(map[string]interface{}{"ip": "10.0.0.3"}))
+		})
+
+		It("doesn't add anything without keys", func() {
+			service.ClientIPKey = ""
+			service.UserAgentKey = ""
+			_, err := service.VerifyRequest(r, VerificationOption{})
+			Expect(err).To(BeNil())
+			Expect(context).To(BeEmpty())
+		})
+
+		It("sends the forwarded client IP with TrustedProxies", func() {
+			service.TrustedProxies = 1
+			r.Header.Set("X-Forwarded-For", "192.168.0.9")
+			_, err := service.VerifyRequest(r, VerificationOption{})
+			Expect(err).To(BeNil())
+			Expect(context["client_ip"]).To(Equal("192.168.0.9"))
+		})
+	})
+
+	Describe("#Authorized", func() {
+		It("sends the client IP and the user agent in the context", func() {
+			ok, _, err := service.Authorized(r, []string{"s"}, "read")
+			Expect(err).To(BeNil())
+			Expect(ok).To(BeTrue())
+			Expect(context).To(Equal(map[string]interface{}{"client_ip": "10.0.0.3", "user_agent": "agent/1.0"}))
+		})
+
+		It("sends the forwarded client IP with TrustedProxies", func() {
+			service.TrustedProxies = 1
+			r.Header.Set("X-Forwarded-For", "192.168.0.9")
+			_, _, err := service.Authorized(r, []string{"s"}, "read")
+			Expect(err).To(BeNil())
+			Expect(context["client_ip"]).To(Equal("192.168.0.9"))
+		})
+	})
+
+	Describe("#clientIP", func() {
+		It("uses the remote address without TrustedProxies", func() {
+			r.Header.Set("X-Forwarded-For", "192.168.0.9")
+			Expect(service.clientIP(r)).To(Equal("10.0.0.3"))
+
+			r.RemoteAddr = "[::1]:1234"
+			Expect(service.clientIP(r)).To(Equal("::1"))
+
+			r.RemoteAddr = "pipe"
+			Expect(service.clientIP(r)).To(Equal("pipe"))
+		})
+
+		It("uses the address added by the outermost trusted proxy", func() {
+			r.Header.Set("X-Forwarded-For", "6.6.6.6, 192.168.0.9")
+			r.Header.Add("X-Forwarded-For", "172.16.0.2")
+
+			service.TrustedProxies = 1
+			Expect(service.clientIP(r)).To(Equal("172.16.0.2"))
+			service.TrustedProxies = 2
+			Expect(service.clientIP(r)).To(Equal("192.168.0.9"))
+			service.TrustedProxies = 5
+			Expect(service.clientIP(r)).To(Equal("6.6.6.6"))
+		})
+
+		It("uses the remote address without the X-Forwarded-For header", func() {
+			service.TrustedProxies = 1
+			Expect(service.clientIP(r)).To(Equal("10.0.0.3"))
+		})
+	})
+})
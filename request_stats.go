@@ -0,0 +1,57 @@
+package sand
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+//RequestStats records the attempts and the latency of a request, e.g., for logging
+//them uniformly in a middleware. See ContextWithRequestStats.
+type RequestStats struct {
+	//TokenAttempts is the number of token requests to the OAuth2 server. It is 0 if
+	//the tokens were read from the cache.
+	TokenAttempts int
+	//ServiceAttempts is the number of calls to the service, i.e., 1 plus the retries on 401
+	ServiceAttempts int
+	//Elapsed is the total time of the request, including the backoffs of the retries
+	Elapsed time.Duration
+}
+
+//requestStatsKey is the context key of the RequestStats
+type requestStatsKey struct{}
+
+//ContextWithRequestStats returns a context in which RequestWithContext and the token
+//functions with a context record their attempts and latency to stats. The stats
+//should not be shared by concurrent requests.
+func ContextWithRequestStats(ctx context.Context, stats *RequestStats) context.Context {
+	return context.WithValue(ctx, requestStatsKey{}, stats)
+}
+
+//requestStats returns the RequestStats in ctx, or nil if there is none
+func requestStats(ctx context.Context) *RequestStats {
+	if ctx == nil {
+		return nil
+	}
+	stats, _ := ctx.Value(requestStatsKey{}).(*RequestStats)
+	return stats
+}
+
+func (s *RequestStats) countTokenAttempt() {
+	if s != nil {
+		s.TokenAttempts++
+	}
+}
+
+func (s *RequestStats) countServiceAttempt() {
+	if s != nil {
+		s.ServiceAttempts++
+	}
+}
+
+//addElapsed adds the time since start to the stats
+func (s *RequestStats) addElapsed(start time.Time) {
+	if s != nil {
+		s.Elapsed += time.Since(start)
+	}
+}
@@ -0,0 +1,90 @@
+package sand
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/coupa/sand-go/cache"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RequestStats", func() {
+	var (
+		client *Client
+		source *failingTokenSource
+		stats  *RequestStats
+		ctx    context.Context
+	)
+
+	BeforeEach(func() {
+		caches = map[time.Duration]cache.Cache{}
+		client, _ = NewClientWithCache("i", "s", "u", cache.NewGoCache(time.Hour, 0))
+		client.DefaultRetryCount = 1
+		source = &failingTokenSource{}
+		client.TokenSource = func(ctx context.Context, tokenURL string, scopes []string) oauth2.TokenSource {
+			return source
+		}
+		stats = &RequestStats{}
+		ctx = ContextWithRequestStats(context.Background(), stats)
+	})
+	AfterEach(func() {
+		client.Close()
+	})
+
+	It("records the attempts and the elapsed time across the retries", func() {
+		source.failures = 1
+		calls := 0
+		start := time.Now()
+		resp, err := client.RequestWithContext(ctx, "resource", []string{"scope"}, func(token string) (*http.Response, error) {
+			calls++
+			if calls == 1 {
+				return &http.Response{StatusCode: http.StatusUnauthorized}, nil
+			}
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		})
+		elapsed := time.Since(start)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		//A failed and a successful token request, and a new token after the 401
+		Expect(stats.TokenAttempts).To(Equal(3))
+		Expect(stats.ServiceAttempts).To(Equal(2))
+		//One backoff for the token and one for the 401
+		Expect(stats.Elapsed).To(BeNumerically(">=", 2*time.Second))
+		Expect(stats.Elapsed).To(BeNumerically("<=", elapsed))
+	})
+
+	It("records no token attempts for a cached token", func() {
+		_, err := client.RequestWithContext(context.Background(), "resource", []string{"scope"}, func(token string) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		})
+		Expect(err).To(BeNil())
+
+		_, err = client.RequestWithContext(ctx, "resource", []string{"scope"}, func(token string) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		})
+		Expect(err).To(BeNil())
+		Expect(stats.TokenAttempts).To(Equal(0))
+		Expect(stats.ServiceAttempts).To(Equal(1))
+		Expect(stats.Elapsed).To(BeNumerically(">", 0))
+	})
+
+	It("records the attempts of the token functions with a context", func() {
+		source.failures = 1
+		_, err := client.OAuth2TokenWithContext(ctx, "resource", []string{"scope"}, 1)
+		Expect(err).To(BeNil())
+		Expect(stats.TokenAttempts).To(Equal(2))
+		Expect(stats.ServiceAttempts).To(Equal(0))
+	})
+
+	It("does not need stats in the context", func() {
+		resp, err := client.RequestWithContext(context.Background(), "resource", []string{"scope"}, func(token string) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		})
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	})
+})
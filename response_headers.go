@@ -0,0 +1,44 @@
+package sand
+
+import (
+	"net/http"
+)
+
+//responseHeaderTransport reports the ResponseHeaders of every response of the base
+//transport to OnResponseHeaders
+type responseHeaderTransport struct {
+	base   http.RoundTripper
+	names  []string
+	report func(string, http.Header)
+}
+
+func (t *responseHeaderTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(r)
+	if resp != nil {
+		if header := selectHeaders(resp.Header, t.names); len(header) > 0 {
+			t.report(r.URL.String(), header)
+		}
+	}
+	return resp, err
+}
+
+//selectHeaders returns a copy of the named headers that are in header
+func selectHeaders(header http.Header, names []string) http.Header {
+	selected := http.Header{}
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		if values, ok := header[name]; ok {
+			selected[name] = append([]string(nil), values...)
+		}
+	}
+	return selected
+}
+
+//responseHeaderTransport wraps the transport so that the ResponseHeaders are reported
+//to OnResponseHeaders. The transport is returned as is if either is not set.
+func (c *Client) responseHeaderTransport(transport http.RoundTripper) http.RoundTripper {
+	if c.OnResponseHeaders == nil || len(c.ResponseHeaders) == 0 {
+		return transport
+	}
+	return &responseHeaderTransport{base: transport, names: c.ResponseHeaders, report: c.OnResponseHeaders}
+}
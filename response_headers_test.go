@@ -0,0 +1,77 @@
+package sand
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/coupa/sand-go/cache"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ResponseHeaders", func() {
+	var (
+		service *Service
+		ts      *httptest.Server
+		mutex   sync.Mutex
+		urls    []string
+		headers []http.Header
+	)
+
+	BeforeEach(func() {
+		caches = map[time.Duration]cache.Cache{}
+		urls, headers = nil, nil
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Other", "other")
+			if r.RequestURI == "/" {
+				w.Header().Set("X-RateLimit-Remaining", "99")
+				w.Header().Set("X-RateLimit-Reset", "60")
+				fmt.Fprintf(w, `{"access_token":"def"}`)
+			} else if r.RequestURI == "/v" {
+				w.Header().Set("X-RateLimit-Remaining", "42")
+				fmt.Fprintf(w, `{"allowed":true}`)
+			}
+		}))
+		service, _ = NewService("i", "s", ts.URL, "r", ts.URL+"/v", []string{"scope"})
+		service.ResponseHeaders = []string{"x-ratelimit-remaining", "X-RateLimit-Reset"}
+		service.OnResponseHeaders = func(url string, header http.Header) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			urls = append(urls, url)
+			headers = append(headers, header)
+		}
+	})
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	It("reports the rate limit headers of the token and verification responses", func() {
+		t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+		Expect(err).To(BeNil())
+		Expect(t["allowed"]).To(Equal(true))
+		Expect(urls).To(Equal([]string{ts.URL, ts.URL + "/v"}))
+		Expect(headers).To(Equal([]http.Header{
+			{"X-Ratelimit-Remaining": {"99"}, "X-Ratelimit-Reset": {"60"}},
+			{"X-Ratelimit-Remaining": {"42"}},
+		}))
+	})
+
+	It("does not report the responses without the headers", func() {
+		service.ResponseHeaders = []string{"X-Missing"}
+		_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+		Expect(err).To(BeNil())
+		Expect(urls).To(BeEmpty())
+	})
+
+	It("does not report without ResponseHeaders", func() {
+		service.ResponseHeaders = nil
+		_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+		Expect(err).To(BeNil())
+		Expect(urls).To(BeEmpty())
+	})
+})
@@ -2,10 +2,17 @@ package sand
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"errors"
-	"math"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coupa/sand-go/cache"
@@ -17,11 +24,66 @@ import (
 )
 
 const (
-	defaultExpiryTime = 3598 * time.Second
+	//DefaultExpiryTime is the cache expiration of the default client cache, which is
+	//used by NewClient. Use it to size a shared cache consistently with the default.
+	DefaultExpiryTime = 3598 * time.Second
+
+	//DefaultMaxRetryCount is the default MaxRetryCount. The backoff before the last of
+	//these retries is about 8.5 minutes.
+	DefaultMaxRetryCount = 10
+
+	//defaultCleanupInterval is how often the expired tokens are deleted from the
+	//default caches
+	defaultCleanupInterval = time.Minute
+
+	//accessTokenCacheKey is the cache key of the tokens from AccessToken
+	accessTokenCacheKey = "access-token"
+
+	//maxDrainSize is the maximum number of bytes read from a discarded response body
+	//so that the connection can be reused
+	maxDrainSize = 4096
 )
 
+//cacheSettings identifies a default cache with a non-default cleanup interval
+type cacheSettings struct {
+	expiration      time.Duration
+	cleanupInterval time.Duration
+}
+
 var (
+	//caches are the default caches with the default cleanup interval, keyed by expiration
 	caches = map[time.Duration]cache.Cache{}
+	//cleanupCaches are the default caches with custom cleanup intervals
+	cleanupCaches = map[cacheSettings]cache.Cache{}
+	//cachesLock guards caches and cleanupCaches, which are used by NewClient and Close
+	//from any goroutine
+	cachesLock sync.Mutex
+)
+
+//CacheErrorPolicy defines how cache failures are handled
+type CacheErrorPolicy int
+
+const (
+	//FailOpen ignores cache failures and gets the tokens or verification results
+	//directly from the OAuth2 server. This is the default.
+	FailOpen CacheErrorPolicy = iota
+	//FailClosed returns cache failures as errors of type CacheError
+	FailClosed
+)
+
+//ExpiredTokenBehavior defines what happens when a newly fetched token has already
+//expired, e.g., because of clock skew between the client and the OAuth2 server
+type ExpiredTokenBehavior int
+
+const (
+	//RetryExpiredToken fetches the token once more, and returns an error of type
+	//AuthenticationError if it has expired again. This is the default.
+	RetryExpiredToken ExpiredTokenBehavior = iota
+	//FailOnExpiredToken returns an error of type AuthenticationError without fetching
+	//the token again
+	FailOnExpiredToken
+	//AcceptExpiredToken returns the expired token, which is likely rejected by the service
+	AcceptExpiredToken
 )
 
 //Client can be used to request token from an OAuth2 server
@@ -36,6 +98,12 @@ type Client struct {
 	//SSLMinVersion is the minimum supported TLS version. Default is TLS 1.2.
 	SSLMinVersion uint16
 
+	//Transport is the HTTP transport for the connections to the OAuth2 server and
+	//the token verification endpoint. Set it to share one transport, and its proxy
+	//and connection pool settings, across all the connections.
+	//Default is nil, which uses a clone of http.DefaultTransport with SSLMinVersion.
+	Transport http.RoundTripper
+
 	//DefaultRetryCount is the default number of retries to perform with exponential backoff when
 	//1. Clients receive 401 response from services
 	//2. Clients' or services' connections to the OAuth2 server fails.
@@ -43,14 +111,145 @@ type Client struct {
 	DefaultRetryCount int
 	Cache             cache.Cache
 
+	//MaxRetryCount caps the number of retries, including DefaultRetryCount and the
+	//retries given by the callers, so that a huge number of retries doesn't make a
+	//request back off for a very long time.
+	//Default value is DefaultMaxRetryCount for the clients created with NewClient and
+	//its variants, and 0, which doesn't cap the retries, otherwise.
+	MaxRetryCount int
+
+	//Is401Retriable tells if a 401 response of a service could be fixed by getting a
+	//new token and calling the service again, e.g., by checking the WWW-Authenticate
+	//header, as opposed to the user's authorization having failed. The response body
+	//can be read since the response is discarded if it is retried.
+	//Default is nil, which retries on every 401 response.
+	Is401Retriable func(*http.Response) bool
+
+	//RefreshRetryCount is the number of retries of getting a new token on connection
+	//errors when a request is retried because the service returned 401. It is kept
+	//low since every retry of the request already backs off, so that a request doesn't
+	//lock up for a long time. Default is 0, which doesn't retry getting the new token.
+	RefreshRetryCount int
+
+	//OperationTimeout bounds the whole Request, including getting the tokens and all
+	//the retries, e.g., 10 seconds. No retry is started if its backoff would exceed
+	//it, and the last error or response is returned instead. The calls to the service
+	//in exec are not canceled, so they need their own timeout. The deadline of the
+	//context of RequestWithContext is honored the same way.
+	//Default is 0, which doesn't bound the request.
+	OperationTimeout time.Duration
+
+	//BackoffJitter adds a random duration of up to this fraction of the backoff to
+	//each backoff between retries, e.g., 0.5 makes the backoff of 2 seconds last
+	//between 2 and 3 seconds, so that clients don't retry at the same time.
+	//Default is 0, which doesn't add jitter.
+	BackoffJitter float64
+
+	//Rand is the random source of the jitter. Set it with a fixed seed for a
+	//reproducible jitter, e.g., in tests. Default is nil, which uses math/rand.
+	Rand *rand.Rand
+
+	//ExpirySkew is subtracted from the expiry time of the tokens when caching them,
+	//so that the tokens are refreshed slightly before they expire, e.g., in case of
+	//clock skew with the OAuth2 server. Default is 0
+	ExpirySkew time.Duration
+
+	//OnTokenExpired is called with the cache key of a token cached by the client when
+	//the token is fetched again because it has expired in the cache, as opposed to
+	//not having been cached or having been evicted.
+	OnTokenExpired func(cacheKey string)
+
+	//SupersetScopes makes the cached token requests whose scopes are all in
+	//SupersetScopes get one token for SupersetScopes instead, which is cached and
+	//shared by all of them, so that overlapping scope sets don't each need a token.
+	//SECURITY: the token carries all the SupersetScopes, which is more than each
+	//request asked for, so a service receiving it, or anyone who steals it, gets the
+	//access of all of them. Only use it with scopes that the services are equally
+	//trusted with. Default is nil, which gets a token for the exact scopes.
+	SupersetScopes []string
+
+	//OmitScopesFromTokenRequest gets the tokens without the "scope" parameter, e.g.,
+	//for an OAuth2 server that rejects it and derives the scopes from the registered
+	//client. The scopes are still used to cache the tokens separately.
+	//Default is false, which sends the scopes.
+	OmitScopesFromTokenRequest bool
+
+	//MaxConcurrentTokenFetches limits the number of token requests of the client to
+	//the OAuth2 server in flight at the same time, e.g., so that a mass expiry of the
+	//cached tokens doesn't overwhelm the server. The callers beyond the limit block
+	//until a request finishes or their context is done, and are never served a
+	//stale token. Default is 0, which doesn't limit the token requests.
+	MaxConcurrentTokenFetches int
+
+	//OnTokenError is called when getting a token from the OAuth2 server fails, e.g.,
+	//to count the failures for alerting. It is called with the error and the 1-based
+	//number of every failed attempt, and then with the error returned to the caller
+	//and attempt 0 if all the attempts failed.
+	OnTokenError func(err error, attempt int)
+
+	//CacheErrorPolicy defines whether cache failures are ignored or returned as errors.
+	//Default is FailOpen
+	CacheErrorPolicy CacheErrorPolicy
+
+	//OnCacheWriteError is called with the key and the error of every failed cache
+	//write with either CacheErrorPolicy, e.g., to detect a broken external cache that
+	//FailOpen would otherwise only log. It must be safe for concurrent use.
+	OnCacheWriteError func(key string, err error)
+
+	//ExpiredTokenBehavior defines what happens when a newly fetched token has already
+	//expired. Default is RetryExpiredToken
+	ExpiredTokenBehavior ExpiredTokenBehavior
+
+	//ResponseHeaders are the names of the headers reported to OnResponseHeaders, e.g.,
+	//{"X-RateLimit-Remaining", "X-RateLimit-Reset"}.
+	ResponseHeaders []string
+
+	//OnResponseHeaders is called with the request URL and the ResponseHeaders of every
+	//response of the OAuth2 server and the token verification endpoint that has any of
+	//them, e.g., to slow down before being rate limited. It must be safe for concurrent use.
+	OnResponseHeaders func(url string, header http.Header)
+
 	//CacheRoot is the root of the cache key for storing tokens in the cache.
 	//The overall cache key will look like: <CacheRoot>/<cacheType>/<some key>
 	//Default value is "sand"
 	CacheRoot string
 
+	//TokenSource creates the token source for getting tokens from tokenURL with the
+	//scopes, in case a grant type other than client credentials is needed. The ctx
+	//carries the HTTP client to use under the oauth2.HTTPClient key.
+	//Default is nil, which uses the client credentials grant.
+	TokenSource func(ctx context.Context, tokenURL string, scopes []string) oauth2.TokenSource
+
+	//CorrelationIDKey is the key of the correlation ID in the Go context. When it is
+	//set, the correlation ID in the context is sent in the CorrelationIDHeader header
+	//of the requests to the OAuth2 server.
+	//Default is nil, which doesn't send correlation IDs.
+	CorrelationIDKey interface{}
+
+	//CorrelationIDHeader is the header for sending the correlation ID.
+	//Default value is "X-Request-ID"
+	CorrelationIDHeader string
+
+	//AuthorizationScheme is the scheme of the Authorization header built by
+	//AuthorizationHeader, which is also used for the token verification requests of
+	//services. Default value is "Bearer"
+	AuthorizationScheme string
+
 	//Default value is "resources" for sand.Client
 	//Default value is "tokens" for sand.Service
 	cacheType string
+
+	//expiries tracks the expiry times of the cached tokens for OnTokenExpired
+	expiries *tokenExpiries
+
+	//counters counts the cache hits and misses for CacheStats
+	counters *cacheCounters
+
+	//fetchLimiter limits the concurrent token fetches to MaxConcurrentTokenFetches
+	fetchLimiter *tokenFetchLimiter
+
+	//transports are the default transports of the client if Transport is not set
+	transports *transportPool
 }
 
 //NewClient returns a Client with default option values. The default expiration
@@ -58,10 +257,21 @@ type Client struct {
 //If you don't want to use a cache for some very convincing reason, you can set
 //client's Cache to nil.
 func NewClient(id, secret, tokenURL string) (client *Client, err error) {
-	if caches[defaultExpiryTime] == nil {
-		caches[defaultExpiryTime] = cache.NewGoCache(defaultExpiryTime, defaultExpiryTime)
+	return NewClientWithExpiration(id, secret, tokenURL, DefaultExpiryTime)
+}
+
+//NewValidatedClient is the same as NewClient except that the tokenURL must be an
+//absolute http or https URL, so that a typo is caught before the first request.
+//A malformed URL returns a ValidationError of kind InvalidConfig. The URL is
+//normalized by trimming the spaces around it and lowercasing its host.
+func NewValidatedClient(id, secret, tokenURL string) (*Client, error) {
+	if tokenURL != "" {
+		var err error
+		if tokenURL, err = normalizeEndpointURL("TokenURL", tokenURL); err != nil {
+			return nil, err
+		}
 	}
-	return NewClientWithCache(id, secret, tokenURL, caches[defaultExpiryTime])
+	return NewClient(id, secret, tokenURL)
 }
 
 //NewClientWithExpiration returns a Client with default option values and specified
@@ -69,10 +279,33 @@ func NewClient(id, secret, tokenURL string) (client *Client, err error) {
 //If you don't want to use a cache for some very convincing reason, you can set
 //client's Cache to nil.
 func NewClientWithExpiration(id, secret, tokenURL string, cacheExpiration time.Duration) (client *Client, err error) {
-	if caches[cacheExpiration] == nil {
-		caches[cacheExpiration] = cache.NewGoCache(cacheExpiration, cacheExpiration)
+	return NewClientWithCleanupInterval(id, secret, tokenURL, cacheExpiration, defaultCleanupInterval)
+}
+
+//NewClientWithCleanupInterval returns a Client with default option values and
+//specified expiration time and cleanup interval on the cache. The expired tokens
+//are deleted from the cache every cleanupInterval. The default cleanup interval
+//is 1 minute.
+func NewClientWithCleanupInterval(id, secret, tokenURL string, cacheExpiration, cleanupInterval time.Duration) (client *Client, err error) {
+	return NewClientWithCache(id, secret, tokenURL, defaultCache(cacheExpiration, cleanupInterval))
+}
+
+//defaultCache returns the default cache shared by the clients with the same
+//expiration time and cleanup interval.
+func defaultCache(expiration, cleanupInterval time.Duration) cache.Cache {
+	cachesLock.Lock()
+	defer cachesLock.Unlock()
+	if cleanupInterval == defaultCleanupInterval {
+		if caches[expiration] == nil {
+			caches[expiration] = cache.NewGoCache(expiration, cleanupInterval)
+		}
+		return caches[expiration]
 	}
-	return NewClientWithCache(id, secret, tokenURL, caches[cacheExpiration])
+	settings := cacheSettings{expiration, cleanupInterval}
+	if cleanupCaches[settings] == nil {
+		cleanupCaches[settings] = cache.NewGoCache(expiration, cleanupInterval)
+	}
+	return cleanupCaches[settings]
 }
 
 //NewClientWithCache returns a Client with default option values and a specified cache
@@ -84,18 +317,125 @@ func NewClientWithCache(id, secret, tokenURL string, cache cache.Cache) (client
 		return
 	}
 	client = &Client{
-		ClientID:          id,
-		ClientSecret:      secret,
-		TokenURL:          tokenURL,
-		SSLMinVersion:     tls.VersionTLS12,
-		DefaultRetryCount: 5,
-		Cache:             cache,
-		CacheRoot:         "sand",
-		cacheType:         "resources",
+		ClientID:            id,
+		ClientSecret:        secret,
+		TokenURL:            tokenURL,
+		SSLMinVersion:       tls.VersionTLS12,
+		DefaultRetryCount:   5,
+		MaxRetryCount:       DefaultMaxRetryCount,
+		Cache:               cache,
+		CacheRoot:           "sand",
+		CorrelationIDHeader: "X-Request-ID",
+		AuthorizationScheme: "Bearer",
+		cacheType:           "resources",
+		expiries:            newTokenExpiries(),
+		counters:            &cacheCounters{},
+		fetchLimiter:        newTokenFetchLimiter(),
+		transports:          newTransportPool(),
 	}
 	return
 }
 
+//ValidateConfig checks that the client has the required fields and a well-formed
+//TokenURL without connecting to the OAuth2 server.
+func (c *Client) ValidateConfig() error {
+	if c.ClientID == "" || c.ClientSecret == "" {
+		return ValidationError{InvalidConfig, "missing client ID or client secret"}
+	}
+	_, err := parseEndpointURL("TokenURL", c.TokenURL)
+	return err
+}
+
+//parseEndpointURL parses the URL of an endpoint, which must be an absolute http or
+//https URL, and returns a ValidationError of kind InvalidConfig otherwise.
+func parseEndpointURL(name, rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, ValidationError{InvalidConfig, fmt.Sprintf("invalid %s: %v", name, err)}
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ValidationError{InvalidConfig, fmt.Sprintf("invalid %s %q: must be an absolute http(s) URL", name, rawURL)}
+	}
+	return u, nil
+}
+
+//normalizeEndpointURL trims the spaces around the URL of an endpoint, checks it with
+//parseEndpointURL and lowercases its host.
+func normalizeEndpointURL(name, rawURL string) (string, error) {
+	u, err := parseEndpointURL(name, strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", err
+	}
+	u.Host = strings.ToLower(u.Host)
+	return u.String(), nil
+}
+
+//Validate checks the client configuration with ValidateConfig and then performs a
+//test token fetch without scopes, caching or retry. It returns a ValidationError
+//whose Kind tells whether the configuration is invalid, the OAuth2 server is
+//unreachable or the authentication failed. It can be called at startup to catch
+//misconfigured clients early.
+func (c *Client) Validate(ctx context.Context) error {
+	if err := c.ValidateConfig(); err != nil {
+		return err
+	}
+	if ctx == nil {
+		ctx = context.TODO()
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, c.httpClient(ctx))
+	_, err := c.tokenSource(ctx, c.TokenURL, nil).Token()
+	if err == nil {
+		return nil
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return ValidationError{Unreachable, err.Error()}
+	}
+	return ValidationError{AuthenticationFailed, err.Error()}
+}
+
+//AuthorizationHeader returns the value of the Authorization header for sending
+//the token, e.g., "Bearer {token}", with the client's AuthorizationScheme.
+func (c *Client) AuthorizationHeader(token string) string {
+	scheme := c.AuthorizationScheme
+	if scheme == "" {
+		scheme = "Bearer"
+	}
+	return scheme + " " + token
+}
+
+//Close closes the idle connections of the client and stops the client's cache if it
+//implements cache.Stopper, unless it is one of the default caches shared by the
+//clients from NewClient, NewClientWithExpiration and NewClientWithCleanupInterval,
+//so that no background goroutine of the client is left. The client should not be
+//used after Close.
+func (c *Client) Close() error {
+	if c.transports != nil {
+		c.transports.closeIdleConnections()
+	}
+	if stopper, ok := c.Cache.(cache.Stopper); ok && !isDefaultCache(c.Cache) {
+		stopper.Stop()
+	}
+	return nil
+}
+
+//isDefaultCache checks if the cache is one of the shared default caches
+func isDefaultCache(cc cache.Cache) bool {
+	cachesLock.Lock()
+	defer cachesLock.Unlock()
+	for _, dc := range caches {
+		if dc == cc {
+			return true
+		}
+	}
+	for _, dc := range cleanupCaches {
+		if dc == cc {
+			return true
+		}
+	}
+	return false
+}
+
 //Request makes a service API request by first obtaining the access token from
 //SAND. Then it deligates the token to the underlying function to make the service
 //call. If the service returns 401, it performs exponential retry by requesting
@@ -103,7 +443,7 @@ func NewClientWithCache(id, secret, tokenURL string, cache cache.Cache) (client
 //service failed to connect to the authentication service and no retry will occur.
 //Usage Example:
 // client.Request("some-service", []string{"s1", "s2"}, func(token string) (*http.Response, error) {
-//   // Make http request with "Bearer {token}" in the Authorization header
+//   // Make http request with client.AuthorizationHeader(token) in the Authorization header
 //   // return the response and error
 // })
 func (c *Client) Request(cacheKey string, scopes []string, exec func(string) (*http.Response, error)) (*http.Response, error) {
@@ -118,12 +458,49 @@ func (c *Client) Request(cacheKey string, scopes []string, exec func(string) (*h
 //which uses DefaultRetryCount.
 //The retry durations are: 1, 2, 4, 8, 16,... seconds
 func (c *Client) RequestWithCustomRetry(cacheKey string, scopes []string, numRetry int, exec func(string) (*http.Response, error)) (*http.Response, error) {
-	clientRetry := c.clientRequestRetryCount(numRetry)
+	return c.RequestForResource(cacheKey, "", scopes, numRetry, exec)
+}
+
+//RequestForResource is the same as RequestWithCustomRetry except that the token is
+//cached for the resource, so that the same cacheKey and scopes can be used for
+//different resources without sharing the token. An empty resource is the same as
+//RequestWithCustomRetry.
+func (c *Client) RequestForResource(cacheKey, resource string, scopes []string, numRetry int, exec func(string) (*http.Response, error)) (*http.Response, error) {
+	return c.request(context.TODO(), cacheKey, resource, scopes, numRetry, numRetry, exec)
+}
 
-	token, err := c.Token(cacheKey, scopes, numRetry)
+//RequestWithRetries is the same as RequestWithCustomRetry except that the number of
+//retries is specified separately for getting the token on connection errors, and for
+//calling the service again on 401 responses. serviceRetries is at least one, see
+//RequestWithCustomRetry.
+//Using a negative number for either of them uses DefaultRetryCount.
+func (c *Client) RequestWithRetries(cacheKey string, scopes []string, tokenRetries, serviceRetries int, exec func(string) (*http.Response, error)) (*http.Response, error) {
+	return c.request(context.TODO(), cacheKey, "", scopes, tokenRetries, serviceRetries, exec)
+}
+
+//RequestWithContext is the same as Request except that the tokens are requested
+//with ctx, which cancels them when done and carries the correlation ID. The attempts
+//and the latency of the request are recorded to the RequestStats in ctx, see
+//ContextWithRequestStats.
+func (c *Client) RequestWithContext(ctx context.Context, cacheKey string, scopes []string, exec func(string) (*http.Response, error)) (*http.Response, error) {
+	return c.request(ctx, cacheKey, "", scopes, c.DefaultRetryCount, c.DefaultRetryCount, exec)
+}
+
+func (c *Client) request(ctx context.Context, cacheKey, resource string, scopes []string, tokenRetries, serviceRetries int, exec func(string) (*http.Response, error)) (*http.Response, error) {
+	stats := requestStats(ctx)
+	defer stats.addElapsed(time.Now())
+	clientRetry := c.clientRequestRetryCount(serviceRetries)
+	if c.OperationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.OperationTimeout)
+		defer cancel()
+	}
+
+	token, err := c.requestToken(ctx, cacheKey, resource, scopes, tokenRetries)
 	if err != nil {
 		return nil, err
 	}
+	stats.countServiceAttempt()
 	resp, err := exec(token)
 	if err != nil {
 		return resp, err
@@ -131,20 +508,30 @@ func (c *Client) RequestWithCustomRetry(cacheKey string, scopes []string, numRet
 	if clientRetry > 0 {
 		//Retry only on 401 response from the service.
 		//Get a fresh token from authentication service and retry.
-		for retry := 0; resp.StatusCode == http.StatusUnauthorized && retry < clientRetry; retry++ {
-			sleep := time.Duration(math.Pow(2, float64(retry)))
-			log.Warnf("Sand request: retrying after %d sec on %d", sleep, http.StatusUnauthorized)
-			time.Sleep(sleep * time.Second)
+		for retry := 0; c.isRetriable(resp) && retry < clientRetry; retry++ {
+			sleep := c.backoff(retry)
+			if exceedsDeadline(ctx, sleep) {
+				log.Warnf("Sand request: not retrying on %d because the context is done or the deadline would be exceeded", http.StatusUnauthorized)
+				break
+			}
+			log.Warnf("Sand request: retrying after %v on %d", sleep, http.StatusUnauthorized)
+			if !sleepContext(ctx, sleep) {
+				log.Warnf("Sand request: not retrying on %d because the context is done", http.StatusUnauthorized)
+				break
+			}
 			//Prevent reading from cache on retry
 			if c.Cache != nil {
-				c.Cache.Delete(c.cacheKey(cacheKey, scopes, ""))
+				c.Cache.Delete(c.CacheKey(cacheKey, scopes, resource))
 			}
-			//Set number of retry to 0, since we are already retrying here, don't retry
-			//when getting the token. Otherwise it may lock up for a long time
-			token, err = c.Token(cacheKey, scopes, 0)
+			//We are already retrying here, so only retry getting the token up to
+			//RefreshRetryCount times. Otherwise it may lock up for a long time
+			token, err = c.requestToken(ctx, cacheKey, resource, scopes, c.refreshRetryCount())
 			if err != nil {
 				return resp, err
 			}
+			//The 401 response is discarded, so close it to release the connection
+			closeBody(resp)
+			stats.countServiceAttempt()
 			resp, err = exec(token)
 			if err != nil {
 				return resp, err
@@ -154,78 +541,374 @@ func (c *Client) RequestWithCustomRetry(cacheKey string, scopes []string, numRet
 	return resp, err
 }
 
+//requestToken returns the access token for the service call of a request
+func (c *Client) requestToken(ctx context.Context, cacheKey, resource string, scopes []string, numRetry int) (string, error) {
+	token, err := c.oauth2Token(ctx, "", cacheKey, resource, scopes, numRetry)
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+//RequestWithResponseHandler is the same as Request except that the response is passed
+//to the handler and its body is closed afterwards, so the caller doesn't need to close
+//it. The error of the request or the handler is returned.
+//Usage Example:
+// err := client.RequestWithResponseHandler("some-service", []string{"s1"}, func(token string) (*http.Response, error) {
+//   // Make http request with client.AuthorizationHeader(token) in the Authorization header
+// }, func(resp *http.Response) error {
+//   return json.NewDecoder(resp.Body).Decode(&result)
+// })
+func (c *Client) RequestWithResponseHandler(cacheKey string, scopes []string, exec func(string) (*http.Response, error), handler func(*http.Response) error) error {
+	resp, err := c.Request(cacheKey, scopes, exec)
+	defer closeBody(resp)
+	if err != nil {
+		return err
+	}
+	return handler(resp)
+}
+
+//closeBody drains and closes the body of the response so that the connection can
+//be reused. The response may be nil.
+func closeBody(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDrainSize))
+	resp.Body.Close()
+}
+
 //Token returns an OAuth2 token string retrieved from the OAuth2 server. It also puts the
 //token in the cache up to specified amount of time.
 func (c *Client) Token(cacheKey string, scopes []string, numRetry int) (string, error) {
-	token, err := c.OAuth2Token(cacheKey, scopes, numRetry)
+	return c.TokenForResource(cacheKey, "", scopes, numRetry)
+}
+
+//TokenForResource is the same as Token except that the token is cached for the
+//resource. See OAuth2TokenForResource.
+func (c *Client) TokenForResource(cacheKey, resource string, scopes []string, numRetry int) (string, error) {
+	token, err := c.OAuth2TokenForResource(cacheKey, resource, scopes, numRetry)
 	if err == nil {
 		return token.AccessToken, err
 	}
 	return "", err
 }
 
+//AccessToken returns an OAuth2 token string for the scopes. It is the same as Token
+//except that the cache key is derived from the scopes, so that the same scopes in
+//any order share one cached token, and DefaultRetryCount is used for retries.
+//Use Token to cache tokens for the same scopes separately, e.g., per resource.
+func (c *Client) AccessToken(ctx context.Context, scopes ...string) (string, error) {
+	token, err := c.FullToken(ctx, scopes...)
+	if err == nil {
+		return token.AccessToken, err
+	}
+	return "", err
+}
+
+//FullToken is the same as AccessToken except that it returns the whole token,
+//including its TokenType, Expiry and RefreshToken, if the OAuth2 server returned
+//them. The token is cached and shared with AccessToken for the same scopes.
+//The returned token is a copy, so it can be modified by the caller.
+func (c *Client) FullToken(ctx context.Context, scopes ...string) (*oauth2.Token, error) {
+	return c.OAuth2TokenWithContext(ctx, accessTokenCacheKey, scopes, -1)
+}
+
 //OAuth2Token returns an OAuth2 token retrieved from the OAuth2 server. It also puts the
 //token in the cache up to specified amount of time.
 func (c *Client) OAuth2Token(cacheKey string, scopes []string, numRetry int) (*oauth2.Token, error) {
+	return c.OAuth2TokenFromURL("", cacheKey, scopes, numRetry)
+}
+
+//OAuth2TokenFromURL is the same as OAuth2Token except that the token is requested
+//from tokenURL instead of the client's TokenURL. An empty tokenURL falls back to
+//the client's TokenURL. Tokens from different token URLs are cached separately.
+func (c *Client) OAuth2TokenFromURL(tokenURL, cacheKey string, scopes []string, numRetry int) (*oauth2.Token, error) {
+	return c.oauth2Token(context.TODO(), tokenURL, cacheKey, "", scopes, numRetry)
+}
+
+//OAuth2TokenForResource is the same as OAuth2Token except that the token is cached
+//for the resource, the same way as Service caches verification results per resource.
+//Tokens with the same cacheKey and scopes but different resources are cached separately.
+func (c *Client) OAuth2TokenForResource(cacheKey, resource string, scopes []string, numRetry int) (*oauth2.Token, error) {
+	return c.oauth2Token(context.TODO(), "", cacheKey, resource, scopes, numRetry)
+}
+
+//OAuth2TokenWithContext is the same as OAuth2Token except that the correlation ID
+//in ctx, if any, is sent to the OAuth2 server. See CorrelationIDKey.
+func (c *Client) OAuth2TokenWithContext(ctx context.Context, cacheKey string, scopes []string, numRetry int) (*oauth2.Token, error) {
+	return c.oauth2Token(ctx, "", cacheKey, "", scopes, numRetry)
+}
+
+//IsTokenCached tells if there is an unexpired token in the cache for the cacheKey
+//and the scopes, e.g., for deciding whether to warm the cache. It neither fetches a
+//token nor counts as a cache read in the CacheStats.
+func (c *Client) IsTokenCached(cacheKey string, scopes []string) (cached bool) {
+	if c.Cache == nil || cacheKey == "" {
+		return false
+	}
+	defer func() {
+		//A cache that panics on a corrupted entry doesn't have a usable token
+		if r := recover(); r != nil {
+			cached = false
+		}
+	}()
+	token, ok := c.Cache.Read(c.CacheKey(cacheKey, scopes, "")).(oauth2.Token)
+	return ok && !isExpired(&token)
+}
+
+func (c *Client) oauth2Token(ctx context.Context, tokenURL, cacheKey, resource string, scopes []string, numRetry int) (*oauth2.Token, error) {
+	//The same scopes in a different order or with duplicates share the token
+	scopes = NormalizeScopes(scopes)
 	var ckey string
 	if c.Cache != nil && cacheKey != "" {
-		ckey = c.cacheKey(cacheKey, scopes, "")
-		value := c.Cache.Read(ckey)
+		scopes = c.tokenScopes(scopes)
+		ckey = c.tokenCacheKey(tokenURL, cacheKey, resource, scopes)
+		value, err := c.readCache(ckey)
+		if err != nil {
+			return nil, err
+		}
 		if value != nil {
 			if tk, ok := value.(oauth2.Token); ok {
 				return &tk, nil
 			}
+			log.Debugf("Sand cache: evicting %s because of unexpected value type %T", ckey, value)
+			c.evictCache(ckey)
+		} else {
+			c.tokenMissed(ckey)
 		}
 	}
-	token, err := c.OAuth2TokenWithoutCaching(scopes, numRetry)
+	token, err := c.oauth2TokenWithoutCaching(ctx, tokenURL, scopes, numRetry)
 	if err != nil {
 		return nil, err
 	}
 	if c.Cache != nil && cacheKey != "" {
 		expiresIn := 0
-		//If token.Expiry is zero, it means no limit. Otherwise we compute the limit.
+		//If token.Expiry is zero, it means no limit. Otherwise we compute the limit,
+		//which must be positive since 0 means no limit in the cache.
 		if !token.Expiry.IsZero() {
-			expiresIn = int(token.Expiry.Unix() - time.Now().Unix())
+			expiresIn = int(token.Expiry.Unix() - time.Now().Unix() - int64(c.ExpirySkew/time.Second))
+			if expiresIn <= 0 {
+				expiresIn = -1
+			}
 		}
 		if expiresIn >= 0 {
-			c.Cache.Write(ckey, *token, time.Duration(expiresIn)*time.Second)
+			ttl := time.Duration(expiresIn) * time.Second
+			if err = c.writeCache(ckey, *token, ttl); err != nil {
+				return nil, err
+			}
+			if ttl > 0 {
+				c.recordTokenExpiry(ckey, time.Now().Add(ttl))
+			} else {
+				c.recordTokenExpiry(ckey, time.Time{})
+			}
 		}
 	}
 	return token, nil
 }
 
 //OAuth2TokenWithoutCaching makes the connection to the OAuth server and returns oauth2.Token
-//The returned token could have empty accessToken.
+//A response without an access token returns an AuthenticationError.
 func (c *Client) OAuth2TokenWithoutCaching(scopes []string, numRetry int) (token *oauth2.Token, err error) {
-	numRetry = c.tokenRequestRetryCount(numRetry)
-
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.TLSClientConfig.MinVersion = c.SSLMinVersion
-	client := &http.Client{Transport: transport}
+	return c.OAuth2TokenFromURLWithoutCaching("", scopes, numRetry)
+}
 
-	ctx := context.TODO()
-	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+//OAuth2TokenFromURLWithoutCaching is the same as OAuth2TokenWithoutCaching except
+//that the token is requested from tokenURL instead of the client's TokenURL. An
+//empty tokenURL falls back to the client's TokenURL.
+func (c *Client) OAuth2TokenFromURLWithoutCaching(tokenURL string, scopes []string, numRetry int) (token *oauth2.Token, err error) {
+	return c.oauth2TokenWithoutCaching(context.TODO(), tokenURL, scopes, numRetry)
+}
 
-	config := clientcredentials.Config{
-		ClientID:     c.ClientID,
-		ClientSecret: c.ClientSecret,
-		TokenURL:     c.TokenURL,
-		Scopes:       scopes,
+func (c *Client) oauth2TokenWithoutCaching(ctx context.Context, tokenURL string, scopes []string, numRetry int) (token *oauth2.Token, err error) {
+	if ctx == nil {
+		ctx = context.TODO()
+	}
+	if tokenURL == "" {
+		tokenURL = c.TokenURL
 	}
-	token, err = config.Token(ctx)
+	numRetry = c.tokenRequestRetryCount(numRetry)
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, c.httpClient(ctx))
+
+	stats := requestStats(ctx)
+	source := c.tokenSource(ctx, tokenURL, scopes)
+	stats.countTokenAttempt()
+	token, err = c.fetchToken(ctx, source)
+	c.tokenFailed(err, 1)
 	if err != nil && numRetry > 0 {
 		for retry := 0; err != nil && retry < numRetry; retry++ {
 			//Exponential backoff on the retry
-			sleep := time.Duration(math.Pow(2, float64(retry)))
-			log.Warnf("Sand token: retrying after %d sec because of error: %v", sleep, err)
-			time.Sleep(sleep * time.Second)
-			token, err = config.Token(ctx)
+			sleep := c.backoff(retry)
+			if exceedsDeadline(ctx, sleep) {
+				log.Warnf("Sand token: not retrying because the context is done or the deadline would be exceeded, error: %v", err)
+				break
+			}
+			log.Warnf("Sand token: retrying after %v because of error: %v", sleep, err)
+			if !sleepContext(ctx, sleep) {
+				log.Warnf("Sand token: not retrying because the context is done, error: %v", err)
+				break
+			}
+			stats.countTokenAttempt()
+			token, err = c.fetchToken(ctx, source)
+			c.tokenFailed(err, retry+2)
+		}
+	}
+	if err != nil {
+		err = c.tokenError(tokenURL, err)
+		c.tokenFailed(err, 0)
+		return token, err
+	}
+	if isExpired(token) && c.ExpiredTokenBehavior != AcceptExpiredToken {
+		if c.ExpiredTokenBehavior == RetryExpiredToken {
+			log.Warnf("Sand token: fetching the token again because it expired at %v", token.Expiry)
+			stats.countTokenAttempt()
+			token, err = c.fetchToken(ctx, source)
+			if err != nil {
+				err = c.tokenError(tokenURL, err)
+				c.tokenFailed(err, 0)
+				return token, err
+			}
+		}
+		if isExpired(token) {
+			err = AuthenticationError{fmt.Sprintf("The token from %s expired at %v when it was fetched, check the clocks of the client and the OAuth2 server", tokenURL, token.Expiry)}
+			c.tokenFailed(err, 0)
+			return nil, err
+		}
+	}
+	//Don't rely on the token source to reject a response with an empty access token
+	if token == nil || token.AccessToken == "" {
+		err = AuthenticationError{fmt.Sprintf("The token response from %s has no access token", tokenURL)}
+		c.tokenFailed(err, 0)
+		return nil, err
+	}
+	return token, nil
+}
+
+//isExpired tells if the token has an expiry time in the past
+func isExpired(token *oauth2.Token) bool {
+	return token != nil && !token.Expiry.IsZero() && token.Expiry.Before(time.Now())
+}
+
+//tokenFailed calls OnTokenError if err is not nil
+func (c *Client) tokenFailed(err error, attempt int) {
+	if err != nil && c.OnTokenError != nil {
+		c.OnTokenError(err, attempt)
+	}
+}
+
+//tokenError converts an error getting a token from tokenURL to a ConnectionError if
+//the OAuth2 server or its proxy could not be reached, an UnavailableError if the
+//OAuth2 server is rate limiting or unavailable, or an AuthenticationError otherwise.
+func (c *Client) tokenError(tokenURL string, err error) error {
+	if isConnectionFailure(err) {
+		return ConnectionError{Message: err.Error()}
+	}
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.Response != nil {
+		status := retrieveErr.Response.StatusCode
+		if c.isProxyFailure(tokenURL, status, retrieveErr.Body) {
+			return ConnectionError{Message: err.Error(), StatusCode: status}
+		}
+		if isUnavailableStatus(status) {
+			return UnavailableError{Message: err.Error(), StatusCode: status}
+		}
+	}
+	return AuthenticationError{err.Error()}
+}
+
+//isUnavailableStatus checks if the status means that the server is rate limiting
+//the requests or is temporarily unavailable
+func isUnavailableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+//isProxyFailure checks if a response with the status and the body from rawURL is a
+//failure of the proxy that the request went through rather than a response of the
+//server, i.e., a 407, or a 403, 502, 503 or 504 without the JSON body of the OAuth2
+//server or SAND. The failures to connect through the proxy are errors instead of
+//responses, see isConnectionFailure.
+func (c *Client) isProxyFailure(rawURL string, status int, body []byte) bool {
+	switch status {
+	case http.StatusProxyAuthRequired:
+	case http.StatusForbidden, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		if json.Valid(body) {
+			return false
 		}
+	default:
+		return false
+	}
+	transport, ok := c.httpTransport().(*http.Transport)
+	if !ok || transport.Proxy == nil {
+		return false
 	}
+	req, err := http.NewRequest("POST", rawURL, nil)
 	if err != nil {
-		err = AuthenticationError{err.Error()}
+		return false
 	}
-	return token, err
+	proxy, err := transport.Proxy(req)
+	return err == nil && proxy != nil
+}
+
+//isConnectionFailure checks if err is a failure to connect to the server or the proxy
+func isConnectionFailure(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect")
+}
+
+//isContextError checks if err is caused by the cancellation or the deadline of a context
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+//httpTransport returns the Transport of the client, or a clone of the default
+//transport with SSLMinVersion as the minimum TLS version if it is not set.
+func (c *Client) httpTransport() http.RoundTripper {
+	if c.Transport != nil {
+		return c.Transport
+	}
+	if c.transports != nil {
+		return c.transports.transport(c.SSLMinVersion)
+	}
+	//Without the pool of NewClient the transport is not reused, so its connections
+	//are not kept alive in the background
+	transport := newDefaultTransport(c.SSLMinVersion)
+	transport.DisableKeepAlives = true
+	return transport
+}
+
+//httpClient returns the HTTP client for the connections to the OAuth2 server and
+//the token verification endpoint. It sends the correlation ID in ctx if any, and
+//reports the ResponseHeaders.
+func (c *Client) httpClient(ctx context.Context) *http.Client {
+	transport := c.correlationTransport(ctx, c.contextTransport(ctx))
+	return &http.Client{Transport: c.responseHeaderTransport(transport)}
+}
+
+//tokenSource returns the token source that gets tokens from the tokenURL. It uses
+//the client credentials grant unless the client has a custom TokenSource. The scopes
+//are not given to it if OmitScopesFromTokenRequest is set.
+func (c *Client) tokenSource(ctx context.Context, tokenURL string, scopes []string) oauth2.TokenSource {
+	if c.OmitScopesFromTokenRequest {
+		scopes = nil
+	}
+	if c.TokenSource != nil {
+		return c.TokenSource(ctx, tokenURL, scopes)
+	}
+	config := clientcredentials.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		TokenURL:     tokenURL,
+		Scopes:       scopes,
+	}
+	return config.TokenSource(ctx)
+}
+
+//CacheKey returns the key of the cache entry of the client's token for the key, the
+//scopes and the resource, e.g., for looking up the entry in a shared cache. The scopes
+//are normalized and replaced by the SupersetScopes like in OAuth2Token.
+func (c *Client) CacheKey(key string, scopes []string, resource string) string {
+	return c.tokenCacheKey("", key, resource, c.tokenScopes(NormalizeScopes(scopes)))
 }
 
 //cacheKey builds the cache key in the format: <CachRoot>/<cacheType>/<key>
@@ -240,26 +923,133 @@ func (c *Client) cacheKey(key string, scopes []string, resource string) string {
 	return rv
 }
 
+//readCache reads the value of the key from the cache. If the cache panics when
+//reading a corrupted entry, the entry is evicted and nil is returned so that the
+//caller proceeds as if it was a cache miss. A read failure is only returned as
+//an error if CacheErrorPolicy is FailClosed.
+func (c *Client) readCache(key string) (value interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Debugf("Sand cache: evicting %s because it failed to be read: %v", key, r)
+			value = nil
+			c.evictCache(key)
+			err = c.cacheError(fmt.Sprintf("failed to read %s: %v", key, r))
+		}
+		c.countCacheRead(value != nil)
+	}()
+	if reader, ok := c.Cache.(cache.ErrorReader); ok {
+		value, err = reader.ReadWithError(key)
+		if err != nil {
+			return nil, c.cacheError(fmt.Sprintf("failed to read %s: %v", key, err))
+		}
+		return value, nil
+	}
+	return c.Cache.Read(key), nil
+}
+
+//writeCache writes the value of the key to the cache. A write failure is reported
+//to OnCacheWriteError, and only returned as an error if CacheErrorPolicy is FailClosed.
+func (c *Client) writeCache(key string, value interface{}, exp time.Duration) error {
+	if err := c.Cache.Write(key, value, exp); err != nil {
+		if c.OnCacheWriteError != nil {
+			c.OnCacheWriteError(key, err)
+		}
+		return c.cacheError(fmt.Sprintf("failed to write %s: %v", key, err))
+	}
+	return nil
+}
+
+//cacheError returns a CacheError with the message if CacheErrorPolicy is FailClosed.
+//Otherwise it logs the message and returns nil.
+func (c *Client) cacheError(message string) error {
+	if c.CacheErrorPolicy == FailClosed {
+		return CacheError{Message: "Sand cache: " + message}
+	}
+	log.Warn("Sand cache: " + message)
+	return nil
+}
+
+//evictCache deletes the key from the cache, ignoring any panic from the cache.
+func (c *Client) evictCache(key string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Debugf("Sand cache: failed to evict %s: %v", key, r)
+		}
+	}()
+	c.Cache.Delete(key)
+}
+
+//tokenScopes returns the normalized SupersetScopes if they contain all the scopes,
+//otherwise the scopes. Empty scopes are returned as they are.
+func (c *Client) tokenScopes(scopes []string) []string {
+	if len(c.SupersetScopes) == 0 || len(scopes) == 0 {
+		return scopes
+	}
+	for _, scope := range scopes {
+		if !contains(c.SupersetScopes, scope) {
+			return scopes
+		}
+	}
+	return NormalizeScopes(c.SupersetScopes)
+}
+
+//tokenCacheKey builds the cache key of a client token. Tokens requested from a
+//token URL other than the client's TokenURL have the URL appended so that they
+//don't collide with the tokens from the default token URL.
+func (c *Client) tokenCacheKey(tokenURL, key, resource string, scopes []string) string {
+	rv := c.cacheKey(key, scopes, resource)
+	if tokenURL != "" && tokenURL != c.TokenURL {
+		rv += "@" + tokenURL
+	}
+	return rv
+}
+
 //For client requests to services, the retry must be at least 1 in case that the
 //token is expired, then a retry would make the client get a new token.
 func (c *Client) clientRequestRetryCount(count int) int {
 	if count >= 1 {
-		return count
+		return c.capRetryCount(count)
 	}
 	if count == 0 || c.DefaultRetryCount < 1 {
 		return 1
 	}
-	return c.DefaultRetryCount
+	return c.capRetryCount(c.DefaultRetryCount)
+}
+
+//isRetriable checks if the request should be retried with a new token because of
+//the response
+func (c *Client) isRetriable(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	return c.Is401Retriable == nil || c.Is401Retriable(resp)
+}
+
+//refreshRetryCount returns the number of retries of getting a new token when a
+//request is retried on 401
+func (c *Client) refreshRetryCount() int {
+	if c.RefreshRetryCount < 0 {
+		return 0
+	}
+	return c.RefreshRetryCount
 }
 
 //For requests to get Sand access tokens, we allow 0 retry if the caller doesn't
 //want to retry. Specifying a negative number will make it use the default retry count.
 func (c *Client) tokenRequestRetryCount(count int) int {
 	if count >= 0 {
-		return count
+		return c.capRetryCount(count)
 	}
 	if c.DefaultRetryCount < 0 {
 		return 0
 	}
-	return c.DefaultRetryCount
+	return c.capRetryCount(c.DefaultRetryCount)
+}
+
+//capRetryCount limits the retry count to MaxRetryCount if it is set
+func (c *Client) capRetryCount(count int) int {
+	if c.MaxRetryCount > 0 && count > c.MaxRetryCount {
+		return c.MaxRetryCount
+	}
+	return count
 }
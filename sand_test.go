@@ -4,11 +4,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/coupa/sand-go/cache"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -22,6 +29,9 @@ var _ = Describe("Sand", func() {
 		client, _ = NewClient("i", "s", "u")
 		client.DefaultRetryCount = 0
 	})
+	AfterEach(func() {
+		client.Close()
+	})
 
 	Describe("#NewClient", func() {
 		It("gives error when missing required arguments", func() {
@@ -29,13 +39,27 @@ var _ = Describe("Sand", func() {
 			Expect(err.Error()).To(Equal("NewClient: missing required argument(s)"))
 		})
 
+		It("validates and normalizes the URL with NewValidatedClient", func() {
+			c, err := NewValidatedClient("i", "s", " HTTPS://OAuth.Example.com/oauth2/token ")
+			Expect(err).To(BeNil())
+			Expect(c.TokenURL).To(Equal("https://oauth.example.com/oauth2/token"))
+
+			for _, u := range []string{"oauth.example.com/oauth2/token", "/oauth2/token", "localhost:8080/token"} {
+				_, err = NewValidatedClient("i", "s", u)
+				Expect(err).To(MatchError(ValidationError{InvalidConfig, fmt.Sprintf("invalid TokenURL %q: must be an absolute http(s) URL", u)}))
+			}
+
+			_, err = NewValidatedClient("i", "s", "")
+			Expect(err.Error()).To(Equal("NewClient: missing required argument(s)"))
+		})
+
 		It("uses the same global cache", func() {
 			c1, err := NewClient("a", "s", "u")
 			Expect(err).To(BeNil())
 
 			c2, err := NewClient("a", "s", "u")
 			Expect(err).To(BeNil())
-			Expect(c1.Cache).To(Equal(caches[defaultExpiryTime]))
+			Expect(c1.Cache).To(Equal(caches[DefaultExpiryTime]))
 			Expect(c1.Cache).To(Equal(c2.Cache))
 		})
 
@@ -48,6 +72,95 @@ var _ = Describe("Sand", func() {
 			Expect(c1.Cache).To(Equal(caches[time.Second]))
 			Expect(c1.Cache).To(Equal(c2.Cache))
 		})
+
+		It("uses the default cleanup interval", func() {
+			c, err := NewClient("a", "s", "u")
+			Expect(err).To(BeNil())
+			Expect(c.Cache.(*cache.GoCache).CleanupInterval()).To(Equal(defaultCleanupInterval))
+		})
+
+		It("uses the same global cache with custom cleanup interval", func() {
+			c1, err := NewClientWithCleanupInterval("a", "s", "u", time.Hour, time.Second)
+			Expect(err).To(BeNil())
+			Expect(c1.Cache.(*cache.GoCache).CleanupInterval()).To(Equal(time.Second))
+
+			c2, err := NewClientWithCleanupInterval("a", "s", "u", time.Hour, time.Second)
+			Expect(err).To(BeNil())
+			Expect(c1.Cache).To(BeIdenticalTo(c2.Cache))
+
+			c3, err := NewClientWithExpiration("a", "s", "u", time.Hour)
+			Expect(err).To(BeNil())
+			Expect(c3.Cache).NotTo(BeIdenticalTo(c1.Cache))
+		})
+	})
+
+	Describe("#AuthorizationHeader", func() {
+		It("uses the Bearer scheme by default", func() {
+			Expect(client.AuthorizationHeader("abc")).To(Equal("Bearer abc"))
+			client.AuthorizationScheme = ""
+			Expect(client.AuthorizationHeader("abc")).To(Equal("Bearer abc"))
+		})
+
+		It("uses the AuthorizationScheme", func() {
+			client.AuthorizationScheme = "bearer"
+			Expect(client.AuthorizationHeader("abc")).To(Equal("bearer abc"))
+		})
+	})
+
+	Describe("#Close", func() {
+		It("stops the cache of the client", func() {
+			c, err := NewClientWithCache("a", "s", "u", &stoppableCache{Cache: cache.NewGoCache(time.Hour, 0)})
+			Expect(err).To(BeNil())
+			Expect(c.Close()).To(Succeed())
+			Expect(c.Cache.(*stoppableCache).stopped).To(BeTrue())
+		})
+
+		It("does not stop the shared default caches", func() {
+			caches[DefaultExpiryTime] = &stoppableCache{Cache: cache.NewGoCache(time.Hour, 0)}
+			c, err := NewClient("a", "s", "u")
+			Expect(err).To(BeNil())
+			Expect(c.Close()).To(Succeed())
+			Expect(c.Cache.(*stoppableCache).stopped).To(BeFalse())
+		})
+
+		It("closes the clients while other clients are created", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(2)
+				go func(i int) {
+					defer wg.Done()
+					NewClientWithExpiration("a", "s", "u", time.Duration(i+1)*time.Minute)
+				}(i)
+				go func(i int) {
+					defer wg.Done()
+					c, _ := NewClientWithCleanupInterval("a", "s", "u", time.Hour, time.Duration(i+1)*time.Minute)
+					c.Close()
+				}(i)
+			}
+			wg.Wait()
+		})
+
+		It("closes a client without a cache", func() {
+			client.Cache = nil
+			Expect(client.Close()).To(Succeed())
+		})
+
+		It("leaves no goroutines of the closed clients", func() {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"access_token":"abc","expires_in":3600}`)
+			}))
+			defer ts.Close()
+			before := runtime.NumGoroutine()
+			for i := 0; i < 1000; i++ {
+				c, err := NewClientWithCache("a", "s", ts.URL, cache.NewGoCache(time.Hour, time.Minute))
+				Expect(err).To(BeNil())
+				_, err = c.Token("k", []string{"s"}, 0)
+				Expect(err).To(BeNil())
+				Expect(c.Close()).To(Succeed())
+			}
+			Eventually(runtime.NumGoroutine, 5*time.Second).Should(BeNumerically("<=", before))
+		})
 	})
 
 	Describe("Token tests", func() {
@@ -64,6 +177,41 @@ var _ = Describe("Sand", func() {
 			ts.Close()
 		})
 
+		Describe("#Validate", func() {
+			It("returns nil with a valid configuration", func() {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, `{"access_token":"abc"}`)
+				}
+				Expect(client.Validate(context.Background())).To(Succeed())
+			})
+
+			It("returns an invalid config error with a bad TokenURL", func() {
+				for _, u := range []string{"u", "ftp://oauth.example.com", "http://", "://bad"} {
+					client.TokenURL = u
+					err := client.Validate(context.Background())
+					Expect(err).To(HaveOccurred())
+					Expect(err.(ValidationError).Kind).To(Equal(InvalidConfig))
+				}
+			})
+
+			It("returns an unreachable error when the server cannot be connected", func() {
+				ts.Close()
+				err := client.Validate(context.Background())
+				Expect(err).To(HaveOccurred())
+				Expect(err.(ValidationError).Kind).To(Equal(Unreachable))
+			})
+
+			It("returns an authentication failed error when the server rejects the credentials", func() {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusUnauthorized)
+					fmt.Fprintf(w, `{"error":"invalid_client"}`)
+				}
+				err := client.Validate(context.Background())
+				Expect(err).To(HaveOccurred())
+				Expect(err.(ValidationError).Kind).To(Equal(AuthenticationFailed))
+			})
+		})
+
 		Describe("#Request", func() {
 			Context("with a valid token", func() {
 				It("makes the request successfully", func() {
@@ -317,6 +465,280 @@ var _ = Describe("Sand", func() {
 			})
 		})
 
+		Describe("with Is401Retriable", func() {
+			var calls int
+			exec := func(token string) (*http.Response, error) {
+				calls++
+				header := http.Header{}
+				if calls == 1 {
+					header.Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				} else {
+					header.Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+				}
+				return &http.Response{StatusCode: 401, Header: header}, nil
+			}
+			BeforeEach(func() {
+				calls = 0
+				client.TokenSource = func(ctx context.Context, tokenURL string, scopes []string) oauth2.TokenSource {
+					return &failingTokenSource{}
+				}
+				client.Is401Retriable = func(resp *http.Response) bool {
+					return strings.Contains(resp.Header.Get("WWW-Authenticate"), "invalid_token")
+				}
+			})
+
+			It("retries the retriable 401 responses", func() {
+				resp, err := client.RequestWithCustomRetry("resource", []string{"scope"}, 3, exec)
+				Expect(err).To(BeNil())
+				Expect(resp.StatusCode).To(Equal(401))
+				Expect(calls).To(Equal(2))
+			})
+
+			It("doesn't retry the non-retriable 401 responses", func() {
+				calls = 1
+				resp, err := client.RequestWithCustomRetry("resource", []string{"scope"}, 3, exec)
+				Expect(err).To(BeNil())
+				Expect(resp.StatusCode).To(Equal(401))
+				Expect(calls).To(Equal(2))
+			})
+
+			It("retries every 401 response by default", func() {
+				client.Is401Retriable = nil
+				_, err := client.RequestWithCustomRetry("resource", []string{"scope"}, 2, exec)
+				Expect(err).To(BeNil())
+				Expect(calls).To(Equal(3))
+			})
+		})
+
+		Describe("closing response bodies", func() {
+			BeforeEach(func() {
+				client.TokenSource = func(ctx context.Context, tokenURL string, scopes []string) oauth2.TokenSource {
+					return &failingTokenSource{}
+				}
+			})
+
+			It("closes the bodies of the discarded 401 responses", func() {
+				bodies := []*trackingBody{{}, {}}
+				statuses := []int{401, 200}
+				calls := 0
+				resp, err := client.RequestWithCustomRetry("resource", []string{"scope"}, 1, func(token string) (*http.Response, error) {
+					calls++
+					return &http.Response{StatusCode: statuses[calls-1], Body: bodies[calls-1]}, nil
+				})
+				Expect(err).To(BeNil())
+				Expect(resp.StatusCode).To(Equal(200))
+				Expect(bodies[0].closed).To(BeTrue())
+				Expect(bodies[1].closed).To(BeFalse())
+			})
+
+			It("closes the bodies of all but the last response on sustained 401s", func() {
+				bodies := []*trackingBody{{}, {}, {}}
+				calls := 0
+				resp, err := client.RequestWithCustomRetry("resource", []string{"scope"}, 2, func(token string) (*http.Response, error) {
+					calls++
+					return &http.Response{StatusCode: 401, Body: bodies[calls-1]}, nil
+				})
+				Expect(err).To(BeNil())
+				Expect(calls).To(Equal(3))
+				Expect(resp.Body).To(BeIdenticalTo(bodies[2]))
+				Expect(bodies[0].closed).To(BeTrue())
+				Expect(bodies[1].closed).To(BeTrue())
+				Expect(bodies[2].closed).To(BeFalse())
+			})
+
+			It("closes the body after the response handler", func() {
+				body := &trackingBody{}
+				var closedInHandler bool
+				err := client.RequestWithResponseHandler("resource", []string{"scope"}, func(token string) (*http.Response, error) {
+					return &http.Response{StatusCode: 200, Body: body}, nil
+				}, func(resp *http.Response) error {
+					closedInHandler = body.closed
+					return errors.New("handler error")
+				})
+				Expect(err).To(MatchError("handler error"))
+				Expect(closedInHandler).To(BeFalse())
+				Expect(body.closed).To(BeTrue())
+			})
+
+			It("closes the body on error without calling the handler", func() {
+				body := &trackingBody{}
+				err := client.RequestWithResponseHandler("resource", []string{"scope"}, func(token string) (*http.Response, error) {
+					return &http.Response{StatusCode: 500, Body: body}, errors.New("request error")
+				}, func(resp *http.Response) error {
+					Fail("the handler should not be called")
+					return nil
+				})
+				Expect(err).To(MatchError("request error"))
+				Expect(body.closed).To(BeTrue())
+			})
+		})
+
+		Describe("#OnTokenError", func() {
+			var source *failingTokenSource
+			var attempts []int
+			var errs []error
+			BeforeEach(func() {
+				source = &failingTokenSource{}
+				client.TokenSource = func(ctx context.Context, tokenURL string, scopes []string) oauth2.TokenSource {
+					return source
+				}
+				attempts, errs = nil, nil
+				client.OnTokenError = func(err error, attempt int) {
+					attempts = append(attempts, attempt)
+					errs = append(errs, err)
+				}
+			})
+
+			It("is called for every failed attempt", func() {
+				source.failures = 2
+				_, err := client.OAuth2TokenWithoutCaching([]string{"scope"}, 2)
+				Expect(err).To(BeNil())
+				Expect(attempts).To(Equal([]int{1, 2}))
+				Expect(errs[0]).To(MatchError("failed to get token"))
+			})
+
+			It("is called with the final error if all the attempts failed", func() {
+				source.failures = 10
+				_, err := client.OAuth2TokenWithoutCaching([]string{"scope"}, 1)
+				Expect(err).To(HaveOccurred())
+				Expect(attempts).To(Equal([]int{1, 2, 0}))
+				Expect(errs[2]).To(Equal(err))
+				_, yes := errs[2].(AuthenticationError)
+				Expect(yes).To(BeTrue())
+			})
+
+			It("is not called on success", func() {
+				_, err := client.OAuth2TokenWithoutCaching([]string{"scope"}, 1)
+				Expect(err).To(BeNil())
+				Expect(attempts).To(BeEmpty())
+			})
+		})
+
+		Describe("#RequestWithRetries", func() {
+			var source *failingTokenSource
+			BeforeEach(func() {
+				source = &failingTokenSource{}
+				client.TokenSource = func(ctx context.Context, tokenURL string, scopes []string) oauth2.TokenSource {
+					return source
+				}
+			})
+
+			It("retries getting the token with tokenRetries", func() {
+				source.failures = 1
+				calls := 0
+				resp, err := client.RequestWithRetries("resource", []string{"scope"}, 1, 3, func(token string) (*http.Response, error) {
+					calls++
+					return &http.Response{StatusCode: 200}, nil
+				})
+				Expect(err).To(BeNil())
+				Expect(resp.StatusCode).To(Equal(200))
+				Expect(source.count).To(Equal(2))
+				Expect(calls).To(Equal(1))
+
+				source.failures = 10
+				source.count = 0
+				client.Cache.Delete(client.cacheKey("resource", []string{"scope"}, ""))
+				_, err = client.RequestWithRetries("resource", []string{"scope"}, 0, 3, func(token string) (*http.Response, error) {
+					calls++
+					return &http.Response{StatusCode: 200}, nil
+				})
+				_, yes := err.(AuthenticationError)
+				Expect(yes).To(BeTrue())
+				Expect(source.count).To(Equal(1))
+				Expect(calls).To(Equal(1))
+			})
+
+			It("calls the service again on 401 with serviceRetries", func() {
+				calls := 0
+				resp, err := client.RequestWithRetries("resource", []string{"scope"}, 3, 2, func(token string) (*http.Response, error) {
+					calls++
+					return &http.Response{StatusCode: 401}, nil
+				})
+				Expect(err).To(BeNil())
+				Expect(resp.StatusCode).To(Equal(401))
+				Expect(calls).To(Equal(3))
+				//The token is fetched again without retry for every service retry
+				Expect(source.count).To(Equal(3))
+			})
+
+			Context("with an OperationTimeout", func() {
+				BeforeEach(func() {
+					client.OperationTimeout = 1500 * time.Millisecond
+				})
+
+				It("stops retrying on 401 within the timeout", func() {
+					calls := 0
+					start := time.Now()
+					resp, err := client.RequestWithRetries("resource", []string{"scope"}, 0, 5, func(token string) (*http.Response, error) {
+						calls++
+						return &http.Response{StatusCode: 401}, nil
+					})
+					Expect(time.Since(start)).To(BeNumerically("<", client.OperationTimeout))
+					Expect(err).To(BeNil())
+					Expect(resp.StatusCode).To(Equal(401))
+					//The second backoff of 2 seconds would exceed the timeout
+					Expect(calls).To(Equal(2))
+				})
+
+				It("stops retrying getting the token within the timeout", func() {
+					source.failures = 10
+					start := time.Now()
+					_, err := client.RequestWithRetries("resource", []string{"scope"}, 5, 1, func(token string) (*http.Response, error) {
+						return &http.Response{StatusCode: 200}, nil
+					})
+					Expect(time.Since(start)).To(BeNumerically("<", client.OperationTimeout))
+					Expect(err).To(HaveOccurred())
+					Expect(source.count).To(Equal(2))
+				})
+			})
+
+			It("gets a new token on 401 for unsorted scopes", func() {
+				calls := 0
+				resp, err := client.RequestWithRetries("resource", []string{"s2", "s1", "s2"}, 0, 1, func(token string) (*http.Response, error) {
+					calls++
+					if calls == 1 {
+						return &http.Response{StatusCode: 401}, nil
+					}
+					return &http.Response{StatusCode: 200}, nil
+				})
+				Expect(err).To(BeNil())
+				Expect(resp.StatusCode).To(Equal(200))
+				Expect(source.count).To(Equal(2))
+			})
+
+			Context("with a failure getting the new token on 401", func() {
+				var calls int
+				exec := func(token string) (*http.Response, error) {
+					calls++
+					if calls == 1 {
+						return &http.Response{StatusCode: 401}, nil
+					}
+					return &http.Response{StatusCode: 200}, nil
+				}
+				BeforeEach(func() {
+					calls = 0
+					source.failCalls = map[int]bool{2: true}
+				})
+
+				It("doesn't retry getting the token by default", func() {
+					_, err := client.RequestWithRetries("resource", []string{"scope"}, 3, 1, exec)
+					_, yes := err.(AuthenticationError)
+					Expect(yes).To(BeTrue())
+					Expect(source.count).To(Equal(2))
+					Expect(calls).To(Equal(1))
+				})
+
+				It("retries getting the token with RefreshRetryCount", func() {
+					client.RefreshRetryCount = 1
+					resp, err := client.RequestWithRetries("resource", []string{"scope"}, 3, 1, exec)
+					Expect(err).To(BeNil())
+					Expect(resp.StatusCode).To(Equal(200))
+					Expect(source.count).To(Equal(3))
+					Expect(calls).To(Equal(2))
+				})
+			})
+		})
+
 		Describe("#Token", func() {
 			Context("with a valid response", func() {
 				It("returns the token", func() {
@@ -364,10 +786,264 @@ var _ = Describe("Sand", func() {
 			})
 		})
 
+		Describe("#IsTokenCached", func() {
+			BeforeEach(func() {
+				client.Cache = cache.NewGoCache(time.Hour, 0)
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, `{"access_token":"abc","expires_in":3600}`)
+				}
+			})
+
+			It("tells if an unexpired token is cached for the key and scopes", func() {
+				_, err := client.OAuth2Token("resource", []string{"s2", "s1"}, 0)
+				Expect(err).To(BeNil())
+				Expect(client.IsTokenCached("resource", []string{"s1", "s2"})).To(BeTrue())
+				Expect(client.CacheStats().Hits).To(Equal(int64(0)))
+			})
+
+			It("tells that an expired token is not cached", func() {
+				key := client.tokenCacheKey("", "resource", "", []string{"s1"})
+				client.Cache.Write(key, oauth2.Token{AccessToken: "abc", Expiry: time.Now().Add(-time.Minute)}, time.Hour)
+				Expect(client.IsTokenCached("resource", []string{"s1"})).To(BeFalse())
+
+				client.Cache.Write(key, oauth2.Token{AccessToken: "abc"}, time.Millisecond)
+				time.Sleep(5 * time.Millisecond)
+				Expect(client.IsTokenCached("resource", []string{"s1"})).To(BeFalse())
+			})
+
+			It("tells that an absent token is not cached without fetching it", func() {
+				requests := 0
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					requests++
+				}
+				Expect(client.IsTokenCached("resource", []string{"s1"})).To(BeFalse())
+				Expect(client.IsTokenCached("other", nil)).To(BeFalse())
+				Expect(requests).To(Equal(0))
+				Expect(client.CacheStats().Misses).To(Equal(int64(0)))
+
+				client.Cache = nil
+				Expect(client.IsTokenCached("resource", []string{"s1"})).To(BeFalse())
+			})
+		})
+
+		Describe("#CacheKey", func() {
+			BeforeEach(func() {
+				client.Cache = cache.NewGoCache(time.Hour, 0)
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, `{"access_token":"abc","expires_in":3600}`)
+				}
+			})
+
+			It("returns the key of the cached token", func() {
+				_, err := client.OAuth2Token("resource", []string{"s2", "s1", "s1"}, 0)
+				Expect(err).To(BeNil())
+				key := client.CacheKey("resource", []string{"s1", "s2"}, "")
+				Expect(key).To(Equal(client.tokenCacheKey("", "resource", "", []string{"s1", "s2"})))
+				Expect(key).To(Equal("sand/resources/resource/s1_s2"))
+				Expect(client.Cache.Read(key)).To(BeAssignableToTypeOf(oauth2.Token{}))
+			})
+
+			It("returns the key with the resource and the SupersetScopes", func() {
+				client.SupersetScopes = []string{"s1", "s2", "s3"}
+				Expect(client.CacheKey("key", []string{"s2"}, "res")).To(Equal(client.tokenCacheKey("", "key", "res", []string{"s1", "s2", "s3"})))
+				Expect(client.CacheKey("key", nil, "")).To(Equal(client.cacheKey("key", nil, "")))
+			})
+		})
+
+		Describe("#AccessToken", func() {
+			var count int
+			BeforeEach(func() {
+				client.Cache = cache.NewGoCache(10, 0)
+				count = 0
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					count++
+					fmt.Fprintf(w, `{"access_token":"abc%d","expires_in":3600}`, count)
+				}
+			})
+
+			It("caches the token by the scopes", func() {
+				token, err := client.AccessToken(context.Background(), "s1", "s2")
+				Expect(err).To(BeNil())
+				Expect(token).To(Equal("abc1"))
+				Expect(client.Cache.Read(client.cacheKey(accessTokenCacheKey, []string{"s1", "s2"}, ""))).NotTo(BeNil())
+
+				token, err = client.AccessToken(context.Background(), "s2", "s1")
+				Expect(err).To(BeNil())
+				Expect(token).To(Equal("abc1"))
+				Expect(count).To(Equal(1))
+			})
+
+			It("requests and caches the token with the normalized scopes", func() {
+				var requested []string
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					count++
+					r.ParseForm()
+					requested = append(requested, r.FormValue("scope"))
+					fmt.Fprintf(w, `{"access_token":"abc%d","expires_in":3600}`, count)
+				}
+				token, err := client.OAuth2TokenWithContext(context.Background(), "resource", []string{"s2", "s1", "s2"}, 0)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("abc1"))
+				Expect(requested).To(Equal([]string{"s1 s2"}))
+
+				token, err = client.OAuth2TokenWithContext(context.Background(), "resource", []string{"s1", "s2"}, 0)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("abc1"))
+				Expect(count).To(Equal(1))
+			})
+
+			It("caches the tokens for different scopes separately", func() {
+				token, err := client.AccessToken(context.Background(), "s1")
+				Expect(err).To(BeNil())
+				Expect(token).To(Equal("abc1"))
+
+				token, err = client.AccessToken(context.Background(), "s2")
+				Expect(err).To(BeNil())
+				Expect(token).To(Equal("abc2"))
+
+				token, err = client.AccessToken(context.Background())
+				Expect(err).To(BeNil())
+				Expect(token).To(Equal("abc3"))
+
+				token, err = client.AccessToken(context.Background(), "s1")
+				Expect(err).To(BeNil())
+				Expect(token).To(Equal("abc1"))
+				Expect(count).To(Equal(3))
+			})
+
+			It("returns the error", func() {
+				client.DefaultRetryCount = 0
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusUnauthorized)
+				}
+				token, err := client.AccessToken(context.Background(), "s1")
+				_, yes := err.(AuthenticationError)
+				Expect(yes).To(BeTrue())
+				Expect(token).To(Equal(""))
+			})
+		})
+
+		Describe("with SupersetScopes", func() {
+			var requested []string
+			BeforeEach(func() {
+				client.Cache = cache.NewGoCache(10, 0)
+				client.SupersetScopes = []string{"a", "b", "c"}
+				requested = nil
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					r.ParseForm()
+					requested = append(requested, r.PostForm.Get("scope"))
+					fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3600}`, len(requested))
+				}
+			})
+
+			It("reuses the superset token for the subsets of the scopes", func() {
+				for _, scopes := range [][]string{{"a", "b"}, {"a"}, {"c", "b"}, {"a", "b", "c"}} {
+					token, err := client.Token("service", scopes, -1)
+					Expect(err).To(BeNil())
+					Expect(token).To(Equal("token-1"))
+				}
+				Expect(requested).To(Equal([]string{"a b c"}))
+			})
+
+			It("gets a token for the exact scopes that are not a subset", func() {
+				token, err := client.Token("service", []string{"a", "d"}, -1)
+				Expect(err).To(BeNil())
+				Expect(token).To(Equal("token-1"))
+				Expect(requested).To(Equal([]string{"a d"}))
+			})
+
+			It("gets a new superset token when retrying on 401", func() {
+				calls := 0
+				resp, err := client.RequestWithCustomRetry("service", []string{"a"}, 1, func(token string) (*http.Response, error) {
+					calls++
+					if token == "token-1" {
+						return &http.Response{StatusCode: 401}, nil
+					}
+					return &http.Response{StatusCode: 200}, nil
+				})
+				Expect(err).To(BeNil())
+				Expect(resp.StatusCode).To(Equal(200))
+				Expect(requested).To(Equal([]string{"a b c", "a b c"}))
+			})
+		})
+
+		Describe("with OmitScopesFromTokenRequest", func() {
+			var forms []url.Values
+			BeforeEach(func() {
+				client.Cache = cache.NewGoCache(10, 0)
+				client.OmitScopesFromTokenRequest = true
+				forms = nil
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					r.ParseForm()
+					forms = append(forms, r.PostForm)
+					fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3600}`, len(forms))
+				}
+			})
+
+			It("gets the token without the scope parameter", func() {
+				token, err := client.Token("service", []string{"a", "b"}, -1)
+				Expect(err).To(BeNil())
+				Expect(token).To(Equal("token-1"))
+				Expect(forms).To(HaveLen(1))
+				Expect(forms[0]).NotTo(HaveKey("scope"))
+				Expect(forms[0].Get("grant_type")).To(Equal("client_credentials"))
+			})
+
+			It("still caches the tokens for different scopes separately", func() {
+				for _, scopes := range [][]string{{"a"}, {"b"}, {"a"}} {
+					_, err := client.Token("service", scopes, -1)
+					Expect(err).To(BeNil())
+				}
+				Expect(forms).To(HaveLen(2))
+				Expect(client.Cache.Read(client.CacheKey("service", []string{"a"}, "")).(oauth2.Token).AccessToken).To(Equal("token-1"))
+				Expect(client.Cache.Read(client.CacheKey("service", []string{"b"}, "")).(oauth2.Token).AccessToken).To(Equal("token-2"))
+			})
+
+			It("sends the scope parameter by default", func() {
+				client.OmitScopesFromTokenRequest = false
+				_, err := client.Token("service", []string{"a", "b"}, -1)
+				Expect(err).To(BeNil())
+				Expect(forms[0].Get("scope")).To(Equal("a b"))
+			})
+		})
+
+		Describe("#FullToken", func() {
+			var count int
+			BeforeEach(func() {
+				client.Cache = cache.NewGoCache(10, 0)
+				count = 0
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					count++
+					fmt.Fprintf(w, `{"access_token":"abc","token_type":"bearer","refresh_token":"ref","expires_in":3600}`)
+				}
+			})
+
+			It("returns all the fields of the token", func() {
+				for i := 0; i < 2; i++ {
+					token, err := client.FullToken(context.Background(), "s1")
+					Expect(err).To(BeNil())
+					Expect(token.AccessToken).To(Equal("abc"))
+					Expect(token.TokenType).To(Equal("bearer"))
+					Expect(token.RefreshToken).To(Equal("ref"))
+					Expect(token.Expiry).To(BeTemporally("~", time.Now().Add(time.Hour), 5*time.Second))
+				}
+				Expect(count).To(Equal(1))
+			})
+
+			It("shares the cached token with AccessToken", func() {
+				_, err := client.FullToken(context.Background(), "s2", "s1")
+				Expect(err).To(BeNil())
+				token, err := client.AccessToken(context.Background(), "s1", "s2")
+				Expect(err).To(BeNil())
+				Expect(token).To(Equal("abc"))
+				Expect(count).To(Equal(1))
+			})
+		})
+
 		Describe("#OAuth2Token", func() {
 			Context("with a valid response", func() {
 				BeforeEach(func() {
-					client.Cache = cache.NewGoCache(10, 10)
+					client.Cache = cache.NewGoCache(10, 0)
 				})
 				It("caches the token", func() {
 					var oneTime bool
@@ -400,6 +1076,338 @@ var _ = Describe("Sand", func() {
 					Expect(*token).To(Equal(value))
 				})
 			})
+
+			Context("with a corrupted value in the cache", func() {
+				BeforeEach(func() {
+					client.Cache = cache.NewGoCache(10, 0)
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						fmt.Fprintf(w, `{"access_token":"abc","expires_in":3600}`)
+					}
+				})
+
+				It("evicts the value and gets a fresh token", func() {
+					ckey := client.cacheKey("resource", []string{"scope"}, "")
+					client.Cache.Write(ckey, "garbage", 0)
+					token, err := client.OAuth2Token("resource", []string{"scope"}, -1)
+					Expect(err).To(BeNil())
+					Expect(token.AccessToken).To(Equal("abc"))
+					Expect(client.Cache.Read(ckey)).To(Equal(*token))
+				})
+
+				It("recovers from a cache that panics on read", func() {
+					ckey := client.cacheKey("resource", []string{"scope"}, "")
+					client.Cache = &panickyCache{Cache: client.Cache, key: ckey}
+					token, err := client.OAuth2Token("resource", []string{"scope"}, -1)
+					Expect(err).To(BeNil())
+					Expect(token.AccessToken).To(Equal("abc"))
+					Expect(client.Cache.(*panickyCache).deleted).To(BeTrue())
+				})
+			})
+		})
+
+		Describe("with a failing cache", func() {
+			var failing *failingCache
+			BeforeEach(func() {
+				failing = &failingCache{Cache: cache.NewGoCache(10, 0)}
+				client.Cache = failing
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, `{"access_token":"abc","expires_in":3600}`)
+				}
+			})
+
+			Context("and FailOpen policy", func() {
+				It("gets the token directly on read failure", func() {
+					failing.readErr = errors.New("connection refused")
+					token, err := client.OAuth2Token("resource", []string{"scope"}, -1)
+					Expect(err).To(BeNil())
+					Expect(token.AccessToken).To(Equal("abc"))
+				})
+
+				It("returns the token on write failure", func() {
+					failing.writeErr = errors.New("connection refused")
+					token, err := client.OAuth2Token("resource", []string{"scope"}, -1)
+					Expect(err).To(BeNil())
+					Expect(token.AccessToken).To(Equal("abc"))
+				})
+
+				It("calls OnCacheWriteError on write failure", func() {
+					failing.writeErr = errors.New("connection refused")
+					var keys []string
+					var errs []error
+					client.OnCacheWriteError = func(key string, err error) {
+						keys = append(keys, key)
+						errs = append(errs, err)
+					}
+					_, err := client.OAuth2Token("resource", []string{"scope"}, -1)
+					Expect(err).To(BeNil())
+					Expect(keys).To(Equal([]string{client.tokenCacheKey("", "resource", "", []string{"scope"})}))
+					Expect(errs).To(Equal([]error{failing.writeErr}))
+				})
+
+				It("does not call OnCacheWriteError when the cache works", func() {
+					called := false
+					client.OnCacheWriteError = func(key string, err error) {
+						called = true
+					}
+					_, err := client.OAuth2Token("resource", []string{"scope"}, -1)
+					Expect(err).To(BeNil())
+					Expect(called).To(BeFalse())
+				})
+			})
+
+			Context("and FailClosed policy", func() {
+				BeforeEach(func() {
+					client.CacheErrorPolicy = FailClosed
+				})
+
+				It("returns the read failure", func() {
+					failing.readErr = errors.New("connection refused")
+					token, err := client.OAuth2Token("resource", []string{"scope"}, -1)
+					Expect(token).To(BeNil())
+					Expect(err).To(BeAssignableToTypeOf(CacheError{}))
+					Expect(err.Error()).To(ContainSubstring("connection refused"))
+				})
+
+				It("returns the write failure", func() {
+					failing.writeErr = errors.New("connection refused")
+					token, err := client.OAuth2Token("resource", []string{"scope"}, -1)
+					Expect(token).To(BeNil())
+					Expect(err).To(BeAssignableToTypeOf(CacheError{}))
+				})
+
+				It("also calls OnCacheWriteError on write failure", func() {
+					failing.writeErr = errors.New("connection refused")
+					calls := 0
+					client.OnCacheWriteError = func(key string, err error) {
+						calls++
+					}
+					_, err := client.OAuth2Token("resource", []string{"scope"}, -1)
+					Expect(err).To(BeAssignableToTypeOf(CacheError{}))
+					Expect(calls).To(Equal(1))
+				})
+
+				It("returns the token when the cache works", func() {
+					token, err := client.OAuth2Token("resource", []string{"scope"}, -1)
+					Expect(err).To(BeNil())
+					Expect(token.AccessToken).To(Equal("abc"))
+				})
+			})
+		})
+
+		Describe("#OAuth2TokenFromURL", func() {
+			var ts2 *httptest.Server
+			BeforeEach(func() {
+				client.Cache = cache.NewGoCache(10, 0)
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, `{"access_token":"abc","expires_in":3600}`)
+				}
+				ts2 = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", "application/json")
+					fmt.Fprintf(w, `{"access_token":"xyz","expires_in":3600}`)
+				}))
+			})
+			AfterEach(func() {
+				ts2.Close()
+			})
+
+			It("gets the tokens from different token URLs and caches them separately", func() {
+				token, err := client.OAuth2TokenFromURL("", "resource", []string{"scope"}, -1)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("abc"))
+
+				token, err = client.OAuth2TokenFromURL(ts2.URL, "resource", []string{"scope"}, -1)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("xyz"))
+
+				defaultKey := client.tokenCacheKey("", "resource", "", []string{"scope"})
+				otherKey := client.tokenCacheKey(ts2.URL, "resource", "", []string{"scope"})
+				Expect(defaultKey).To(Equal(client.cacheKey("resource", []string{"scope"}, "")))
+				Expect(otherKey).NotTo(Equal(defaultKey))
+				Expect(client.Cache.Read(defaultKey).(oauth2.Token).AccessToken).To(Equal("abc"))
+				Expect(client.Cache.Read(otherKey).(oauth2.Token).AccessToken).To(Equal("xyz"))
+
+				token, err = client.OAuth2Token("resource", []string{"scope"}, -1)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("abc"))
+			})
+		})
+
+		Describe("with an ExpirySkew", func() {
+			var ttls *ttlCache
+			BeforeEach(func() {
+				ttls = &ttlCache{Cache: cache.NewGoCache(10, 0), ttls: map[string]time.Duration{}}
+				client.Cache = ttls
+				client.ExpirySkew = time.Minute
+			})
+
+			It("caches the token for shorter than its expiry time", func() {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, `{"access_token":"abc","expires_in":3600}`)
+				}
+				_, err := client.OAuth2Token("resource", []string{"scope"}, -1)
+				Expect(err).To(BeNil())
+				ttl := ttls.ttls[client.cacheKey("resource", []string{"scope"}, "")]
+				Expect(ttl).To(BeNumerically("<=", 3540*time.Second))
+				Expect(ttl).To(BeNumerically(">=", 3538*time.Second))
+			})
+
+			It("does not cache the token expiring within the skew", func() {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, `{"access_token":"abc","expires_in":30}`)
+				}
+				token, err := client.OAuth2Token("resource", []string{"scope"}, -1)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("abc"))
+				Expect(ttls.ttls).To(BeEmpty())
+			})
+		})
+
+		Describe("#OAuth2TokenForResource", func() {
+			var count int
+			BeforeEach(func() {
+				client.Cache = cache.NewGoCache(10, 0)
+				count = 0
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					count++
+					fmt.Fprintf(w, `{"access_token":"abc%d","expires_in":3600}`, count)
+				}
+			})
+
+			It("caches the tokens for different resources separately", func() {
+				token, err := client.OAuth2TokenForResource("key", "r1", []string{"scope"}, -1)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("abc1"))
+
+				token, err = client.OAuth2TokenForResource("key", "r2", []string{"scope"}, -1)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("abc2"))
+
+				Expect(client.Cache.Read(client.cacheKey("key", []string{"scope"}, "r1")).(oauth2.Token).AccessToken).To(Equal("abc1"))
+				Expect(client.Cache.Read(client.cacheKey("key", []string{"scope"}, "r2")).(oauth2.Token).AccessToken).To(Equal("abc2"))
+
+				token, err = client.OAuth2TokenForResource("key", "r1", []string{"scope"}, -1)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("abc1"))
+				Expect(count).To(Equal(2))
+			})
+
+			It("shares the token of OAuth2Token with an empty resource", func() {
+				token, err := client.OAuth2Token("key", []string{"scope"}, -1)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("abc1"))
+
+				token, err = client.OAuth2TokenForResource("key", "", []string{"scope"}, -1)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("abc1"))
+				Expect(count).To(Equal(1))
+			})
+
+			It("uses the token of the resource in requests", func() {
+				for _, resource := range []string{"r1", "r2", "r1"} {
+					resp, err := client.RequestForResource("key", resource, []string{"scope"}, -1, func(token string) (*http.Response, error) {
+						if resource == "r1" {
+							Expect(token).To(Equal("abc1"))
+						} else {
+							Expect(token).To(Equal("abc2"))
+						}
+						return &http.Response{StatusCode: 200}, nil
+					})
+					Expect(err).To(BeNil())
+					Expect(resp.StatusCode).To(Equal(200))
+				}
+				Expect(count).To(Equal(2))
+			})
+		})
+
+		Describe("with a custom TokenSource", func() {
+			var calls int
+			BeforeEach(func() {
+				calls = 0
+				client.Cache = cache.NewGoCache(10, 0)
+				client.TokenSource = func(ctx context.Context, tokenURL string, scopes []string) oauth2.TokenSource {
+					Expect(tokenURL).To(Equal(client.TokenURL))
+					Expect(scopes).To(Equal([]string{"scope"}))
+					Expect(ctx.Value(oauth2.HTTPClient)).NotTo(BeNil())
+					calls++
+					return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "custom", Expiry: time.Now().Add(time.Hour)})
+				}
+			})
+
+			It("gets and caches the token from the custom token source", func() {
+				token, err := client.OAuth2Token("resource", []string{"scope"}, -1)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("custom"))
+
+				token, err = client.OAuth2Token("resource", []string{"scope"}, -1)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("custom"))
+				Expect(calls).To(Equal(1))
+			})
+
+			It("uses the custom token in requests", func() {
+				resp, err := client.Request("resource", []string{"scope"}, func(token string) (*http.Response, error) {
+					Expect(token).To(Equal("custom"))
+					return &http.Response{StatusCode: 200}, nil
+				})
+				Expect(err).To(BeNil())
+				Expect(resp.StatusCode).To(Equal(200))
+			})
+		})
+
+		Describe("with a token that has already expired when fetched", func() {
+			var requests, expiredRequests int
+			BeforeEach(func() {
+				requests = 0
+				expiredRequests = 1
+				client.Cache = cache.NewGoCache(time.Hour, 0)
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					requests++
+					if requests <= expiredRequests {
+						fmt.Fprintf(w, `{"access_token":"old%d","expires_in":-60}`, requests)
+						return
+					}
+					fmt.Fprintf(w, `{"access_token":"new","expires_in":3600}`)
+				}
+			})
+
+			It("fetches the token once more by default", func() {
+				token, err := client.OAuth2Token("resource", []string{"scope"}, 0)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("new"))
+				Expect(requests).To(Equal(2))
+
+				token, err = client.OAuth2Token("resource", []string{"scope"}, 0)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("new"))
+				Expect(requests).To(Equal(2))
+			})
+
+			It("returns an error if the token has expired again", func() {
+				expiredRequests = 2
+				token, err := client.OAuth2Token("resource", []string{"scope"}, 0)
+				Expect(token).To(BeNil())
+				Expect(err).To(BeAssignableToTypeOf(AuthenticationError{}))
+				Expect(err.Error()).To(ContainSubstring("expired at"))
+				Expect(requests).To(Equal(2))
+				Expect(client.Cache.Read(client.cacheKey("resource", []string{"scope"}, ""))).To(BeNil())
+			})
+
+			It("returns an error without fetching the token again with FailOnExpiredToken", func() {
+				client.ExpiredTokenBehavior = FailOnExpiredToken
+				token, err := client.OAuth2Token("resource", []string{"scope"}, 0)
+				Expect(token).To(BeNil())
+				Expect(err).To(BeAssignableToTypeOf(AuthenticationError{}))
+				Expect(requests).To(Equal(1))
+			})
+
+			It("returns the expired token without caching it with AcceptExpiredToken", func() {
+				client.ExpiredTokenBehavior = AcceptExpiredToken
+				token, err := client.OAuth2Token("resource", []string{"scope"}, 0)
+				Expect(err).To(BeNil())
+				Expect(token.AccessToken).To(Equal("old1"))
+				Expect(requests).To(Equal(1))
+				Expect(client.Cache.Read(client.cacheKey("resource", []string{"scope"}, ""))).To(BeNil())
+			})
 		})
 
 		Describe("#OAuth2TokenWithoutCaching", func() {
@@ -445,6 +1453,30 @@ var _ = Describe("Sand", func() {
 				})
 			})
 
+			Context("with an empty access token", func() {
+				It("returns an error for a response with the other fields", func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						fmt.Fprintf(w, `{"access_token":"","expires_in":3600,"scope":"scope","token_type":"bearer","refresh_token":"r"}`)
+					}
+					token, err := client.OAuth2TokenWithoutCaching([]string{"scope"}, -1)
+					Expect(err).To(BeAssignableToTypeOf(AuthenticationError{}))
+					Expect(token).To(BeNil())
+				})
+
+				It("returns an error for a token without an access token from the token source", func() {
+					client.TokenSource = func(ctx context.Context, tokenURL string, scopes []string) oauth2.TokenSource {
+						return oauth2.StaticTokenSource(&oauth2.Token{TokenType: "bearer", RefreshToken: "r", Expiry: time.Now().Add(time.Hour)})
+					}
+					token, err := client.OAuth2TokenWithoutCaching([]string{"scope"}, -1)
+					Expect(err).To(Equal(AuthenticationError{fmt.Sprintf("The token response from %s has no access token", client.TokenURL)}))
+					Expect(token).To(BeNil())
+
+					_, err = client.OAuth2Token("resource", []string{"scope"}, -1)
+					Expect(err).To(HaveOccurred())
+					Expect(client.IsTokenCached("resource", []string{"scope"})).To(BeFalse())
+				})
+			})
+
 			Context("with an error response", func() {
 				BeforeEach(func() {
 					handler = func(w http.ResponseWriter, r *http.Request) {
@@ -472,6 +1504,44 @@ var _ = Describe("Sand", func() {
 					})
 				})
 			})
+			Context("with a context deadline", func() {
+				It("stops retrying before the deadline is exceeded", func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						w.WriteHeader(http.StatusNotFound)
+					}
+					ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+					defer cancel()
+					t1 := time.Now()
+					//5 retries would take 1 + 2 + 4 + 8 + 16 = 31 seconds, but only the first
+					//retry fits in the deadline
+					token, err := client.OAuth2TokenWithContext(ctx, "resource", []string{"scope"}, 5)
+					Expect(time.Since(t1)).To(BeNumerically(">=", time.Second))
+					Expect(time.Since(t1)).To(BeNumerically("<", 2500*time.Millisecond))
+					Expect(token).To(BeNil())
+					_, yes := err.(AuthenticationError)
+					Expect(yes).To(BeTrue())
+				})
+			})
+			Context("with a canceled context", func() {
+				It("stops retrying without waiting for the backoff", func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						w.WriteHeader(http.StatusNotFound)
+					}
+					ctx, cancel := context.WithCancel(context.Background())
+					time.AfterFunc(200*time.Millisecond, cancel)
+					t1 := time.Now()
+					token, err := client.OAuth2TokenWithContext(ctx, "resource", []string{"scope"}, 5)
+					Expect(time.Since(t1)).To(BeNumerically("<", 800*time.Millisecond))
+					Expect(token).To(BeNil())
+					Expect(err).NotTo(BeNil())
+
+					//A context that is already canceled is not retried at all
+					t1 = time.Now()
+					_, err = client.OAuth2TokenWithContext(ctx, "resource", []string{"scope"}, 5)
+					Expect(time.Since(t1)).To(BeNumerically("<", 500*time.Millisecond))
+					Expect(err).NotTo(BeNil())
+				})
+			})
 			Context("with connection error", func() {
 				It("returns a sand.AuthenticationError", func() {
 					client.TokenURL = ""
@@ -522,6 +1592,21 @@ var _ = Describe("Sand", func() {
 				Expect(client.clientRequestRetryCount(-1)).To(Equal(1))
 			})
 		})
+		Context("with a MaxRetryCount", func() {
+			It("clamps the retry count", func() {
+				Expect(client.MaxRetryCount).To(Equal(DefaultMaxRetryCount))
+				Expect(client.clientRequestRetryCount(1000000)).To(Equal(DefaultMaxRetryCount))
+
+				client.MaxRetryCount = 2
+				client.DefaultRetryCount = 5
+				Expect(client.clientRequestRetryCount(3)).To(Equal(2))
+				Expect(client.clientRequestRetryCount(-1)).To(Equal(2))
+				Expect(client.clientRequestRetryCount(0)).To(Equal(1))
+
+				client.MaxRetryCount = 0
+				Expect(client.clientRequestRetryCount(1000000)).To(Equal(1000000))
+			})
+		})
 	})
 
 	Describe("#tokenRequestRetryCount", func() {
@@ -546,5 +1631,126 @@ var _ = Describe("Sand", func() {
 				Expect(client.tokenRequestRetryCount(-1)).To(Equal(0))
 			})
 		})
+		Context("with a MaxRetryCount", func() {
+			It("clamps the retry count", func() {
+				Expect(client.tokenRequestRetryCount(1000000)).To(Equal(DefaultMaxRetryCount))
+
+				client.MaxRetryCount = 2
+				client.DefaultRetryCount = 5
+				Expect(client.tokenRequestRetryCount(3)).To(Equal(2))
+				Expect(client.tokenRequestRetryCount(-1)).To(Equal(2))
+				Expect(client.tokenRequestRetryCount(0)).To(Equal(0))
+			})
+		})
+	})
+
+	Describe("#RequestWithCustomRetry with a MaxRetryCount", func() {
+		It("retries on 401 at most MaxRetryCount times", func() {
+			client.MaxRetryCount = 1
+			client.TokenSource = func(ctx context.Context, tokenURL string, scopes []string) oauth2.TokenSource {
+				return &failingTokenSource{}
+			}
+			calls := 0
+			resp, err := client.RequestWithCustomRetry("resource", []string{"scope"}, 1000, func(token string) (*http.Response, error) {
+				calls++
+				return &http.Response{StatusCode: 401}, nil
+			})
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(401))
+			Expect(calls).To(Equal(2))
+		})
 	})
 })
+
+//panickyCache panics when reading the key until the key is deleted
+type panickyCache struct {
+	cache.Cache
+	key     string
+	deleted bool
+}
+
+func (c *panickyCache) Read(key string) interface{} {
+	if key == c.key && !c.deleted {
+		panic("cannot deserialize the value")
+	}
+	return c.Cache.Read(key)
+}
+
+func (c *panickyCache) Delete(key string) {
+	if key == c.key {
+		c.deleted = true
+	}
+	c.Cache.Delete(key)
+}
+
+//stoppableCache records whether it is stopped
+type stoppableCache struct {
+	cache.Cache
+	stopped bool
+}
+
+func (c *stoppableCache) Stop() {
+	c.stopped = true
+}
+
+//ttlCache records the expiry times of the written keys
+type ttlCache struct {
+	cache.Cache
+	ttls map[string]time.Duration
+}
+
+func (c *ttlCache) Write(key string, value interface{}, exp time.Duration) error {
+	c.ttls[key] = exp
+	return c.Cache.Write(key, value, exp)
+}
+
+//trackingBody is an empty response body that records whether it is closed
+type trackingBody struct {
+	closed bool
+}
+
+func (b *trackingBody) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (b *trackingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+//failingTokenSource fails to get a token for the first number of failures times,
+//and for the calls whose numbers are in failCalls
+type failingTokenSource struct {
+	failures  int
+	failCalls map[int]bool
+	count     int
+}
+
+func (s *failingTokenSource) Token() (*oauth2.Token, error) {
+	s.count++
+	if s.count <= s.failures || s.failCalls[s.count] {
+		return nil, errors.New("failed to get token")
+	}
+	return &oauth2.Token{AccessToken: "abc", Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+//failingCache fails the reads and writes with the given errors
+type failingCache struct {
+	cache.Cache
+	readErr  error
+	writeErr error
+}
+
+func (c *failingCache) ReadWithError(key string) (interface{}, error) {
+	if c.readErr != nil {
+		return nil, c.readErr
+	}
+	return c.Cache.Read(key), nil
+}
+
+func (c *failingCache) Write(key string, item interface{}, exp time.Duration) error {
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	return c.Cache.Write(key, item, exp)
+}
@@ -7,19 +7,81 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
+	"unicode"
 
+	"github.com/coupa/sand-go/cache"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
 )
 
 const (
 	iso8601 = "2006-01-02T15:04:05.00-07:00"
+
+	//serviceAccessTokenKey is the base of the cache key of the service's own access token
+	serviceAccessTokenKey = "service-access-token"
+
+	//DefaultServiceExpTime is the default value of DefaultExpTime of a Service in seconds
+	DefaultServiceExpTime = 3600
+
+	//maxReasonLength is the maximum length of the reason of a denial
+	maxReasonLength = 200
+)
+
+//EmptyScopeBehavior defines how empty target scopes are sent to SAND
+type EmptyScopeBehavior int
+
+const (
+	//EmptyScopesAsEmptyList sends empty target scopes as an empty list. This is the default.
+	EmptyScopesAsEmptyList EmptyScopeBehavior = iota
+	//EmptyScopesOmitted omits the "scopes" field for empty target scopes
+	EmptyScopesOmitted
+	//EmptyScopesAsWildcard sends empty target scopes as ["*"]
+	EmptyScopesAsWildcard
+)
+
+//VerifyEncoding defines how the body of the token verification request is encoded
+type VerifyEncoding int
+
+const (
+	//VerifyAsJSON sends the body as JSON. This is the default.
+	VerifyAsJSON VerifyEncoding = iota
+	//VerifyAsForm sends the body as application/x-www-form-urlencoded. The lists are
+	//sent as repeated fields and the other non-string values, e.g., the context, as JSON.
+	VerifyAsForm
+)
+
+//ScopeMatch defines which of the target scopes a token needs to be allowed
+type ScopeMatch int
+
+const (
+	//MatchAllScopes requires all the target scopes, as checked by SAND. This is the default.
+	MatchAllScopes ScopeMatch = iota
+	//MatchAnyScope requires any of the target scopes. The token is verified with SAND
+	//without the target scopes, and the scopes granted in the "scope", "scopes" or
+	//"scp" field of the response are checked against them.
+	MatchAnyScope
+)
+
+//DenialCaching defines whether the explicit denials of SAND are cached
+type DenialCaching int
+
+const (
+	//CacheDenials caches the responses with "allowed": false for DefaultExpTime. This is the default.
+	CacheDenials DenialCaching = iota
+	//DoNotCacheDenials verifies the denied tokens with SAND again every time
+	DoNotCacheDenials
 )
 
 var notAllowedResponse = map[string]interface{}{
 	"allowed": false,
 }
 
+//now returns the current time for the timers of the verification results
+var now = time.Now
+
 //Service can be used to verify a token with SAND
 type Service struct {
 	Client
@@ -34,12 +96,165 @@ type Service struct {
 	TokenVerifyURL string
 
 	//The default expiry time for cache for invalid tokens and also valid tokens without expiry times
-	//Default value is 3600 (1 hour)
+	//Default value is DefaultServiceExpTime, which is 3600 (1 hour)
 	//Only services need this because client tokens will always give expiry time
 	DefaultExpTime int
 
 	//The scopes required for the service to access the token verification endpoint
 	Scopes []string
+
+	//ExpectedIssuer is the issuer that the "iss" field of an allowed verification
+	//response must match. Not checked if empty.
+	ExpectedIssuer string
+
+	//ExpectedAudience is the audience that the "aud" field of an allowed verification
+	//response must contain. Not checked if empty.
+	ExpectedAudience string
+
+	//DenialCaching defines whether the responses with "allowed": false are cached.
+	//The outcomes of errors and 500 responses from SAND are never cached.
+	//Default is CacheDenials
+	DenialCaching DenialCaching
+
+	//EmptyScopeBehavior defines how empty target scopes are sent to SAND.
+	//Default is EmptyScopesAsEmptyList
+	EmptyScopeBehavior EmptyScopeBehavior
+
+	//VerifyEncoding defines how the body of the token verification request is encoded.
+	//Default is VerifyAsJSON
+	VerifyEncoding VerifyEncoding
+
+	//UseNonce makes the service send a unique "nonce" with each token verification
+	//request, and reject the responses that don't echo back the same nonce.
+	UseNonce bool
+
+	//StrictAuthorizationHeader rejects the incoming requests with more than one
+	//Authorization header with an InvalidRequestError, since a proxy may have added
+	//one in front of the client's. Default is false, which uses the first header.
+	StrictAuthorizationHeader bool
+
+	//RequestFieldNames maps the default field names of the token verification request
+	//body, i.e., "token", "scopes", "resource", "action", "context" and "tenant", to the names
+	//expected by SAND, e.g., {"token": "client_token"}. Fields not in the map keep
+	//their default names.
+	RequestFieldNames map[string]string
+
+	//TrustedTokens maps statically trusted tokens, e.g., of internal machine clients,
+	//to the responses returned for them without calling SAND. The responses are
+	//always allowed, for any scopes, resource and action, and are not cached.
+	//SECURITY: anyone holding a trusted token is allowed without SAND being able
+	//to revoke or expire it, so keep the tokens secret, long and random, load them
+	//from a secret store rather than the code, and rotate them by redeploying.
+	//Default is nil, which trusts no token.
+	TrustedTokens map[string]map[string]interface{}
+
+	//ExpiredTokenGrace is how long after its expiry a token that SAND allowed before
+	//is still allowed when SAND denies it because it expired, i.e., the reason of the
+	//denial mentions the expiry, e.g., for a retryable background job whose token
+	//expired during a long operation. The last allowed response of the token is kept
+	//in the cache until the end of the grace and returned with Grace set. A denial for
+	//another reason, e.g., a revoked token or a missing scope, is never overridden.
+	//SECURITY: SAND may report an expired token that was also revoked as expired, so
+	//keep the grace short, e.g., a minute, and only use it for idempotent operations.
+	//Default is 0, which allows no expired token.
+	ExpiredTokenGrace time.Duration
+
+	//TokenKeyHash hashes the tokens for the cache keys of the verification results, so
+	//that the tokens are not stored in the cache. Default is SHA256Hex
+	TokenKeyHash func(string) string
+
+	//VerifyHeaders are added to every token verification request, e.g.,
+	//{"X-HTTP-Method-Override": {"POST"}} for routing by an API gateway. They are
+	//set before BeforeVerify is called, and cannot replace the Authorization header.
+	VerifyHeaders http.Header
+
+	//BeforeVerify is called with the token verification request right before it is
+	//sent to SAND, e.g., to add headers or sign the body. The verification is aborted
+	//with the error if it returns an error.
+	BeforeVerify func(*http.Request) error
+
+	//RetryVerifyStatuses are the status codes of the token verification endpoint that
+	//the verification is retried on, e.g., {502, 503} for a transient failure of SAND.
+	//They are retried like the connection failures, with the exponential backoff and
+	//up to NumRetry times, and the last response is handled as usual.
+	//Default is nil, which only retries the connection failures.
+	RetryVerifyStatuses []int
+
+	//ResponseParser converts the body of a successful token verification response to
+	//the verification response with the "allowed" field, e.g., for a SAND variant that
+	//wraps it in a "data" object. Default is nil, which decodes the body as a JSON
+	//object with the numbers as json.Number.
+	ResponseParser func([]byte) (map[string]interface{}, error)
+
+	//VolatileResponseFields are the fields of an allowed verification response that
+	//are specific to the verification request, e.g., "jti", so they are removed from
+	//the response written to the cache and not returned for other requests. The
+	//response of the verification itself keeps them. Default is nil, which caches the
+	//whole response.
+	VolatileResponseFields []string
+
+	//CacheTTLFunc computes how long a verification response is cached from the whole
+	//response, e.g., from a "cache_ttl_seconds" hint of SAND. A TTL <= 0 doesn't cache
+	//the response. The NotAllowedTTL of the option still takes precedence for denials.
+	//Default is nil, which caches the allowed responses until their "exp" time and the
+	//others for DefaultExpTime.
+	CacheTTLFunc func(resp map[string]interface{}) time.Duration
+
+	//OnVerificationLatency is called with the time a verification took, e.g., for
+	//latency histograms. cached is true for a result read from the cache, and false
+	//for a verification with SAND, including the failed ones. Trusted tokens and
+	//verifications that are not performed are not reported.
+	OnVerificationLatency func(cached bool, latency time.Duration)
+
+	//AccessTokenCache is a dedicated cache for the service's own access token for
+	//SAND, so that it is not evicted by the churn of the verification results in
+	//Cache, which would add a token request to the next verification.
+	//Default is nil, which caches the access token in Cache.
+	AccessTokenCache cache.Cache
+
+	//AccessTokenCacheID identifies the service's own access token in the cache, so
+	//that services with different credentials sharing a cache don't share their
+	//access tokens. Default is "", which uses the ClientID.
+	AccessTokenCacheID string
+
+	//TokenExtractor extracts the token to verify from an incoming request in VerifyRequest.
+	//Default is ExtractRequestToken, which reads the Authorization header and falls back
+	//to the "access_token" form field
+	TokenExtractor func(*http.Request) string
+
+	//ResourceResolver derives the resource of an incoming request in VerifyRequest,
+	//CheckRequest and Authorized when the option has no Resource, e.g., "order" for the
+	//paths under "/orders/". Default is nil, and a resolver returning "" also uses the
+	//service's Resource.
+	ResourceResolver func(*http.Request) string
+
+	//ClientIPKey is the key under which VerifyRequest adds the IP of the client of the
+	//incoming request to the verification context, e.g., DefaultClientIPKey.
+	//Default is "", which doesn't add the client IP.
+	ClientIPKey string
+
+	//UserAgentKey is the key under which VerifyRequest adds the User-Agent of the
+	//incoming request to the verification context, e.g., DefaultUserAgentKey.
+	//Default is "", which doesn't add the user agent.
+	UserAgentKey string
+
+	//TrustedProxies is the number of proxies in front of the service whose
+	//X-Forwarded-For addresses are trusted for the client IP. SECURITY: the header can
+	//be set by anyone, so only count the proxies that append to it.
+	//Default is 0, which uses the remote address of the connection.
+	TrustedProxies int
+
+	//JWKSURL is the URL of the JSON Web Key Set of the JWTs issued by SAND, e.g.,
+	//"https://oauth.example.com/.well-known/jwks.json", for verifying them locally
+	//in VerifyHybrid. Default is "", which verifies all the tokens with SAND.
+	JWKSURL string
+
+	//maintainer keeps the service access token warm if started
+	maintainer *tokenMaintainer
+
+	//sharesClient is true if the service was built by NewServiceFromClient, so that the
+	//cache and the transports belong to the client
+	sharesClient bool
 }
 
 // VerificationOption affects how tokens are verified
@@ -49,6 +264,141 @@ type VerificationOption struct {
 	Action       string
 	Context      map[string]interface{}
 	NumRetry     *int
+
+	//RequestContext is the Go context of the verification. The correlation ID in it
+	//is sent to SAND, see CorrelationIDKey. VerifyRequest uses the context of the
+	//incoming request if it is not set.
+	RequestContext context.Context
+
+	//CacheKey is used to cache the verification result instead of the token, e.g.,
+	//a session ID, so that different tokens of the same session share the result.
+	//The result is still cached separately for different scopes and resources.
+	CacheKey string
+
+	//ServiceScopes are the scopes of the service access token for this verification
+	//instead of the service's Scopes, e.g., a narrower set for some resources. The
+	//service access tokens for different scopes are cached separately.
+	//Default is nil, which uses the service's Scopes.
+	ServiceScopes []string
+
+	//SkipCache forces the token to be verified with SAND even if the result is cached,
+	//e.g., for step-up authentication. The fresh result still replaces the cached one.
+	SkipCache bool
+
+	//MaxStaleness is the maximum age of a cached result that is accepted, e.g., 30
+	//seconds for sensitive operations. Older results are verified with SAND again and
+	//replaced in the cache. Results are also verified again if the cache doesn't
+	//implement cache.AgeReader. Default is 0, which accepts cached results of any age.
+	MaxStaleness time.Duration
+
+	//NotAllowedTTL is how long a denial of this verification is cached instead of the
+	//DefaultExpTime, e.g., a few seconds for a user who is about to be granted access.
+	//A duration <= 0 doesn't cache the denial. Default is nil, which uses the DefaultExpTime.
+	NotAllowedTTL *time.Duration
+
+	//ScopeMatch defines whether the token needs all or any of the TargetScopes.
+	//Default is MatchAllScopes
+	ScopeMatch ScopeMatch
+
+	//DenialDetails makes a denial return the full response of SAND, e.g., with the
+	//required scopes for an informative 403, instead of a cached denial that only has
+	//the reason. A cached denial is verified with SAND again for it, and the full
+	//response is still not cached.
+	DenialDetails bool
+
+	//Tenant is the tenant or realm the token is verified in with a multi-tenant SAND,
+	//where a token may only be valid in some tenants. It is sent to SAND in the
+	//"tenant" field and the result is cached separately for every tenant. Default is
+	//"", which sends no tenant.
+	Tenant string
+}
+
+//VerificationResult is the result of a token verification
+type VerificationResult struct {
+	//Response is the verification response, which has the "allowed" field
+	Response map[string]interface{}
+
+	//StatusCode is the HTTP status code of the SAND response. It is 0 if SAND was
+	//not called or didn't respond.
+	StatusCode int
+
+	//Cached is true if the result was read from the cache
+	Cached bool
+
+	//TTL is how long the result was written to the cache for. It is 0 if the result
+	//was read from the cache or was not written to the cache.
+	TTL time.Duration
+
+	//Age is how long ago the result was written to the cache if it was read from the
+	//cache. It is 0 if the result was not read from the cache or if the cache doesn't
+	//implement cache.AgeReader.
+	Age time.Duration
+
+	//Expiry is the expiry time of the token given by SAND in the "exp" field of an
+	//allowed response, e.g., for setting the max-age of a gateway's cached responses.
+	//It is zero if the token is not allowed or SAND gave no valid expiry time.
+	Expiry time.Time
+
+	//Reason is the reason of a denial given by SAND in the "reason" or "error" field
+	//of the response. It is sanitized so that it can be included in the responses to
+	//clients. It is empty if the token is allowed or SAND gave no reason.
+	Reason string
+
+	//Grace is true if SAND denied the token because it expired, but it was allowed by
+	//the last allowed response within the ExpiredTokenGrace
+	Grace bool
+}
+
+//Allowed returns whether the token is allowed
+func (r *VerificationResult) Allowed() bool {
+	return r.Response["allowed"] == true
+}
+
+//ExpiryTimer returns a timer that fires when the token expires at Expiry, e.g., to
+//verify the token of a websocket connection again. The timer fires immediately if
+//the token already expired, and the caller should stop it when the connection is
+//closed. It returns nil if there is no Expiry.
+func (r *VerificationResult) ExpiryTimer() *time.Timer {
+	if r.Expiry.IsZero() {
+		return nil
+	}
+	return time.NewTimer(r.Expiry.Sub(now()))
+}
+
+//VerifyResult is the typed form of a verification response, see Authorized and
+//CheckRequestTyped
+type VerifyResult struct {
+	//Allowed is true if the token is allowed
+	Allowed bool
+
+	//Subject is the subject of the token in the "sub" field of the response
+	Subject string
+
+	//Scopes are the scopes granted to the token in the "scope", "scopes" or "scp"
+	//field of the response
+	Scopes []string
+
+	//Expiry is the expiry time of the token in the "exp" field of an allowed response.
+	//It is zero if SAND gave no valid expiry time.
+	Expiry time.Time
+
+	//Reason is the sanitized reason of a denial given by SAND
+	Reason string
+
+	//Response is the verification response for the fields not in VerifyResult
+	Response map[string]interface{}
+}
+
+func newVerifyResult(result *VerificationResult) *VerifyResult {
+	subject, _ := result.Response["sub"].(string)
+	return &VerifyResult{
+		Allowed:  result.Allowed(),
+		Subject:  subject,
+		Scopes:   claimScopes(result.Response),
+		Expiry:   result.Expiry,
+		Reason:   result.Reason,
+		Response: result.Response,
+	}
 }
 
 //NewService returns a Service struct.
@@ -58,16 +408,69 @@ func NewService(id, secret, tokenURL, resource, verifyURL string, scopes []strin
 		err = errors.New("NewService: missing required argument(s)")
 		return
 	}
-	client.cacheType = "tokens"
-	service = &Service{
-		Client:         *client,
+	service = newService(client, resource, verifyURL, scopes)
+	return
+}
+
+//NewValidatedService is the same as NewService except that the tokenURL and the
+//verifyURL are validated and normalized like in NewValidatedClient.
+func NewValidatedService(id, secret, tokenURL, resource, verifyURL string, scopes []string) (*Service, error) {
+	var err error
+	if tokenURL != "" {
+		if tokenURL, err = normalizeEndpointURL("TokenURL", tokenURL); err != nil {
+			return nil, err
+		}
+	}
+	if verifyURL != "" {
+		if verifyURL, err = normalizeEndpointURL("TokenVerifyURL", verifyURL); err != nil {
+			return nil, err
+		}
+	}
+	return NewService(id, secret, tokenURL, resource, verifyURL, scopes)
+}
+
+//NewServiceFromClient returns a Service struct that has the same configuration as
+//the client, including the client's cache, so that the tokens of the client and
+//the service are kept in the same cache.
+func NewServiceFromClient(c *Client, resource, verifyURL string, scopes []string) (service *Service, err error) {
+	if c == nil || resource == "" || verifyURL == "" {
+		err = errors.New("NewServiceFromClient: missing required argument(s)")
+		return
+	}
+	service = newService(c, resource, verifyURL, scopes)
+	service.sharesClient = true
+	return
+}
+
+func newService(c *Client, resource, verifyURL string, scopes []string) *Service {
+	service := &Service{
+		Client:         *c,
 		Resource:       resource,
 		Context:        map[string]interface{}{},
 		TokenVerifyURL: verifyURL,
 		Scopes:         scopes,
-		DefaultExpTime: 3600,
+		DefaultExpTime: DefaultServiceExpTime,
 	}
-	return
+	service.cacheType = "tokens"
+	service.counters = &cacheCounters{}
+	service.fetchLimiter = newTokenFetchLimiter()
+	return service
+}
+
+//Close stops the token maintainer and closes the client of the service. A refresh of
+//the maintainer in progress is canceled, so Close does not wait for the OAuth2 server.
+//The AccessTokenCache is stopped the same way as the client's cache. The client of a
+//service from NewServiceFromClient is not closed, since its cache and transports are
+//still used by the client.
+func (s *Service) Close() error {
+	s.StopTokenMaintainer()
+	if stopper, ok := s.AccessTokenCache.(cache.Stopper); ok && !isDefaultCache(s.AccessTokenCache) {
+		stopper.Stop()
+	}
+	if s.sharesClient {
+		return nil
+	}
+	return s.Client.Close()
 }
 
 //CheckRequest checks the bearer token of an incoming HTTP request and return response with 'allowed' true/false field.
@@ -91,68 +494,491 @@ func (s *Service) CheckRequestWithCustomRetry(r *http.Request, targetScopes []st
 	return s.VerifyRequest(r, VerificationOption{TargetScopes: targetScopes, Action: action, NumRetry: &numRetry})
 }
 
+//CheckRequestTyped is the same as CheckRequest except that the verification response
+//is returned as a VerifyResult, so that its fields are checked by the compiler.
+//The result is never nil. Example with Gin:
+//  func(c *gin.Context) {
+//    result, err := sandService.CheckRequestTyped(c.Request, []string{"scope1"}, "action")
+//    if err != nil || !result.Allowed {
+//      c.JSON(sandService.ErrorCode(err), err)
+//    }
+//  }
+func (s *Service) CheckRequestTyped(r *http.Request, targetScopes []string, action string) (*VerifyResult, error) {
+	numRetry := s.DefaultRetryCount
+	result, err := s.verifyIncomingRequest(r, VerificationOption{TargetScopes: targetScopes, Action: action, NumRetry: &numRetry})
+	return newVerifyResult(result), err
+}
+
 //VerifyRequest takes the token in a request and verifies with SAND
+//The client IP and the user agent of the request are added to the verification
+//context if the ClientIPKey and UserAgentKey are set.
 //Remember to set a reasonable NumRetry value (>= 0) for the VerificationOption
 func (s *Service) VerifyRequest(r *http.Request, opt VerificationOption) (map[string]interface{}, error) {
-	token := ExtractToken(r.Header.Get("Authorization"))
-	rv, err := s.VerifyTokenWithCache(token, opt)
+	result, err := s.verifyIncomingRequest(r, opt)
+	return result.Response, err
+}
+
+//verifyIncomingRequest verifies the token in the request and logs the error if any
+func (s *Service) verifyIncomingRequest(r *http.Request, opt VerificationOption) (*VerificationResult, error) {
+	if err := s.checkAuthorizationHeader(r); err != nil {
+		log.Error(err)
+		return &VerificationResult{Response: notAllowedResponse}, err
+	}
+	token := s.extractToken(r)
+	if opt.RequestContext == nil {
+		opt.RequestContext = r.Context()
+	}
+	if opt.Resource == "" {
+		opt.Resource = s.resolveResource(r)
+	}
+	opt.Context = s.requestContext(r, opt.Context)
+	result, err := s.VerifyTokenWithResult(token, opt)
 	if err != nil {
 		log.Error(err)
 	}
-	return rv, err
+	return result, err
+}
+
+//Authorized verifies the token in the request with SAND for the required scopes and
+//the action, and returns whether the token is allowed together with the details of
+//the verification as a VerifyResult, which is never nil. If the verification response
+//lists the scopes of the token in the "scopes", "scope" or "scp" field, the token must
+//also carry all the required scopes to be authorized.
+//  func(c *gin.Context) {
+//    ok, _, err := sandService.Authorized(c.Request, []string{"scope1"}, "action")
+//    if !ok {
+//      c.JSON(sandService.ErrorCode(err), err)
+//    }
+//  }
+func (s *Service) Authorized(r *http.Request, requiredScopes []string, action string) (bool, *VerifyResult, error) {
+	verification, err := s.verifyIncomingRequest(r, VerificationOption{TargetScopes: requiredScopes, Action: action})
+	result := newVerifyResult(verification)
+	if err != nil {
+		return false, result, err
+	}
+	if !result.Allowed {
+		return false, result, nil
+	}
+	if len(result.Scopes) > 0 {
+		for _, scope := range requiredScopes {
+			if !contains(result.Scopes, scope) {
+				return false, result, nil
+			}
+		}
+	}
+	return true, result, nil
+}
+
+//checkAuthorizationHeader rejects a request with more than one Authorization header
+//if StrictAuthorizationHeader is set
+func (s *Service) checkAuthorizationHeader(r *http.Request) error {
+	if count := len(r.Header.Values("Authorization")); s.StrictAuthorizationHeader && count > 1 {
+		return InvalidRequestError{fmt.Sprintf("The request has %d Authorization headers", count)}
+	}
+	return nil
+}
+
+//resolveResource returns the resource of the request from ResourceResolver if it is
+//set, or "" for the service's Resource
+func (s *Service) resolveResource(r *http.Request) string {
+	if s.ResourceResolver != nil {
+		return s.ResourceResolver(r)
+	}
+	return ""
+}
+
+//extractToken extracts the token from the request with TokenExtractor if it is set
+func (s *Service) extractToken(r *http.Request) string {
+	if s.TokenExtractor != nil {
+		return s.TokenExtractor(r)
+	}
+	return ExtractRequestToken(r)
 }
 
 //ErrorCode gets the HTTP error code based on the error type. By default it is
-//401 unauthorized; if the error is connection error, then it returns 502
+//401 unauthorized; if SAND or its proxy is rate limiting or unavailable, i.e., the
+//error is an UnavailableError or a ConnectionError with a 429 or 503 status, then
+//it returns 503 so that the clients back off. An InvalidRequestError returns 400.
+//Any other error returns 502, since the token could not be verified.
 func (s *Service) ErrorCode(err error) int {
-	if err != nil {
-		//Return 502 on error
-		return http.StatusBadGateway
+	if err == nil {
+		return http.StatusUnauthorized
+	}
+	var invalidErr InvalidRequestError
+	if errors.As(err, &invalidErr) {
+		return http.StatusBadRequest
 	}
-	return http.StatusUnauthorized
+	var unavailableErr UnavailableError
+	var connErr ConnectionError
+	if errors.As(err, &unavailableErr) || (errors.As(err, &connErr) && isUnavailableStatus(connErr.StatusCode)) {
+		return http.StatusServiceUnavailable
+	}
+	//Return 502 on other errors
+	return http.StatusBadGateway
 }
 
 //VerifyTokenWithCache tries to get the result for this token from the cache first.
 //If not found in cache, if will make a token verification request with Sand.
+//Allowed responses are cached, and so are denied responses unless DenialCaching is
+//DoNotCacheDenials. A 500 response is returned as not allowed without being cached,
+//use VerifyTokenWithResult to tell it apart from a denial by the StatusCode.
 func (s *Service) VerifyTokenWithCache(token string, opt VerificationOption) (map[string]interface{}, error) {
+	resp, _, err := s.VerifyTokenWithCacheTTL(token, opt)
+	return resp, err
+}
+
+//VerifyTokenWithCacheTimeout is the same as VerifyTokenWithCache except that the calls
+//to SAND for this verification, including getting the service access token and the
+//retries, are canceled after the timeout.
+func (s *Service) VerifyTokenWithCacheTimeout(token string, opt VerificationOption, timeout time.Duration) (map[string]interface{}, error) {
+	parent := opt.RequestContext
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	opt.RequestContext = ctx
+	return s.VerifyTokenWithCache(token, opt)
+}
+
+//VerifyTokenWithCacheTTL is the same as VerifyTokenWithCache, but it also returns
+//the TTL with which the result was written to the cache. The TTL is 0 if the
+//result was read from the cache or was not written to the cache.
+func (s *Service) VerifyTokenWithCacheTTL(token string, opt VerificationOption) (map[string]interface{}, time.Duration, error) {
+	result, err := s.VerifyTokenWithResult(token, opt)
+	return result.Response, result.TTL, err
+}
+
+//VerifyTokenWithResult is the same as VerifyTokenWithCache, but it returns the
+//details of the verification in a VerificationResult.
+func (s *Service) VerifyTokenWithResult(token string, opt VerificationOption) (*VerificationResult, error) {
 	s.buildOption(&opt)
 	if token == "" || opt.Resource == "" {
-		return notAllowedResponse, nil
+		return &VerificationResult{Response: notAllowedResponse}, nil
+	}
+	if response, ok := s.trustedResponse(token); ok {
+		return &VerificationResult{Response: response, Expiry: responseExpiry(response)}, nil
 	}
 
 	var ckey string
 	if s.Cache != nil {
 		//Calculate cache key for use later
-		ckey = s.cacheKey(token, opt.TargetScopes, opt.Resource)
+		ckey = s.verificationCacheKey(token, opt)
+	}
+	if s.Cache != nil && !opt.SkipCache {
 		//Read from cache
-		result := s.Cache.Read(ckey)
+		start := time.Now()
+		result, err := s.readCache(ckey)
+		if err != nil {
+			return &VerificationResult{Response: notAllowedResponse}, err
+		}
 		response, ok := result.(map[string]interface{})
-		if ok {
-			return response, nil
+		if ok && opt.DenialDetails && response["allowed"] != true {
+			log.Debugf("Sand cache: verifying %s again for the details of the denial", ckey)
+		} else if ok {
+			age, known := s.cacheAge(ckey)
+			if opt.MaxStaleness <= 0 || (known && age <= opt.MaxStaleness) {
+				s.reportLatency(true, start)
+				return &VerificationResult{Response: response, Cached: true, Age: age, Expiry: responseExpiry(response), Reason: denialReason(response)}, nil
+			}
+			log.Debugf("Sand cache: verifying %s again because the cached result is older than %s", ckey, opt.MaxStaleness)
+		} else if result != nil {
+			log.Debugf("Sand cache: evicting %s because of unexpected value type %T", ckey, result)
+			s.evictCache(ckey)
 		}
 	}
-	resp, err := s.verifyToken(token, opt)
+	start := time.Now()
+	resp, status, err := s.verifyTokenWithStatus(token, opt)
+	s.reportLatency(false, start)
 	if err != nil || resp == nil {
-		return notAllowedResponse, err
+		return &VerificationResult{Response: notAllowedResponse, StatusCode: status}, err
 	}
-	if s.Cache != nil {
+	if resp["allowed"] == true {
+		if err = s.validateClaims(resp); err != nil {
+			return &VerificationResult{Response: notAllowedResponse, StatusCode: status}, err
+		}
+	}
+	if resp["allowed"] != true && s.Cache != nil && s.ExpiredTokenGrace > 0 && isExpiryReason(denialReason(resp)) {
+		if allowed, ok := s.graceResponse(ckey); ok {
+			log.Debugf("Sand cache: allowing the expired token of %s within the grace of %s", ckey, s.ExpiredTokenGrace)
+			return &VerificationResult{Response: allowed, StatusCode: status, Expiry: responseExpiry(allowed), Grace: true}, nil
+		}
+	}
+	rv := &VerificationResult{Response: resp, StatusCode: status, Expiry: responseExpiry(resp), Reason: denialReason(resp)}
+	if s.Cache != nil && s.cachesResult(resp, opt) {
 		//Write to cache
-		if resp["allowed"] == true {
-			exp := s.DefaultExpTime
-			if resp["exp"] != nil {
-				expTime, ok := resp["exp"].(string)
-				if ok {
-					exp = s.expiryTime(expTime)
-				}
-			}
-			s.Cache.Write(ckey, resp, time.Duration(exp)*time.Second)
+		rv.TTL = s.cacheTTL(resp)
+		if resp["allowed"] != true && opt.NotAllowedTTL != nil {
+			rv.TTL = *opt.NotAllowedTTL
+		}
+		if s.CacheTTLFunc != nil && rv.TTL <= 0 {
+			rv.TTL = 0
+		} else if resp["allowed"] == true {
+			cached := s.cachedResponse(resp)
+			err = s.writeCache(ckey, cached, rv.TTL)
+			s.writeGraceResponse(ckey, cached, rv.Expiry)
 		} else {
-			s.Cache.Write(ckey, notAllowedResponse, time.Duration(s.DefaultExpTime)*time.Second)
+			err = s.writeCache(ckey, denialResponse(rv.Reason), rv.TTL)
+		}
+		if err != nil {
+			return &VerificationResult{Response: notAllowedResponse, StatusCode: status}, err
+		}
+	}
+	return rv, nil
+}
+
+//reportLatency reports the time since start to OnVerificationLatency if it is set
+func (s *Service) reportLatency(cached bool, start time.Time) {
+	if s.OnVerificationLatency != nil {
+		s.OnVerificationLatency(cached, time.Since(start))
+	}
+}
+
+//cachedResponse returns a copy of the allowed response without the
+//VolatileResponseFields for the cache, or the response itself if there are none.
+func (s *Service) cachedResponse(resp map[string]interface{}) map[string]interface{} {
+	if len(s.VolatileResponseFields) == 0 {
+		return resp
+	}
+	rv := make(map[string]interface{}, len(resp))
+	for field, value := range resp {
+		if !contains(s.VolatileResponseFields, field) {
+			rv[field] = value
+		}
+	}
+	return rv
+}
+
+//graceKey returns the cache key of the last allowed response for ExpiredTokenGrace
+func graceKey(ckey string) string {
+	return ckey + "/grace"
+}
+
+//writeGraceResponse keeps the allowed response until the end of the ExpiredTokenGrace
+//after the expiry of the token. Failures are ignored since the grace is optional.
+func (s *Service) writeGraceResponse(ckey string, resp map[string]interface{}, expiry time.Time) {
+	if s.ExpiredTokenGrace <= 0 || expiry.IsZero() {
+		return
+	}
+	if ttl := time.Until(expiry.Add(s.ExpiredTokenGrace)); ttl > 0 {
+		s.writeCache(graceKey(ckey), resp, ttl)
+	}
+}
+
+//graceResponse returns the last allowed response if the token expired within the
+//ExpiredTokenGrace. A token that has not expired yet was denied for another reason,
+//e.g., it was revoked, so it is not allowed.
+func (s *Service) graceResponse(ckey string) (map[string]interface{}, bool) {
+	value, _ := s.readCache(graceKey(ckey))
+	resp, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	expiry := responseExpiry(resp)
+	if expiry.IsZero() || time.Now().Before(expiry) || !time.Now().Before(expiry.Add(s.ExpiredTokenGrace)) {
+		return nil, false
+	}
+	return resp, true
+}
+
+//isExpiryReason checks if the reason of a denial is that the token expired
+func isExpiryReason(reason string) bool {
+	return strings.Contains(strings.ToLower(reason), "expir")
+}
+
+//VerifyTokenNoCache verifies the token with SAND without reading or writing the
+//verification result in the cache, e.g., for callers who cache the results
+//themselves or need a fresh result. The TrustedTokens are still allowed, and the
+//service's own access token for SAND is still cached.
+func (s *Service) VerifyTokenNoCache(token string, opt VerificationOption) (map[string]interface{}, error) {
+	s.buildOption(&opt)
+	if response, ok := s.trustedResponse(token); ok {
+		return response, nil
+	}
+	resp, err := s.verifyToken(token, opt)
+	if err != nil || resp == nil {
+		return notAllowedResponse, err
+	}
+	if resp["allowed"] == true {
+		if err = s.validateClaims(resp); err != nil {
+			return notAllowedResponse, err
 		}
 	}
 	return resp, nil
 }
 
+//cachesResult tells if the verification response is written to the cache
+func (s *Service) cachesResult(resp map[string]interface{}, opt VerificationOption) bool {
+	if resp["allowed"] == true {
+		return true
+	}
+	if s.DenialCaching == DoNotCacheDenials {
+		return false
+	}
+	return opt.NotAllowedTTL == nil || *opt.NotAllowedTTL > 0
+}
+
+//trustedResponse returns the allowed response of the token if it is in TrustedTokens
+func (s *Service) trustedResponse(token string) (map[string]interface{}, bool) {
+	canned, ok := s.TrustedTokens[token]
+	if !ok {
+		return nil, false
+	}
+	response := make(map[string]interface{}, len(canned)+1)
+	for k, v := range canned {
+		response[k] = v
+	}
+	response["allowed"] = true
+	return response, true
+}
+
+//denialReason returns the sanitized reason of the denial in the response, or an empty
+//string if the response is allowed or has no reason.
+func denialReason(resp map[string]interface{}) string {
+	if resp["allowed"] == true {
+		return ""
+	}
+	for _, field := range []string{"reason", "error"} {
+		if reason, ok := resp[field].(string); ok && reason != "" {
+			return sanitizeReason(reason)
+		}
+	}
+	return ""
+}
+
+//sanitizeReason removes the control characters from the reason and truncates it to
+//maxReasonLength characters.
+func sanitizeReason(reason string) string {
+	reason = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, reason)
+	if runes := []rune(reason); len(runes) > maxReasonLength {
+		reason = string(runes[:maxReasonLength])
+	}
+	return strings.TrimSpace(reason)
+}
+
+//denialResponse is the response cached for a denial with the reason
+func denialResponse(reason string) map[string]interface{} {
+	if reason == "" {
+		return notAllowedResponse
+	}
+	return map[string]interface{}{"allowed": false, "reason": reason}
+}
+
+//VerificationCacheKey returns the key of the cache entry of the verification result
+//of the token with the option in VerifyTokenWithCache, e.g., for looking up the entry
+//in a shared cache. The token is hashed with TokenKeyHash, and the Resource and the
+//Context of the service are used if the option has none.
+func (s *Service) VerificationCacheKey(token string, opt VerificationOption) string {
+	s.buildOption(&opt)
+	return s.verificationCacheKey(token, opt)
+}
+
+//verificationCacheKey builds the cache key of the verification result of the token.
+//The CacheKey of the option is used instead of the token if it is set. The action, the
+//context and the tenant are part of the key if they are given, since SAND may decide
+//differently for them.
+func (s *Service) verificationCacheKey(token string, opt VerificationOption) string {
+	key := s.tokenKey(token)
+	if opt.CacheKey != "" {
+		key = "key:" + opt.CacheKey
+	}
+	rv := s.cacheKey(key, opt.TargetScopes, opt.Resource)
+	if opt.Action != "" {
+		rv += "/action:" + opt.Action
+	}
+	if len(opt.Context) > 0 {
+		rv += "/context:" + contextKey(opt.Context)
+	}
+	if matchesAnyScope(opt) {
+		rv += "/match:any"
+	}
+	if opt.Tenant != "" {
+		rv += "/tenant:" + opt.Tenant
+	}
+	return rv
+}
+
+//matchesAnyScope tells if the verification needs only any of several target scopes
+func matchesAnyScope(opt VerificationOption) bool {
+	return opt.ScopeMatch == MatchAnyScope && len(opt.TargetScopes) > 1
+}
+
+//grantsAnyScope tells if the response grants any of the scopes
+func grantsAnyScope(resp map[string]interface{}, scopes []string) bool {
+	granted := claimScopes(resp)
+	for _, scope := range scopes {
+		if contains(granted, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+//contextKey returns the hash of the canonical serialization of the context, so that
+//equal contexts have the same key regardless of the order of their map entries.
+func contextKey(ctx map[string]interface{}) string {
+	//encoding/json sorts the keys of maps, including the nested ones
+	canonical, err := json.Marshal(ctx)
+	if err != nil {
+		canonical = []byte(fmt.Sprintf("%v", ctx))
+	}
+	return SHA256Hex(string(canonical))
+}
+
+//tokenKey hashes the token for the cache key with TokenKeyHash
+func (s *Service) tokenKey(token string) string {
+	if s.TokenKeyHash != nil {
+		return s.TokenKeyHash(token)
+	}
+	return SHA256Hex(token)
+}
+
+//cacheAge returns how long ago the key was written to the cache, and false if unknown
+func (s *Service) cacheAge(key string) (time.Duration, bool) {
+	if reader, ok := s.Cache.(cache.AgeReader); ok {
+		return reader.Age(key)
+	}
+	return 0, false
+}
+
+//cacheTTL computes how long a verification response is cached with CacheTTLFunc if
+//it is set. Otherwise allowed responses are cached until their "exp" time, and the
+//others are cached for DefaultExpTime.
+func (s *Service) cacheTTL(resp map[string]interface{}) time.Duration {
+	if s.CacheTTLFunc != nil {
+		return s.CacheTTLFunc(resp)
+	}
+	exp := s.DefaultExpTime
+	if resp["allowed"] == true && resp["exp"] != nil {
+		switch expTime := resp["exp"].(type) {
+		case string:
+			exp = s.expiryTime(expTime)
+		case json.Number:
+			exp = s.numericExpiryTime(expTime)
+		}
+	}
+	return time.Duration(exp) * time.Second
+}
+
+//responseExpiry returns the expiry time in the "exp" field of an allowed response,
+//or the zero time if there is none or it is invalid.
+func responseExpiry(resp map[string]interface{}) time.Time {
+	exp, ok := resp["exp"]
+	if !ok || resp["allowed"] != true {
+		return time.Time{}
+	}
+	expiry, err := claimTime(exp)
+	if err != nil {
+		return time.Time{}
+	}
+	return expiry
+}
+
 //Set the defaults for values that are not given.
 func (s *Service) buildOption(opt *VerificationOption) {
 	if opt.Resource == "" {
@@ -170,21 +996,52 @@ func (s *Service) buildOption(opt *VerificationOption) {
 	}
 	retry = s.tokenRequestRetryCount(retry)
 	opt.NumRetry = &retry
+	if opt.RequestContext == nil {
+		opt.RequestContext = context.Background()
+	}
+}
+
+//retriesVerify tells if the verification is retried after the response or the error,
+//i.e., on a connection failure or a status in RetryVerifyStatuses. A canceled or timed
+//out request is not retried.
+func (s *Service) retriesVerify(resp *http.Response, err error) bool {
+	if err != nil {
+		return isConnectionFailure(err) && !isContextError(err)
+	}
+	for _, status := range s.RetryVerifyStatuses {
+		if resp.StatusCode == status {
+			return true
+		}
+	}
+	return false
 }
 
 //verifyToken verifies with SAND to see if the token is allowed to access this service.
 func (s *Service) verifyToken(token string, opt VerificationOption) (map[string]interface{}, error) {
+	result, _, err := s.verifyTokenWithStatus(token, opt)
+	return result, err
+}
+
+//verifyTokenWithStatus is the same as verifyToken, but it also returns the HTTP
+//status code of the SAND response, which is 0 if SAND didn't respond.
+func (s *Service) verifyTokenWithStatus(token string, opt VerificationOption) (map[string]interface{}, int, error) {
 	if token == "" || opt.Resource == "" {
-		return nil, nil
+		return nil, 0, nil
+	}
+	if opt.RequestContext == nil {
+		opt.RequestContext = context.Background()
+	}
+	var anyScopes []string
+	if matchesAnyScope(opt) {
+		//SAND requires all the target scopes, so the granted scopes are checked after
+		anyScopes, opt.TargetScopes = opt.TargetScopes, []string{}
 	}
-	accessToken, err := s.Token("service-access-token", s.Scopes, *opt.NumRetry)
+	accessToken, err := s.accessToken(opt.RequestContext, opt.ServiceScopes, *opt.NumRetry)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.TLSClientConfig.MinVersion = s.SSLMinVersion
-	client := &http.Client{Transport: transport}
+	client := s.httpClient(opt.RequestContext)
 
 	data := map[string]interface{}{
 		"scopes":   opt.TargetScopes,
@@ -193,12 +1050,70 @@ func (s *Service) verifyToken(token string, opt VerificationOption) (map[string]
 		"action":   opt.Action,
 		"context":  opt.Context,
 	}
-	dBytes, _ := json.Marshal(data)
-	req, _ := http.NewRequest("POST", s.TokenVerifyURL, bytes.NewBuffer(dBytes))
-	req.Header.Add("Authorization", "Bearer "+accessToken)
+	var nonce string
+	if s.UseNonce {
+		if nonce, err = newNonce(); err != nil {
+			return nil, 0, err
+		}
+		data["nonce"] = nonce
+	}
+	if opt.Tenant != "" {
+		data["tenant"] = opt.Tenant
+	}
+	if len(opt.TargetScopes) == 0 {
+		switch s.EmptyScopeBehavior {
+		case EmptyScopesOmitted:
+			delete(data, "scopes")
+		case EmptyScopesAsWildcard:
+			data["scopes"] = []string{"*"}
+		}
+	}
+	if len(s.RequestFieldNames) > 0 {
+		renamed := make(map[string]interface{}, len(data))
+		for field, value := range data {
+			if name := s.RequestFieldNames[field]; name != "" {
+				field = name
+			}
+			renamed[field] = value
+		}
+		data = renamed
+	}
+	dBytes := s.encodeVerifyBody(data)
+	req, err := s.verifyRequest(opt.RequestContext, dBytes, accessToken)
+	if err != nil {
+		return nil, 0, err
+	}
 	resp, err := client.Do(req)
+	for retry := 0; s.retriesVerify(resp, err) && retry < *opt.NumRetry; retry++ {
+		failure := fmt.Sprintf("error: %v", err)
+		if err == nil {
+			failure = fmt.Sprintf("status: %d", resp.StatusCode)
+		}
+		//Exponential backoff on the retry
+		sleep := s.backoff(retry)
+		if exceedsDeadline(opt.RequestContext, sleep) {
+			log.Warnf("Sand verify: not retrying because the context is done or the deadline would be exceeded, %s", failure)
+			break
+		}
+		log.Warnf("Sand verify: retrying after %v because of %s", sleep, failure)
+		if !sleepContext(opt.RequestContext, sleep) {
+			log.Warnf("Sand verify: not retrying because the context is done, %s", failure)
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		//The body of the previous request has been consumed, so build a new one
+		if req, err = s.verifyRequest(opt.RequestContext, dBytes, accessToken); err != nil {
+			return nil, 0, err
+		}
+		resp, err = client.Do(req)
+	}
 	if err != nil {
-		return nil, AuthenticationError{"Service failed to verify the token: " + err.Error()}
+		if isConnectionFailure(err) {
+			return nil, 0, ConnectionError{Message: "Service failed to verify the token: " + err.Error()}
+		}
+		return nil, 0, AuthenticationError{"Service failed to verify the token: " + err.Error()}
 	}
 
 	defer resp.Body.Close()
@@ -210,15 +1125,216 @@ func (s *Service) verifyToken(token string, opt VerificationOption) (map[string]
 			//When the response is 500, the token may be expired. So let the client retry
 			//and return 401 by returning nil, so that the result is not cached.
 			log.Error(str)
-			return nil, nil
+			return nil, resp.StatusCode, nil
 		}
-		return nil, AuthenticationError{Message: str}
+		if s.isProxyFailure(s.TokenVerifyURL, resp.StatusCode, body) {
+			return nil, resp.StatusCode, ConnectionError{Message: str, StatusCode: resp.StatusCode}
+		}
+		if isUnavailableStatus(resp.StatusCode) {
+			return nil, resp.StatusCode, UnavailableError{Message: str, StatusCode: resp.StatusCode}
+		}
+		return nil, resp.StatusCode, AuthenticationError{Message: str}
+	}
+	parse := s.ResponseParser
+	if parse == nil {
+		parse = decodeVerifyResponse
+	}
+	result, err := parse(body)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	if allowed, ok := result["allowed"]; ok {
+		result["allowed"] = isAllowed(allowed)
+	}
+	if s.UseNonce && result["nonce"] != nonce {
+		return nil, resp.StatusCode, AuthenticationError{fmt.Sprintf("Nonce mismatch: expected %q, got %v", nonce, result["nonce"])}
+	}
+	if anyScopes != nil && result["allowed"] == true && !grantsAnyScope(result, anyScopes) {
+		return denialResponse("none of the target scopes is granted"), resp.StatusCode, nil
+	}
+	return result, resp.StatusCode, nil
+}
+
+//isAllowed normalizes the "allowed" field of a verification response, which some
+//gateways convert from a boolean to a string or a number. Only true, "true" and 1
+//are allowed.
+func isAllowed(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(strings.TrimSpace(v), "true")
+	case json.Number:
+		return v.String() == "1"
+	case float64:
+		return v == 1
 	}
+	return false
+}
+
+//decodeVerifyResponse decodes the body of a verification response. Numbers are
+//decoded as json.Number so that large values such as "exp" keep their precision
+//instead of being rounded to a float64.
+func decodeVerifyResponse(body []byte) (map[string]interface{}, error) {
 	var result map[string]interface{}
-	err = json.Unmarshal(body, &result)
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	err := decoder.Decode(&result)
 	return result, err
 }
 
+//verifyRequest builds the token verification request with the body and the
+//VerifyHeaders and runs the BeforeVerify hook on it. The request is canceled when
+//ctx is done.
+func (s *Service) verifyRequest(ctx context.Context, body []byte, accessToken string) (*http.Request, error) {
+	req, _ := http.NewRequest("POST", s.TokenVerifyURL, bytes.NewBuffer(body))
+	req = req.WithContext(ctx)
+	if s.VerifyEncoding == VerifyAsForm {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, values := range s.VerifyHeaders {
+		req.Header[http.CanonicalHeaderKey(name)] = append([]string{}, values...)
+	}
+	req.Header.Set("Authorization", s.AuthorizationHeader(accessToken))
+	if s.BeforeVerify != nil {
+		if err := s.BeforeVerify(req); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+//encodeVerifyBody encodes the fields of the token verification request with VerifyEncoding
+func (s *Service) encodeVerifyBody(data map[string]interface{}) []byte {
+	if s.VerifyEncoding != VerifyAsForm {
+		body, _ := json.Marshal(data)
+		return body
+	}
+	form := url.Values{}
+	for field, value := range data {
+		switch v := value.(type) {
+		case nil:
+		case string:
+			form.Set(field, v)
+		case []string:
+			form[field] = v
+		case map[string]interface{}:
+			if len(v) > 0 {
+				encoded, _ := json.Marshal(v)
+				form.Set(field, string(encoded))
+			}
+		default:
+			encoded, _ := json.Marshal(v)
+			form.Set(field, string(encoded))
+		}
+	}
+	return []byte(form.Encode())
+}
+
+//accessToken returns the access token with the scopes for the service to verify
+//tokens with SAND. Empty scopes fall back to the service's Scopes. The token kept
+//by the token maintainer is used for the service's Scopes if it is running, and the
+//token of a batch is fetched once for all the verifications of the batch.
+func (s *Service) accessToken(ctx context.Context, scopes []string, numRetry int) (string, error) {
+	if len(scopes) == 0 {
+		scopes = s.Scopes
+		if token := s.maintainedToken(); token != "" {
+			return token, nil
+		}
+	}
+	if shared, ok := ctx.Value(sharedAccessTokenKey{}).(*sharedAccessToken); ok {
+		shared.once.Do(func() {
+			shared.token, shared.err = s.fetchAccessToken(ctx, scopes, numRetry)
+		})
+		return shared.token, shared.err
+	}
+	return s.fetchAccessToken(ctx, scopes, numRetry)
+}
+
+//fetchAccessToken gets the access token with the scopes for the service from the
+//cache or the OAuth2 server
+func (s *Service) fetchAccessToken(ctx context.Context, scopes []string, numRetry int) (string, error) {
+	token, err := s.accessTokenClient().OAuth2TokenWithContext(ctx, s.accessTokenCacheKey(), scopes, numRetry)
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+//accessTokenCacheKey returns the cache key of the service's own access token
+func (s *Service) accessTokenCacheKey() string {
+	id := s.AccessTokenCacheID
+	if id == "" {
+		id = s.ClientID
+	}
+	return serviceAccessTokenKey + "/" + id
+}
+
+//accessTokenClient returns the client that caches the service access token in the
+//AccessTokenCache if it is set, or in the service's cache otherwise.
+func (s *Service) accessTokenClient() *Client {
+	if s.AccessTokenCache == nil {
+		return &s.Client
+	}
+	dedicated := s.Client
+	dedicated.Cache = s.AccessTokenCache
+	return &dedicated
+}
+
+//RefreshServiceToken evicts the cached access token of the service for its Scopes
+//and gets a new one, e.g., after the service's credentials are rotated, so that the
+//following verifications use the new token. The token of the token maintainer is
+//also replaced if it is running. The tokens for other ServiceScopes stay cached.
+func (s *Service) RefreshServiceToken(ctx context.Context) error {
+	client := s.accessTokenClient()
+	if client.Cache != nil {
+		client.evictCache(client.CacheKey(s.accessTokenCacheKey(), s.Scopes, ""))
+	}
+	token, err := client.OAuth2TokenWithContext(ctx, s.accessTokenCacheKey(), s.Scopes, -1)
+	if err != nil {
+		return err
+	}
+	if s.maintainer != nil {
+		select {
+		case <-s.maintainer.done:
+			//The maintainer is stopped
+		default:
+			s.maintainer.set(token)
+		}
+	}
+	return nil
+}
+
+//validateClaims checks the issuer and audience of a verification response against
+//ExpectedIssuer and ExpectedAudience if they are set.
+func (s *Service) validateClaims(resp map[string]interface{}) error {
+	if s.ExpectedIssuer != "" && resp["iss"] != s.ExpectedIssuer {
+		return AuthenticationError{fmt.Sprintf("Token issuer mismatch: expected %q, got %v", s.ExpectedIssuer, resp["iss"])}
+	}
+	if s.ExpectedAudience != "" && !hasAudience(resp["aud"], s.ExpectedAudience) {
+		return AuthenticationError{fmt.Sprintf("Token audience mismatch: expected %q, got %v", s.ExpectedAudience, resp["aud"])}
+	}
+	return nil
+}
+
+//hasAudience checks if the "aud" field, which can be either a string or a list of
+//strings, contains the audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 //expiryTime computes the expiry time given the expiry time as a string
 //Example time returned by SAND: {"exp":"2016-09-06T08:32:59.71-07:00"}
 func (s *Service) expiryTime(expTime string) int {
@@ -229,7 +1345,23 @@ func (s *Service) expiryTime(expTime string) int {
 	if err != nil {
 		return s.DefaultExpTime
 	}
-	diff := t.Unix() - time.Now().Unix()
+	return s.secondsUntil(t.Unix())
+}
+
+//numericExpiryTime returns the number of seconds until the "exp" given as the
+//seconds since the epoch, or the DefaultExpTime if it is invalid or in the past.
+func (s *Service) numericExpiryTime(expTime json.Number) int {
+	seconds, err := expTime.Int64()
+	if err != nil {
+		return s.DefaultExpTime
+	}
+	return s.secondsUntil(seconds)
+}
+
+//secondsUntil returns the number of seconds until the unix time, or the
+//DefaultExpTime if it is in the past.
+func (s *Service) secondsUntil(unix int64) int {
+	diff := unix - time.Now().Unix()
 	if diff > 0 {
 		return int(diff)
 	}
@@ -3,13 +3,20 @@ package sand
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/coupa/sand-go/cache"
+	"golang.org/x/net/context"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -114,6 +121,22 @@ var _ = Describe("Service", func() {
 			Expect(err.Error()).To(Equal("NewService: missing required argument(s)"))
 		})
 
+		It("validates and normalizes the URLs with NewValidatedService", func() {
+			validated, err := NewValidatedService("i", "s", "https://oauth.example.com/token", "r", "https://Oauth.Example.com/warden/token/allowed", []string{"scope"})
+			Expect(err).To(BeNil())
+			Expect(validated.TokenURL).To(Equal("https://oauth.example.com/token"))
+			Expect(validated.TokenVerifyURL).To(Equal("https://oauth.example.com/warden/token/allowed"))
+
+			_, err = NewValidatedService("i", "s", "oauth.example.com/token", "r", "https://oauth.example.com/v", []string{"scope"})
+			Expect(err).To(MatchError(ValidationError{InvalidConfig, `invalid TokenURL "oauth.example.com/token": must be an absolute http(s) URL`}))
+
+			_, err = NewValidatedService("i", "s", "https://oauth.example.com/token", "r", "/v", []string{"scope"})
+			Expect(err).To(MatchError(ValidationError{InvalidConfig, `invalid TokenVerifyURL "/v": must be an absolute http(s) URL`}))
+
+			_, err = NewValidatedService("i", "s", "https://oauth.example.com/token", "", "https://oauth.example.com/v", []string{"scope"})
+			Expect(err.Error()).To(Equal("NewService: missing required argument(s)"))
+		})
+
 		It("uses the same global cache", func() {
 			c1, err := NewService("c", "s", "u", "r", "/v", []string{"scope"})
 			Expect(err).To(BeNil())
@@ -121,9 +144,54 @@ var _ = Describe("Service", func() {
 			c2, err := NewClient("a", "s", "u")
 			Expect(err).To(BeNil())
 
-			Expect(c2.Cache).To(Equal(caches[defaultExpiryTime]))
+			Expect(c2.Cache).To(Equal(caches[DefaultExpiryTime]))
 			Expect(c1.Cache).To(Equal(c2.Cache))
 		})
+
+		It("uses the default expiry times", func() {
+			s, err := NewService("c", "s", "u", "r", "/v", []string{"scope"})
+			Expect(err).To(BeNil())
+			Expect(s.DefaultExpTime).To(Equal(DefaultServiceExpTime))
+			Expect(s.Cache).To(BeIdenticalTo(caches[DefaultExpiryTime]))
+			Expect(DefaultExpiryTime).To(Equal(3598 * time.Second))
+			Expect(DefaultServiceExpTime).To(Equal(3600))
+		})
+	})
+
+	Describe("#NewServiceFromClient", func() {
+		It("gives error when missing required arguments", func() {
+			client, _ := NewClient("i", "s", "u")
+			_, err := NewServiceFromClient(nil, "r", "/v", []string{"scope"})
+			Expect(err.Error()).To(Equal("NewServiceFromClient: missing required argument(s)"))
+			_, err = NewServiceFromClient(client, "", "/v", []string{"scope"})
+			Expect(err.Error()).To(Equal("NewServiceFromClient: missing required argument(s)"))
+		})
+
+		It("uses the same cache and configuration as the client", func() {
+			client, _ := NewClientWithCache("i", "s", "u", cache.NewGoCache(time.Minute, time.Minute))
+			client.CacheRoot = "root"
+			client.Transport = &recordingTransport{base: http.DefaultTransport}
+			s, err := NewServiceFromClient(client, "r", "/v", []string{"scope"})
+			Expect(err).To(BeNil())
+			Expect(s.Cache).To(BeIdenticalTo(client.Cache))
+			Expect(s.Transport).To(BeIdenticalTo(client.Transport))
+			Expect(s.ClientID).To(Equal("i"))
+			Expect(s.CacheRoot).To(Equal("root"))
+			Expect(s.cacheType).To(Equal("tokens"))
+			Expect(client.cacheType).To(Equal("resources"))
+		})
+
+		It("leaves the client's cache running when the service is closed", func() {
+			goCache := cache.NewGoCache(time.Minute, 10*time.Millisecond)
+			client, _ := NewClientWithCache("i", "s", "u", goCache)
+			defer client.Close()
+			s, err := NewServiceFromClient(client, "r", "/v", []string{"scope"})
+			Expect(err).To(BeNil())
+			Expect(s.Close()).To(Succeed())
+
+			goCache.Write("expiring", "item", time.Millisecond)
+			Eventually(goCache.ItemCount, time.Second).Should(Equal(0))
+		})
 	})
 
 	Describe("Token tests", func() {
@@ -193,6 +261,252 @@ var _ = Describe("Service", func() {
 			})
 		})
 
+		Describe("#CheckRequestTyped", func() {
+			var response string
+			var r *http.Request
+			BeforeEach(func() {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						fmt.Fprintf(w, response)
+					}
+				}
+				r, _ = http.NewRequest("GET", "/", nil)
+				r.Header.Set("Authorization", "Bearer abc")
+			})
+
+			It("returns the fields of an allowed response", func() {
+				exp := time.Now().Add(time.Hour).Truncate(time.Second)
+				response = fmt.Sprintf(`{"allowed":true,"sub":"client","scopes":["a","b"],"exp":%q,"iss":"sand"}`, exp.Format(iso8601))
+				result, err := service.CheckRequestTyped(r, []string{"a"}, "read")
+				Expect(err).To(BeNil())
+				Expect(result.Allowed).To(BeTrue())
+				Expect(result.Subject).To(Equal("client"))
+				Expect(result.Scopes).To(Equal([]string{"a", "b"}))
+				Expect(result.Expiry.Equal(exp)).To(BeTrue())
+				Expect(result.Reason).To(BeEmpty())
+				Expect(result.Response["iss"]).To(Equal("sand"))
+			})
+
+			It("returns a denied response", func() {
+				response = `{"allowed":false,"reason":"revoked"}`
+				result, err := service.CheckRequestTyped(r, []string{"a"}, "read")
+				Expect(err).To(BeNil())
+				Expect(result.Allowed).To(BeFalse())
+				Expect(result.Subject).To(BeEmpty())
+				Expect(result.Scopes).To(BeEmpty())
+				Expect(result.Expiry.IsZero()).To(BeTrue())
+				Expect(result.Reason).To(Equal("revoked"))
+			})
+
+			It("returns a denied result with the error", func() {
+				service.TokenVerifyURL = ""
+				result, err := service.CheckRequestTyped(r, []string{"a"}, "read")
+				Expect(err).To(HaveOccurred())
+				Expect(result.Allowed).To(BeFalse())
+			})
+		})
+
+		Describe("#VerifyRequest", func() {
+			Context("with the token in the access_token form field", func() {
+				It("verifies the token", func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						if r.RequestURI == "/" {
+							fmt.Fprintf(w, `{"access_token":"def"}`)
+						} else if r.RequestURI == "/v" {
+							var body map[string]interface{}
+							json.NewDecoder(r.Body).Decode(&body)
+							Expect(body["token"]).To(Equal("abc"))
+							fmt.Fprintf(w, `{"allowed":true}`)
+						}
+					}
+					r, _ := http.NewRequest("POST", "/", strings.NewReader("access_token=abc"))
+					r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+					t, err := service.VerifyRequest(r, VerificationOption{TargetScopes: []string{"scope"}})
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(true))
+				})
+			})
+
+			Context("with StrictAuthorizationHeader", func() {
+				var r *http.Request
+				BeforeEach(func() {
+					service.StrictAuthorizationHeader = true
+					r, _ = http.NewRequest("GET", "/", nil)
+				})
+
+				It("verifies a single Authorization header", func() {
+					r.Header.Set("Authorization", "Bearer abc")
+					t, err := service.VerifyRequest(r, VerificationOption{TargetScopes: []string{"scope"}})
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(true))
+				})
+
+				It("rejects identical Authorization headers", func() {
+					r.Header.Add("Authorization", "Bearer abc")
+					r.Header.Add("Authorization", "Bearer abc")
+					t, err := service.VerifyRequest(r, VerificationOption{TargetScopes: []string{"scope"}})
+					Expect(err).To(MatchError(InvalidRequestError{"The request has 2 Authorization headers"}))
+					Expect(t).To(Equal(notAllowedResponse))
+					Expect(service.ErrorCode(err)).To(Equal(http.StatusBadRequest))
+				})
+
+				It("rejects different Authorization headers", func() {
+					r.Header.Add("Authorization", "Bearer injected")
+					r.Header.Add("Authorization", "Bearer abc")
+					t, err := service.VerifyRequest(r, VerificationOption{TargetScopes: []string{"scope"}})
+					Expect(err).To(MatchError(InvalidRequestError{"The request has 2 Authorization headers"}))
+					Expect(t).To(Equal(notAllowedResponse))
+
+					ok, _, err := service.Authorized(r, []string{"scope"}, "")
+					Expect(ok).To(BeFalse())
+					Expect(err).To(HaveOccurred())
+				})
+
+				It("uses the first Authorization header by default", func() {
+					service.StrictAuthorizationHeader = false
+					r.Header.Add("Authorization", "Bearer abc")
+					r.Header.Add("Authorization", "Bearer other")
+					t, err := service.VerifyRequest(r, VerificationOption{TargetScopes: []string{"scope"}})
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(true))
+				})
+			})
+
+			Context("with a TokenExtractor", func() {
+				It("verifies the token extracted by it", func() {
+					service.TokenExtractor = func(r *http.Request) string {
+						return r.Header.Get("X-Token")
+					}
+					r, _ := http.NewRequest("GET", "/", nil)
+					r.Header.Set("X-Token", "abc")
+					t, err := service.VerifyRequest(r, VerificationOption{TargetScopes: []string{"scope"}})
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(true))
+
+					r.Header.Del("X-Token")
+					r.Header.Set("Authorization", "Bearer abc")
+					t, err = service.VerifyRequest(r, VerificationOption{TargetScopes: []string{"scope"}})
+					Expect(err).To(BeNil())
+					Expect(t).To(Equal(notAllowedResponse))
+				})
+			})
+
+			Context("with a ResourceResolver", func() {
+				var resources []string
+				BeforeEach(func() {
+					resources = nil
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						if r.RequestURI == "/" {
+							fmt.Fprintf(w, `{"access_token":"def"}`)
+						} else if r.RequestURI == "/v" {
+							var body map[string]interface{}
+							json.NewDecoder(r.Body).Decode(&body)
+							resources = append(resources, body["resource"].(string))
+							fmt.Fprintf(w, `{"allowed":true}`)
+						}
+					}
+					service.ResourceResolver = func(r *http.Request) string {
+						switch {
+						case strings.HasPrefix(r.URL.Path, "/orders/"):
+							return "order"
+						case strings.HasPrefix(r.URL.Path, "/invoices/"):
+							return "invoice"
+						}
+						return ""
+					}
+				})
+
+				It("verifies the token for the resource of the request path", func() {
+					for _, path := range []string{"/orders/1", "/invoices/2", "/other"} {
+						r, _ := http.NewRequest("GET", path, nil)
+						r.Header.Set("Authorization", "Bearer abc")
+						t, err := service.VerifyRequest(r, VerificationOption{TargetScopes: []string{"scope"}})
+						Expect(err).To(BeNil())
+						Expect(t["allowed"]).To(Equal(true))
+					}
+					Expect(resources).To(Equal([]string{"order", "invoice", "r"}))
+				})
+
+				It("derives the resource for CheckRequest and Authorized", func() {
+					r, _ := http.NewRequest("GET", "/orders/1", nil)
+					r.Header.Set("Authorization", "Bearer abc")
+					_, err := service.CheckRequest(r, []string{"scope"}, "read")
+					Expect(err).To(BeNil())
+					ok, _, err := service.Authorized(r, []string{"scope"}, "write")
+					Expect(err).To(BeNil())
+					Expect(ok).To(BeTrue())
+					Expect(resources).To(Equal([]string{"order", "order"}))
+				})
+
+				It("uses the Resource of the option instead", func() {
+					r, _ := http.NewRequest("GET", "/orders/1", nil)
+					r.Header.Set("Authorization", "Bearer abc")
+					_, err := service.VerifyRequest(r, VerificationOption{TargetScopes: []string{"scope"}, Resource: "explicit"})
+					Expect(err).To(BeNil())
+					Expect(resources).To(Equal([]string{"explicit"}))
+				})
+			})
+		})
+
+		Describe("#Authorized", func() {
+			var response string
+			var request *http.Request
+			BeforeEach(func() {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						fmt.Fprintf(w, response)
+					}
+				}
+				request, _ = http.NewRequest("GET", "/", nil)
+				request.Header.Set("Authorization", "Bearer abc")
+			})
+
+			It("authorizes an allowed token with the required scopes", func() {
+				response = `{"allowed":true,"scopes":["s1","s2"]}`
+				ok, result, err := service.Authorized(request, []string{"s1", "s2"}, "read")
+				Expect(err).To(BeNil())
+				Expect(ok).To(BeTrue())
+				Expect(result.Allowed).To(BeTrue())
+				Expect(result.Scopes).To(Equal([]string{"s1", "s2"}))
+			})
+
+			It("authorizes an allowed token without scopes in the response", func() {
+				response = `{"allowed":true}`
+				ok, _, err := service.Authorized(request, []string{"s1"}, "read")
+				Expect(err).To(BeNil())
+				Expect(ok).To(BeTrue())
+			})
+
+			It("does not authorize an allowed token missing a required scope", func() {
+				response = `{"allowed":true,"scopes":["s1"]}`
+				ok, result, err := service.Authorized(request, []string{"s1", "s2"}, "read")
+				Expect(err).To(BeNil())
+				Expect(ok).To(BeFalse())
+				Expect(result.Allowed).To(BeTrue())
+			})
+
+			It("does not authorize a denied token", func() {
+				response = `{"allowed":false,"reason":"revoked"}`
+				ok, result, err := service.Authorized(request, []string{"s1"}, "read")
+				Expect(err).To(BeNil())
+				Expect(ok).To(BeFalse())
+				Expect(result.Allowed).To(BeFalse())
+				Expect(result.Reason).To(Equal("revoked"))
+			})
+
+			It("returns the verification error", func() {
+				service.TokenVerifyURL = ""
+				ok, result, err := service.Authorized(request, []string{"s1"}, "read")
+				Expect(err).NotTo(BeNil())
+				Expect(ok).To(BeFalse())
+				Expect(result.Allowed).To(BeFalse())
+			})
+		})
+
 		Describe("#CheckRequestWithCustomRetry", func() {
 			Context("with service unable to retrieve an access token", func() {
 				It("performs retry and returns an error of type sand.AuthenticationError", func() {
@@ -238,160 +552,2088 @@ var _ = Describe("Service", func() {
 			})
 		})
 
-		Describe("#verifyToken", func() {
-			minusOne := -1
-			Context("with empty token", func() {
-				It("returns nil", func() {
-					t, err := service.verifyToken("", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
-					Expect(t).To(BeNil())
-					Expect(err).To(BeNil())
-				})
+		Describe("#VerifyTokenWithCache with a CacheKey", func() {
+			var verified []string
+			BeforeEach(func() {
+				verified = nil
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						var body map[string]interface{}
+						json.NewDecoder(r.Body).Decode(&body)
+						verified = append(verified, body["token"].(string))
+						fmt.Fprintf(w, `{"allowed":true}`)
+					}
+				}
 			})
 
-			Context("with an error response", func() {
-				It("returns an error", func() {
-					handler = func(w http.ResponseWriter, r *http.Request) {
-						w.WriteHeader(http.StatusNotFound)
-					}
-					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
-					Expect(t).To(BeNil())
-					_, yes := err.(AuthenticationError)
-					Expect(yes).To(BeTrue())
-				})
+			It("shares the cached result between the tokens with the same key", func() {
+				t, err := service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"scope"}, CacheKey: "session"})
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(true))
+
+				t, err = service.VerifyTokenWithCache("xyz", VerificationOption{TargetScopes: []string{"scope"}, CacheKey: "session"})
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(true))
+				Expect(verified).To(Equal([]string{"abc"}))
 			})
 
-			Context("with a valid token and valid response", func() {
-				It("returns allowed response", func() {
-					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
-					Expect(err).To(BeNil())
-					Expect(t).To(Equal(map[string]interface{}{"allowed": true}))
-				})
+			It("caches the results for different keys and scopes separately", func() {
+				service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"scope"}, CacheKey: "session"})
+				service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"scope"}, CacheKey: "other"})
+				service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"scope2"}, CacheKey: "session"})
+				service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"scope"}})
+				Expect(verified).To(Equal([]string{"abc", "abc", "abc", "abc"}))
 			})
+		})
 
-			Context("with 500 response when verifying a token", func() {
-				It("returns nil", func() {
-					handler = func(w http.ResponseWriter, r *http.Request) {
-						var resp map[string]interface{}
-						if r.RequestURI == "/" {
-							resp = map[string]interface{}{"access_token": "def"}
-							exp, _ := json.Marshal(resp)
-							fmt.Fprintf(w, string(exp))
-						} else if r.RequestURI == "/v" {
-							w.WriteHeader(http.StatusInternalServerError)
-						}
-					}
-					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
-					Expect(err).To(BeNil())
-					Expect(t).To(BeNil())
-				})
+		Describe("#verificationCacheKey", func() {
+			It("is returned by VerificationCacheKey with the defaults of the service", func() {
+				service.Context = map[string]interface{}{"region": "us"}
+				opt := VerificationOption{TargetScopes: []string{"scope"}, Action: "read"}
+				t, err := service.VerifyTokenWithCache("abc", opt)
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(true))
+
+				key := service.VerificationCacheKey("abc", opt)
+				Expect(key).To(Equal(service.verificationCacheKey("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "read", Resource: "r", Context: service.Context})))
+				Expect(key).To(HavePrefix(service.CacheRoot + "/tokens/" + SHA256Hex("abc") + "/scope/r/action:read/context:"))
+				Expect(service.Cache.Read(key)).To(HaveKeyWithValue("allowed", true))
 			})
 
-			Context("with an invalid json response when verifying token", func() {
-				It("returns an error", func() {
-					handler = func(w http.ResponseWriter, r *http.Request) {
-						var resp map[string]interface{}
-						if r.RequestURI == "/" {
-							resp = map[string]interface{}{"access_token": "def"}
-							exp, _ := json.Marshal(resp)
-							fmt.Fprintf(w, string(exp))
-						} else if r.RequestURI == "/v" {
-							Expect(r.Header.Get("Authorization")).To(Equal("Bearer def"))
-							fmt.Fprintf(w, "bad")
-						}
-					}
-					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
-					Expect(err).NotTo(BeNil())
-					Expect(t).To(BeNil())
-				})
+			It("builds the same key for equal contexts in any order", func() {
+				ctx1 := map[string]interface{}{"a": 1, "b": "x", "c": map[string]interface{}{"d": true, "e": []interface{}{1, 2}}}
+				ctx2 := map[string]interface{}{"c": map[string]interface{}{"e": []interface{}{1, 2}, "d": true}, "b": "x", "a": 1}
+				for i := 0; i < 20; i++ {
+					Expect(service.verificationCacheKey("abc", VerificationOption{Context: ctx1})).
+						To(Equal(service.verificationCacheKey("abc", VerificationOption{Context: ctx2})))
+				}
 			})
 
-			Context("with a proxy blocking the request", func() {
-				It("returns an error getting token", func() {
-					service.TokenURL = "http://sand.test"
-					service.TokenVerifyURL = service.TokenURL + "/v"
-					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
-					Expect(t).To(BeNil())
-					Expect(err).To(MatchError(AuthenticationError{Message: "oauth2: cannot fetch token: 403 Forbidden\nResponse: "}))
-				})
+			It("builds different keys for different actions and contexts", func() {
+				keys := map[string]bool{}
+				for _, opt := range []VerificationOption{
+					{},
+					{Action: "read"},
+					{Action: "write"},
+					{Context: map[string]interface{}{"a": 1}},
+					{Context: map[string]interface{}{"a": 2}},
+					{Action: "read", Context: map[string]interface{}{"a": 1}},
+				} {
+					keys[service.verificationCacheKey("abc", opt)] = true
+				}
+				Expect(keys).To(HaveLen(6))
+				Expect(service.verificationCacheKey("abc", VerificationOption{Context: map[string]interface{}{}})).
+					To(Equal(service.verificationCacheKey("abc", VerificationOption{})))
+			})
 
-				It("returns an error verifying token", func() {
-					service.TokenVerifyURL = "http://sand.test/v"
-					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
-					Expect(t).To(BeNil())
-					Expect(err).To(MatchError(AuthenticationError{Message: "Error response from the authentication service: 403 - "}))
-				})
+			It("caches the results for different actions separately", func() {
+				verifications := 0
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						verifications++
+						fmt.Fprintf(w, `{"allowed":true}`)
+					}
+				}
+				for _, action := range []string{"read", "write", "read"} {
+					_, err := service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: action})
+					Expect(err).To(BeNil())
+				}
+				Expect(verifications).To(Equal(2))
 			})
+		})
 
-			Context("with a TLS server whose version is too old", func() {
-				var (
-					ss *httptest.Server
-				)
-				BeforeEach(func() {
-					ss = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-						w.Header().Set("Content-Type", "application/json")
-						handler(w, r)
-					}))
-					ss.TLS = &tls.Config{
-						MaxVersion: tls.VersionTLS11,
+		Describe("#VerifyTokenWithCache with a Tenant", func() {
+			var tenants []interface{}
+			BeforeEach(func() {
+				tenants = nil
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						var body map[string]interface{}
+						json.NewDecoder(r.Body).Decode(&body)
+						tenants = append(tenants, body["tenant"])
+						fmt.Fprintf(w, `{"allowed":%t}`, body["tenant"] == "a")
 					}
-					ss.StartTLS()
-				})
-				AfterEach(func() {
-					ss.Close()
-				})
+				}
+			})
 
-				It("returns an error getting token", func() {
-					service.TokenURL = ss.URL
-					service.TokenVerifyURL = service.TokenURL + "/v"
-					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
-					Expect(t).To(BeNil())
-					Expect(err).To(MatchError(AuthenticationError{
-						Message: fmt.Sprintf("Post \"%s\": remote error: tls: protocol version not supported", service.TokenURL),
-					}))
-				})
+			It("verifies the token in every tenant and caches the results separately", func() {
+				for i := 0; i < 2; i++ {
+					t, err := service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"scope"}, Tenant: "a"})
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(true))
 
-				It("returns an error verifying token", func() {
-					service.TokenVerifyURL = ss.URL + "/v"
-					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
-					Expect(t).To(BeNil())
-					Expect(err).To(MatchError(AuthenticationError{
-						Message: fmt.Sprintf("Service failed to verify the token: Post \"%s\": remote error: tls: protocol version not supported", service.TokenVerifyURL),
-					}))
-				})
+					t, err = service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"scope"}, Tenant: "b"})
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(false))
+				}
+				Expect(tenants).To(Equal([]interface{}{"a", "b"}))
+
+				keyA := service.verificationCacheKey("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "r", Tenant: "a"})
+				keyB := service.verificationCacheKey("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "r", Tenant: "b"})
+				Expect(keyA).NotTo(Equal(keyB))
+				Expect(service.Cache.Read(keyA)).To(HaveKeyWithValue("allowed", true))
+				Expect(service.Cache.Read(keyB)).To(HaveKeyWithValue("allowed", false))
 			})
-		})
-	})
 
-	Describe("#expiryTime", func() {
-		Context("with future expiration time", func() {
-			It("returns the time difference", func() {
-				futureTime := time.Now().Add(time.Duration(100) * time.Second)
-				t := futureTime.Format("2006-01-02T15:04:05.00-07:00")
-				Expect(service.expiryTime(t)).To(BeNumerically("<=", 100))
+			It("sends no tenant without a Tenant", func() {
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"scope"}})
+				Expect(err).To(BeNil())
+				Expect(tenants).To(Equal([]interface{}{nil}))
+				Expect(service.verificationCacheKey("abc", VerificationOption{Resource: "r"})).NotTo(ContainSubstring("tenant"))
 			})
 		})
 
-		Context("with past expiration time", func() {
-			It("returns the default expiry time", func() {
-				theTime := time.Now()
-				t := theTime.Format("2006-01-02T15:04:05.00-07:00")
-				Expect(service.expiryTime(t)).To(Equal(service.DefaultExpTime))
+		Describe("#VerifyTokenWithCache with ServiceScopes", func() {
+			var tokenScopes []string
+			var authorizations []string
+			BeforeEach(func() {
+				tokenScopes, authorizations = nil, nil
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						r.ParseForm()
+						scope := r.PostForm.Get("scope")
+						tokenScopes = append(tokenScopes, scope)
+						fmt.Fprintf(w, `{"access_token":"token-%s","expires_in":3600}`, scope)
+					} else if r.RequestURI == "/v" {
+						authorizations = append(authorizations, r.Header.Get("Authorization"))
+						fmt.Fprintf(w, `{"allowed":true}`)
+					}
+				}
+			})
 
-				theTime = time.Now().Add(time.Duration(-100) * time.Second)
-				t = theTime.Format("2006-01-02T15:04:05.00-07:00")
-				Expect(service.expiryTime(t)).To(Equal(service.DefaultExpTime))
+			It("gets the service access token with the service's Scopes by default", func() {
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(tokenScopes).To(Equal([]string{"scope"}))
+				Expect(authorizations).To(Equal([]string{"Bearer token-scope"}))
 			})
-		})
 
-		Context("with invalid time string", func() {
-			It("returns the default expiry time", func() {
-				Expect(service.expiryTime("a")).To(Equal(service.DefaultExpTime))
+			It("gets and caches the service access token with the ServiceScopes", func() {
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{ServiceScopes: []string{"narrow"}})
+				Expect(err).To(BeNil())
+				_, err = service.VerifyTokenWithCache("def", VerificationOption{})
+				Expect(err).To(BeNil())
+				_, err = service.VerifyTokenWithCache("ghi", VerificationOption{ServiceScopes: []string{"narrow"}})
+				Expect(err).To(BeNil())
+				Expect(tokenScopes).To(Equal([]string{"narrow", "scope"}))
+				Expect(authorizations).To(Equal([]string{"Bearer token-narrow", "Bearer token-scope", "Bearer token-narrow"}))
 			})
 		})
-	})
 
-	Describe("#buildOption", func() {
-		BeforeEach(func() {
+		Describe("#RefreshServiceToken", func() {
+			var tokenRequests int
+			var authorizations []string
+			BeforeEach(func() {
+				tokenRequests, authorizations = 0, nil
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						tokenRequests++
+						fmt.Fprintf(w, `{"access_token":"service-%d","expires_in":3600}`, tokenRequests)
+					} else if r.RequestURI == "/v" {
+						authorizations = append(authorizations, r.Header.Get("Authorization"))
+						fmt.Fprintf(w, `{"allowed":true}`)
+					}
+				}
+			})
+
+			It("makes the next verification use the new service access token", func() {
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				_, err = service.VerifyTokenWithCache("def", VerificationOption{})
+				Expect(err).To(BeNil())
+
+				Expect(service.RefreshServiceToken(context.Background())).To(Succeed())
+				_, err = service.VerifyTokenWithCache("ghi", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(tokenRequests).To(Equal(2))
+				Expect(authorizations).To(Equal([]string{"Bearer service-1", "Bearer service-1", "Bearer service-2"}))
+			})
+
+			It("refreshes the service access token in the AccessTokenCache", func() {
+				service.AccessTokenCache = cache.NewGoCache(time.Hour, time.Hour)
+				defer service.Close()
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(service.RefreshServiceToken(context.Background())).To(Succeed())
+				_, err = service.VerifyTokenWithCache("def", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(authorizations).To(Equal([]string{"Bearer service-1", "Bearer service-2"}))
+			})
+
+			It("refreshes the service access token cached for the SupersetScopes", func() {
+				service.SupersetScopes = []string{"scope", "other"}
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(service.RefreshServiceToken(context.Background())).To(Succeed())
+				_, err = service.VerifyTokenWithCache("def", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(tokenRequests).To(Equal(2))
+				Expect(authorizations).To(Equal([]string{"Bearer service-1", "Bearer service-2"}))
+			})
+
+			It("replaces the token of the running token maintainer", func() {
+				Expect(service.StartTokenMaintainer(time.Minute)).To(Succeed())
+				defer service.StopTokenMaintainer()
+				Expect(service.RefreshServiceToken(context.Background())).To(Succeed())
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(authorizations).To(Equal([]string{"Bearer service-2"}))
+			})
+
+			It("returns the error getting the new token", func() {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+				_, yes := service.RefreshServiceToken(context.Background()).(AuthenticationError)
+				Expect(yes).To(BeTrue())
+			})
+		})
+
+		Describe("#VerifyTokenWithCache with SkipCache", func() {
+			var verifications int
+			var allowed bool
+			BeforeEach(func() {
+				verifications = 0
+				allowed = true
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						verifications++
+						fmt.Fprintf(w, `{"allowed":%v}`, allowed)
+					}
+				}
+			})
+
+			It("verifies the token with SAND even if an allow is cached", func() {
+				t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(true))
+
+				allowed = false
+				t, err = service.VerifyTokenWithCache("abc", VerificationOption{SkipCache: true})
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(false))
+				Expect(verifications).To(Equal(2))
+			})
+
+			It("replaces the cached result with the fresh one", func() {
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				allowed = false
+				_, err = service.VerifyTokenWithCache("abc", VerificationOption{SkipCache: true})
+				Expect(err).To(BeNil())
+
+				result, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.Cached).To(BeTrue())
+				Expect(result.Allowed()).To(BeFalse())
+				Expect(verifications).To(Equal(2))
+			})
+		})
+
+		Describe("#VerifyTokenWithCache with MatchAnyScope", func() {
+			var sentScopes []interface{}
+			var response string
+			BeforeEach(func() {
+				sentScopes = nil
+				response = `{"allowed":true,"scope":"read write"}`
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						var body map[string]interface{}
+						json.NewDecoder(r.Body).Decode(&body)
+						sentScopes, _ = body["scopes"].([]interface{})
+						fmt.Fprintf(w, response)
+					}
+				}
+			})
+
+			It("allows a token with any of the target scopes", func() {
+				opt := VerificationOption{TargetScopes: []string{"admin", "write"}, ScopeMatch: MatchAnyScope}
+				t, err := service.VerifyTokenWithCache("abc", opt)
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(true))
+				Expect(sentScopes).To(BeEmpty())
+
+				response = `{"allowed":true,"scopes":["admin"]}`
+				t, err = service.VerifyTokenWithCache("def", opt)
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(true))
+			})
+
+			It("denies a token with none of the target scopes", func() {
+				opt := VerificationOption{TargetScopes: []string{"admin", "delete"}, ScopeMatch: MatchAnyScope}
+				result, err := service.VerifyTokenWithResult("abc", opt)
+				Expect(err).To(BeNil())
+				Expect(result.Allowed()).To(BeFalse())
+				Expect(result.Reason).To(Equal("none of the target scopes is granted"))
+
+				response = `{"allowed":true}`
+				result, err = service.VerifyTokenWithResult("def", opt)
+				Expect(err).To(BeNil())
+				Expect(result.Allowed()).To(BeFalse())
+			})
+
+			It("caches the result separately from matching all the scopes", func() {
+				opt := VerificationOption{TargetScopes: []string{"admin", "write"}, ScopeMatch: MatchAnyScope}
+				t, err := service.VerifyTokenWithCache("abc", opt)
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(true))
+
+				response = `{"allowed":false}`
+				opt.ScopeMatch = MatchAllScopes
+				t, err = service.VerifyTokenWithCache("abc", opt)
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(false))
+				Expect(sentScopes).To(Equal([]interface{}{"admin", "write"}))
+			})
+
+			It("lets SAND check a single target scope", func() {
+				opt := VerificationOption{TargetScopes: []string{"admin"}, ScopeMatch: MatchAnyScope}
+				t, err := service.VerifyTokenWithCache("abc", opt)
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(true))
+				Expect(sentScopes).To(Equal([]interface{}{"admin"}))
+			})
+		})
+
+		Describe("#VerifyTokenWithCache with MaxStaleness", func() {
+			var verifications int
+			var allowed bool
+			BeforeEach(func() {
+				verifications = 0
+				allowed = true
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						verifications++
+						fmt.Fprintf(w, `{"allowed":%v}`, allowed)
+					}
+				}
+			})
+
+			It("returns a cached result within the threshold", func() {
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+
+				allowed = false
+				result, err := service.VerifyTokenWithResult("abc", VerificationOption{MaxStaleness: time.Minute})
+				Expect(err).To(BeNil())
+				Expect(result.Cached).To(BeTrue())
+				Expect(result.Allowed()).To(BeTrue())
+				Expect(verifications).To(Equal(1))
+			})
+
+			It("verifies the token with SAND again beyond the threshold", func() {
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+
+				time.Sleep(20 * time.Millisecond)
+				allowed = false
+				result, err := service.VerifyTokenWithResult("abc", VerificationOption{MaxStaleness: 10 * time.Millisecond})
+				Expect(err).To(BeNil())
+				Expect(result.Cached).To(BeFalse())
+				Expect(result.Allowed()).To(BeFalse())
+				Expect(verifications).To(Equal(2))
+
+				//The fresh result replaces the stale one
+				result, err = service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.Cached).To(BeTrue())
+				Expect(result.Allowed()).To(BeFalse())
+				Expect(verifications).To(Equal(2))
+			})
+
+			It("verifies the token with SAND again if the cache doesn't know the age", func() {
+				service.Cache = cache.NewSyncMapCache()
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+
+				result, err := service.VerifyTokenWithResult("abc", VerificationOption{MaxStaleness: time.Minute})
+				Expect(err).To(BeNil())
+				Expect(result.Cached).To(BeFalse())
+				Expect(verifications).To(Equal(2))
+
+				result, err = service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.Cached).To(BeTrue())
+				Expect(verifications).To(Equal(2))
+			})
+		})
+
+		Describe("#VerifyTokenWithCache with TrustedTokens", func() {
+			var verifications int
+			BeforeEach(func() {
+				verifications = 0
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						verifications++
+						fmt.Fprintf(w, `{"allowed":false}`)
+					}
+				}
+				service.TrustedTokens = map[string]map[string]interface{}{
+					"trusted": {"sub": "internal-service"},
+				}
+			})
+
+			It("allows a trusted token without calling SAND", func() {
+				t, err := service.VerifyTokenWithCache("trusted", VerificationOption{TargetScopes: []string{"scope"}, Action: "write"})
+				Expect(err).To(BeNil())
+				Expect(t).To(Equal(map[string]interface{}{"allowed": true, "sub": "internal-service"}))
+				Expect(verifications).To(Equal(0))
+				Expect(service.TrustedTokens["trusted"]).NotTo(HaveKey("allowed"))
+			})
+
+			It("verifies other tokens with SAND", func() {
+				t, err := service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"scope"}})
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(false))
+				Expect(verifications).To(Equal(1))
+			})
+		})
+
+		Describe("#VerifyTokenWithCache with an AccessTokenCache", func() {
+			var tokenRequests int
+			BeforeEach(func() {
+				tokenRequests = 0
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						tokenRequests++
+						fmt.Fprintf(w, `{"access_token":"def","expires_in":3600}`)
+					} else if r.RequestURI == "/v" {
+						fmt.Fprintf(w, `{"allowed":true}`)
+					}
+				}
+				service.Cache = &boundedCache{Cache: cache.NewGoCache(time.Hour, time.Hour), size: 10}
+			})
+
+			It("keeps the service access token through heavy writes to the cache", func() {
+				service.AccessTokenCache = cache.NewGoCache(time.Hour, time.Hour)
+				defer service.Close()
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				for i := 0; i < 100; i++ {
+					service.Cache.Write(fmt.Sprintf("unrelated-%d", i), i, time.Hour)
+				}
+				_, err = service.VerifyTokenWithCache("def", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(tokenRequests).To(Equal(1))
+			})
+
+			It("loses the service access token to the churn of a shared cache", func() {
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				for i := 0; i < 100; i++ {
+					service.Cache.Write(fmt.Sprintf("unrelated-%d", i), i, time.Hour)
+				}
+				_, err = service.VerifyTokenWithCache("def", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(tokenRequests).To(Equal(2))
+			})
+		})
+
+		Describe("#VerifyTokenWithCache with services sharing a cache", func() {
+			var other *Service
+			var authorizations []string
+			BeforeEach(func() {
+				authorizations = nil
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						id, _, ok := r.BasicAuth()
+						if !ok {
+							id = r.FormValue("client_id")
+						}
+						fmt.Fprintf(w, `{"access_token":"token-%s","expires_in":3600}`, id)
+					} else if r.RequestURI == "/v" {
+						authorizations = append(authorizations, r.Header.Get("Authorization"))
+						fmt.Fprintf(w, `{"allowed":true}`)
+					}
+				}
+				service.Cache = cache.NewGoCache(time.Hour, 0)
+				other, _ = NewService("other", "s", ts.URL, "r", ts.URL+"/v", service.Scopes)
+				other.Cache = service.Cache
+			})
+
+			It("keeps the access tokens of services with different client IDs apart", func() {
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				_, err = other.VerifyTokenWithCache("def", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(authorizations).To(Equal([]string{"Bearer token-i", "Bearer token-other"}))
+			})
+
+			It("shares the access token of services with the same AccessTokenCacheID", func() {
+				service.AccessTokenCacheID = "shared"
+				other.AccessTokenCacheID = "shared"
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				_, err = other.VerifyTokenWithCache("def", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(authorizations).To(Equal([]string{"Bearer token-i", "Bearer token-i"}))
+			})
+		})
+
+		Describe("#VerifyTokenWithCache with reordered Scopes", func() {
+			var tokenRequests int
+			BeforeEach(func() {
+				tokenRequests = 0
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						tokenRequests++
+						fmt.Fprintf(w, `{"access_token":"def","expires_in":3600}`)
+					} else if r.RequestURI == "/v" {
+						fmt.Fprintf(w, `{"allowed":true}`)
+					}
+				}
+				service.Scopes = []string{"verify", "introspect"}
+			})
+
+			It("reuses the cached service access token", func() {
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				service.Scopes = []string{"introspect", "verify"}
+				_, err = service.VerifyTokenWithCache("def", VerificationOption{})
+				Expect(err).To(BeNil())
+				_, err = service.VerifyTokenWithCache("ghi", VerificationOption{ServiceScopes: []string{"verify", "introspect"}})
+				Expect(err).To(BeNil())
+				Expect(tokenRequests).To(Equal(1))
+			})
+
+			It("refreshes the cached service access token", func() {
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				service.Scopes = []string{"introspect", "verify"}
+				Expect(service.RefreshServiceToken(context.Background())).To(Succeed())
+				_, err = service.VerifyTokenWithCache("def", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(tokenRequests).To(Equal(2))
+			})
+		})
+
+		Describe("#VerifyTokenWithCache with a non-boolean allowed field", func() {
+			var allowed string
+			BeforeEach(func() {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						fmt.Fprintf(w, `{"allowed":%s}`, allowed)
+					}
+				}
+			})
+
+			It("allows the token with a true value", func() {
+				for i, value := range []string{`true`, `"true"`, `"TRUE"`, `1`} {
+					allowed = value
+					t, err := service.VerifyTokenWithCache(fmt.Sprintf("abc%d", i), VerificationOption{})
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(true), value)
+				}
+			})
+
+			It("denies the token with a false or unexpected value", func() {
+				for i, value := range []string{`false`, `"false"`, `0`, `"yes"`, `2`, `null`} {
+					allowed = value
+					t, err := service.VerifyTokenWithCache(fmt.Sprintf("abc%d", i), VerificationOption{})
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(false), value)
+				}
+			})
+		})
+
+		Describe("#VerifyTokenWithCache with DenialDetails", func() {
+			var verifications int
+			BeforeEach(func() {
+				verifications = 0
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						verifications++
+						fmt.Fprintf(w, `{"allowed":false,"reason":"missing scope","required_scopes":["write"]}`)
+					}
+				}
+			})
+
+			It("returns the full denial response of SAND every time", func() {
+				opt := VerificationOption{TargetScopes: []string{"write"}, DenialDetails: true}
+				for i := 0; i < 2; i++ {
+					t, err := service.VerifyTokenWithCache("abc", opt)
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(false))
+					Expect(t["required_scopes"]).To(Equal([]interface{}{"write"}))
+				}
+				Expect(verifications).To(Equal(2))
+				key := service.verificationCacheKey("abc", VerificationOption{TargetScopes: []string{"write"}, Resource: "r"})
+				Expect(service.Cache.Read(key)).To(Equal(map[string]interface{}{"allowed": false, "reason": "missing scope"}))
+			})
+
+			It("returns the cached reason without DenialDetails", func() {
+				for i := 0; i < 2; i++ {
+					_, err := service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"write"}})
+					Expect(err).To(BeNil())
+				}
+				t, err := service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"write"}})
+				Expect(err).To(BeNil())
+				Expect(t).To(Equal(map[string]interface{}{"allowed": false, "reason": "missing scope"}))
+				Expect(verifications).To(Equal(1))
+			})
+		})
+
+		Describe("#VerifyTokenWithCache with a ResponseParser", func() {
+			BeforeEach(func() {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						fmt.Fprintf(w, `{"data":{"allowed":true,"sub":"client"}}`)
+					}
+				}
+			})
+
+			It("denies a wrapped response by default", func() {
+				t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).NotTo(Equal(true))
+			})
+
+			It("verifies the token with the response converted by the parser", func() {
+				service.ResponseParser = func(body []byte) (map[string]interface{}, error) {
+					var wrapped struct {
+						Data map[string]interface{} `json:"data"`
+					}
+					err := json.Unmarshal(body, &wrapped)
+					return wrapped.Data, err
+				}
+				t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(t).To(Equal(map[string]interface{}{"allowed": true, "sub": "client"}))
+			})
+
+			It("returns the error of the parser", func() {
+				service.ResponseParser = func(body []byte) (map[string]interface{}, error) {
+					return nil, errors.New("unexpected payload")
+				}
+				t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(MatchError("unexpected payload"))
+				Expect(t).To(Equal(notAllowedResponse))
+			})
+		})
+
+		Describe("#VerifyTokenWithCache with VolatileResponseFields", func() {
+			var requests int
+			BeforeEach(func() {
+				requests = 0
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						requests++
+						fmt.Fprintf(w, `{"allowed":true,"sub":"client","jti":"request-%d","nonce":"n"}`, requests)
+					}
+				}
+				service.VolatileResponseFields = []string{"jti", "nonce"}
+			})
+
+			It("removes the volatile fields from the cached response", func() {
+				t, err := service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"scope"}})
+				Expect(err).To(BeNil())
+				Expect(t).To(Equal(map[string]interface{}{"allowed": true, "sub": "client", "jti": "request-1", "nonce": "n"}))
+				key := service.verificationCacheKey("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "r"})
+				Expect(service.Cache.Read(key)).To(Equal(map[string]interface{}{"allowed": true, "sub": "client"}))
+
+				t, err = service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"scope"}})
+				Expect(err).To(BeNil())
+				Expect(t).To(Equal(map[string]interface{}{"allowed": true, "sub": "client"}))
+				Expect(requests).To(Equal(1))
+			})
+
+			It("caches the whole response by default", func() {
+				service.VolatileResponseFields = nil
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(t["jti"]).To(Equal("request-1"))
+			})
+		})
+
+		Describe("#VerifyTokenNoCache", func() {
+			var verifications int
+			var accesses *accessCache
+			BeforeEach(func() {
+				verifications = 0
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def","expires_in":3600}`)
+					} else if r.RequestURI == "/v" {
+						verifications++
+						fmt.Fprintf(w, `{"allowed":true}`)
+					}
+				}
+				accesses = &accessCache{Cache: cache.NewGoCache(time.Hour, 0)}
+				service.Cache = accesses
+				service.AccessTokenCache = cache.NewGoCache(time.Hour, 0)
+			})
+
+			It("verifies the token with SAND without reading or writing the cache", func() {
+				for i := 0; i < 2; i++ {
+					t, err := service.VerifyTokenNoCache("abc", VerificationOption{TargetScopes: []string{"scope"}})
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(true))
+				}
+				Expect(verifications).To(Equal(2))
+				Expect(accesses.reads).To(BeEmpty())
+				Expect(accesses.writes).To(BeEmpty())
+			})
+
+			It("does not return a cached result", func() {
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, `{"allowed":false}`)
+				}
+				t, err := service.VerifyTokenNoCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(false))
+			})
+		})
+
+		Describe("#VerifyTokenWithCache with a TokenKeyHash", func() {
+			It("caches the result by the SHA-256 hash of the token by default", func() {
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"scope"}})
+				Expect(err).To(BeNil())
+				key := service.cacheKey(SHA256Hex("abc"), []string{"scope"}, "r")
+				Expect(key).NotTo(ContainSubstring("abc"))
+				Expect(service.Cache.Read(key)).To(Equal(map[string]interface{}{"allowed": true}))
+			})
+
+			It("caches the result by the custom hash of the token", func() {
+				service.TokenKeyHash = func(token string) string {
+					return fmt.Sprintf("%x", len(token))
+				}
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{TargetScopes: []string{"scope"}})
+				Expect(err).To(BeNil())
+				Expect(service.Cache.Read(service.cacheKey("3", []string{"scope"}, "r"))).To(Equal(map[string]interface{}{"allowed": true}))
+				Expect(service.Cache.Read(service.cacheKey(SHA256Hex("abc"), []string{"scope"}, "r"))).To(BeNil())
+			})
+		})
+
+		Describe("#VerifyTokenWithCacheTimeout", func() {
+			BeforeEach(func() {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						select {
+						case <-time.After(3 * time.Second):
+						case <-r.Context().Done():
+						}
+						fmt.Fprintf(w, `{"allowed":true}`)
+					}
+				}
+			})
+
+			It("cancels the verification after the timeout", func() {
+				t1 := time.Now()
+				t, err := service.VerifyTokenWithCacheTimeout("abc", VerificationOption{TargetScopes: []string{"scope"}}, 200*time.Millisecond)
+				Expect(time.Since(t1)).To(BeNumerically("<", time.Second))
+				Expect(err).To(MatchError(ContainSubstring("context deadline exceeded")))
+				Expect(t).To(Equal(notAllowedResponse))
+			})
+
+			It("returns the result within the timeout", func() {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						fmt.Fprintf(w, `{"allowed":true}`)
+					}
+				}
+				t, err := service.VerifyTokenWithCacheTimeout("abc", VerificationOption{TargetScopes: []string{"scope"}}, time.Second)
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(true))
+			})
+		})
+
+		Describe("#VerifyTokenWithCache with issuer and audience", func() {
+			BeforeEach(func() {
+				service.Cache = nil
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					var resp map[string]interface{}
+					if r.RequestURI == "/" {
+						resp = map[string]interface{}{"access_token": "def"}
+					} else if r.RequestURI == "/v" {
+						resp = map[string]interface{}{"allowed": true, "iss": "sand", "aud": []string{"a", "b"}}
+					}
+					exp, _ := json.Marshal(resp)
+					fmt.Fprintf(w, string(exp))
+				}
+			})
+
+			Context("with matching issuer and audience", func() {
+				It("returns the allowed response", func() {
+					service.ExpectedIssuer = "sand"
+					service.ExpectedAudience = "b"
+					t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(true))
+				})
+			})
+
+			Context("with mismatching issuer", func() {
+				It("returns not allowed with an error", func() {
+					service.ExpectedIssuer = "other"
+					t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+					Expect(t).To(Equal(notAllowedResponse))
+					Expect(err).To(MatchError(AuthenticationError{`Token issuer mismatch: expected "other", got sand`}))
+				})
+			})
+
+			Context("with mismatching audience", func() {
+				It("returns not allowed with an error", func() {
+					service.ExpectedAudience = "c"
+					t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+					Expect(t).To(Equal(notAllowedResponse))
+					Expect(err).To(MatchError(AuthenticationError{`Token audience mismatch: expected "c", got [a b]`}))
+				})
+			})
+		})
+
+		Describe("#VerifyTokenWithCacheTTL", func() {
+			var exp string
+			BeforeEach(func() {
+				service.Cache = cache.NewGoCache(time.Hour, time.Hour)
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					var resp map[string]interface{}
+					if r.RequestURI == "/" {
+						resp = map[string]interface{}{"access_token": "def"}
+					} else if r.RequestURI == "/v" {
+						resp = map[string]interface{}{"allowed": true, "exp": exp}
+					}
+					b, _ := json.Marshal(resp)
+					fmt.Fprintf(w, string(b))
+				}
+			})
+
+			It("returns the TTL computed from the exp of the response", func() {
+				exp = time.Now().Add(100 * time.Second).Format(iso8601)
+				t, ttl, err := service.VerifyTokenWithCacheTTL("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(true))
+				Expect(ttl).To(BeNumerically("<=", 100*time.Second))
+				Expect(ttl).To(BeNumerically(">=", 98*time.Second))
+
+				//Read from the cache
+				_, ttl, err = service.VerifyTokenWithCacheTTL("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(ttl).To(BeZero())
+			})
+
+			It("returns the TTL computed from a numeric exp of the response", func() {
+				expiry := time.Now().Add(100 * time.Second).Unix()
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						fmt.Fprintf(w, `{"allowed":true,"exp":%d}`, expiry)
+					}
+				}
+				t, ttl, err := service.VerifyTokenWithCacheTTL("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(t["exp"]).To(Equal(json.Number(fmt.Sprint(expiry))))
+				Expect(ttl).To(BeNumerically("<=", 100*time.Second))
+				Expect(ttl).To(BeNumerically(">=", 98*time.Second))
+			})
+
+			It("returns the default expiry time as the TTL without a valid exp", func() {
+				exp = "bad"
+				_, ttl, err := service.VerifyTokenWithCacheTTL("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(ttl).To(Equal(time.Duration(service.DefaultExpTime) * time.Second))
+			})
+
+			Context("with a CacheTTLFunc", func() {
+				BeforeEach(func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						if r.RequestURI == "/" {
+							fmt.Fprintf(w, `{"access_token":"def"}`)
+						} else if r.RequestURI == "/v" {
+							fmt.Fprintf(w, `{"allowed":true,"exp":%d,"cache_ttl_seconds":%s}`, time.Now().Add(time.Hour).Unix(), exp)
+						}
+					}
+					service.CacheTTLFunc = func(resp map[string]interface{}) time.Duration {
+						seconds, _ := resp["cache_ttl_seconds"].(json.Number).Int64()
+						return time.Duration(seconds) * time.Second
+					}
+				})
+
+				It("caches the response for the TTL of the function", func() {
+					exp = "30"
+					ttls := &ttlCache{Cache: service.Cache, ttls: map[string]time.Duration{}}
+					service.Cache = ttls
+					_, ttl, err := service.VerifyTokenWithCacheTTL("abc", VerificationOption{})
+					Expect(err).To(BeNil())
+					Expect(ttl).To(Equal(30 * time.Second))
+					Expect(ttls.ttls[service.verificationCacheKey("abc", VerificationOption{Resource: "r"})]).To(Equal(30 * time.Second))
+				})
+
+				It("does not cache the response for a TTL <= 0", func() {
+					exp = "0"
+					t, ttl, err := service.VerifyTokenWithCacheTTL("abc", VerificationOption{})
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(true))
+					Expect(ttl).To(BeZero())
+					Expect(service.Cache.Read(service.verificationCacheKey("abc", VerificationOption{Resource: "r"}))).To(BeNil())
+				})
+			})
+		})
+
+		Describe("with OnVerificationLatency", func() {
+			var cached []bool
+			var latencies []time.Duration
+			BeforeEach(func() {
+				cached, latencies = nil, nil
+				service.Cache = cache.NewGoCache(time.Hour, time.Hour)
+				service.OnVerificationLatency = func(c bool, latency time.Duration) {
+					cached = append(cached, c)
+					latencies = append(latencies, latency)
+				}
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						time.Sleep(20 * time.Millisecond)
+						fmt.Fprintf(w, `{"allowed":true}`)
+					}
+				}
+			})
+
+			It("reports the latency of SAND for a miss and of the cache for a hit", func() {
+				for i := 0; i < 2; i++ {
+					t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(true))
+				}
+				Expect(cached).To(Equal([]bool{false, true}))
+				Expect(latencies[0]).To(BeNumerically(">=", 20*time.Millisecond))
+				Expect(latencies[1]).To(BeNumerically("<", 20*time.Millisecond))
+			})
+
+			It("reports the latency of SAND for a failed verification", func() {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						w.WriteHeader(http.StatusNotFound)
+					}
+				}
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).NotTo(BeNil())
+				Expect(cached).To(Equal([]bool{false}))
+			})
+
+			It("does not report the trusted tokens", func() {
+				service.TrustedTokens = map[string]map[string]interface{}{"abc": {"sub": "trusted"}}
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(cached).To(BeEmpty())
+			})
+		})
+
+		Describe("with OnCacheWriteError", func() {
+			It("reports the failed writes of the access token and the verification", func() {
+				service.Cache = &failingCache{Cache: cache.NewGoCache(time.Hour, time.Hour), writeErr: errors.New("connection refused")}
+				var keys []string
+				service.OnCacheWriteError = func(key string, err error) {
+					Expect(err).To(MatchError("connection refused"))
+					keys = append(keys, key)
+				}
+				t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(true))
+				Expect(keys).To(HaveLen(2))
+				Expect(keys).To(ContainElement(service.verificationCacheKey("abc", VerificationOption{Resource: "r"})))
+			})
+		})
+
+		Describe("with a Transport", func() {
+			It("uses the transport for both getting the access token and verifying tokens", func() {
+				transport := &recordingTransport{base: http.DefaultTransport}
+				service.Transport = transport
+				t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(true))
+				Expect(transport.urls).To(Equal([]string{service.TokenURL, service.TokenVerifyURL}))
+			})
+		})
+
+		Describe("#VerifyTokenWithResult", func() {
+			var status int
+			var allowed bool
+			BeforeEach(func() {
+				status = http.StatusOK
+				allowed = true
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					var resp map[string]interface{}
+					if r.RequestURI == "/" {
+						resp = map[string]interface{}{"access_token": "def"}
+					} else if r.RequestURI == "/v" {
+						w.WriteHeader(status)
+						resp = map[string]interface{}{"allowed": allowed}
+					}
+					exp, _ := json.Marshal(resp)
+					fmt.Fprintf(w, string(exp))
+				}
+			})
+
+			It("reports the status of an allowed response", func() {
+				result, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.Allowed()).To(BeTrue())
+				Expect(result.StatusCode).To(Equal(http.StatusOK))
+				Expect(result.Cached).To(BeFalse())
+
+				result, err = service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.Allowed()).To(BeTrue())
+				Expect(result.StatusCode).To(Equal(0))
+				Expect(result.Cached).To(BeTrue())
+			})
+
+			It("reports the expiry time given by SAND", func() {
+				exp := time.Now().Add(time.Hour).Truncate(time.Second)
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						fmt.Fprintf(w, `{"allowed":true,"exp":%q}`, exp.Format(iso8601))
+					}
+				}
+				result, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.Expiry.Equal(exp)).To(BeTrue())
+
+				result, err = service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.Cached).To(BeTrue())
+				Expect(result.Expiry.Equal(exp)).To(BeTrue())
+			})
+
+			It("reports no expiry time without a valid exp", func() {
+				result, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.Expiry.IsZero()).To(BeTrue())
+
+				allowed = false
+				result, err = service.VerifyTokenWithResult("def", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.Expiry.IsZero()).To(BeTrue())
+			})
+
+			Context("with an ExpiredTokenGrace", func() {
+				var exp time.Time
+				var reason string
+				BeforeEach(func() {
+					service.ExpiredTokenGrace = time.Minute
+					reason = "expired"
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						if r.RequestURI == "/" {
+							fmt.Fprintf(w, `{"access_token":"def"}`)
+						} else if r.RequestURI == "/v" {
+							if allowed {
+								fmt.Fprintf(w, `{"allowed":true,"exp":%d}`, exp.Unix())
+							} else {
+								fmt.Fprintf(w, `{"allowed":false,"reason":%q}`, reason)
+							}
+						}
+					}
+				})
+
+				It("allows a token that expired within the grace", func() {
+					exp = time.Now().Add(-5 * time.Second)
+					result, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+					Expect(err).To(BeNil())
+					Expect(result.Grace).To(BeFalse())
+
+					allowed = false
+					result, err = service.VerifyTokenWithResult("abc", VerificationOption{SkipCache: true})
+					Expect(err).To(BeNil())
+					Expect(result.Allowed()).To(BeTrue())
+					Expect(result.Grace).To(BeTrue())
+					Expect(result.Expiry.Unix()).To(Equal(exp.Unix()))
+				})
+
+				It("denies a token that SAND denies for another reason within the grace", func() {
+					exp = time.Now().Add(-5 * time.Second)
+					_, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+					Expect(err).To(BeNil())
+
+					allowed = false
+					reason = "token revoked"
+					result, err := service.VerifyTokenWithResult("abc", VerificationOption{SkipCache: true})
+					Expect(err).To(BeNil())
+					Expect(result.Allowed()).To(BeFalse())
+					Expect(result.Grace).To(BeFalse())
+					Expect(result.Reason).To(Equal("token revoked"))
+				})
+
+				It("denies a token that expired beyond the grace", func() {
+					exp = time.Now().Add(-2 * time.Minute)
+					_, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+					Expect(err).To(BeNil())
+
+					allowed = false
+					result, err := service.VerifyTokenWithResult("abc", VerificationOption{SkipCache: true})
+					Expect(err).To(BeNil())
+					Expect(result.Allowed()).To(BeFalse())
+					Expect(result.Grace).To(BeFalse())
+				})
+
+				It("denies a token that has not expired", func() {
+					exp = time.Now().Add(time.Hour)
+					_, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+					Expect(err).To(BeNil())
+
+					allowed = false
+					result, err := service.VerifyTokenWithResult("abc", VerificationOption{SkipCache: true})
+					Expect(err).To(BeNil())
+					Expect(result.Allowed()).To(BeFalse())
+					Expect(result.Reason).To(Equal("expired"))
+				})
+
+				It("denies an expired token without the grace", func() {
+					service.ExpiredTokenGrace = 0
+					exp = time.Now().Add(-5 * time.Second)
+					_, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+					Expect(err).To(BeNil())
+
+					allowed = false
+					result, err := service.VerifyTokenWithResult("abc", VerificationOption{SkipCache: true})
+					Expect(err).To(BeNil())
+					Expect(result.Allowed()).To(BeFalse())
+				})
+			})
+
+			It("returns a timer that fires at the expiry time", func() {
+				clock := time.Now().Add(-time.Hour)
+				now = func() time.Time { return clock }
+				defer func() { now = time.Now }()
+
+				result := &VerificationResult{Expiry: clock.Add(100 * time.Millisecond)}
+				timer := result.ExpiryTimer()
+				start := time.Now()
+				Eventually(timer.C).Should(Receive())
+				Expect(time.Since(start)).To(BeNumerically("~", 100*time.Millisecond, 50*time.Millisecond))
+
+				result = &VerificationResult{Expiry: clock.Add(-time.Second)}
+				Eventually(result.ExpiryTimer().C, 10*time.Millisecond).Should(Receive())
+			})
+
+			It("returns no timer without an expiry time", func() {
+				result, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.ExpiryTimer()).To(BeNil())
+			})
+
+			It("reports the age of a cached result", func() {
+				result, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.Age).To(Equal(time.Duration(0)))
+
+				time.Sleep(20 * time.Millisecond)
+				result, err = service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.Cached).To(BeTrue())
+				Expect(result.Age).To(BeNumerically(">=", 20*time.Millisecond))
+
+				age := result.Age
+				time.Sleep(20 * time.Millisecond)
+				result, err = service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.Age).To(BeNumerically(">=", age+20*time.Millisecond))
+			})
+
+			Context("with the caching of denials", func() {
+				var verifications int
+				BeforeEach(func() {
+					verifications = 0
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						if r.RequestURI == "/" {
+							fmt.Fprintf(w, `{"access_token":"def"}`)
+						} else if r.RequestURI == "/v" {
+							verifications++
+							w.WriteHeader(status)
+							fmt.Fprintf(w, `{"allowed":%t}`, allowed)
+						}
+					}
+				})
+
+				It("caches the denials by default", func() {
+					allowed = false
+					for i := 0; i < 2; i++ {
+						result, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+						Expect(err).To(BeNil())
+						Expect(result.Allowed()).To(BeFalse())
+					}
+					Expect(verifications).To(Equal(1))
+				})
+
+				It("does not cache the denials with DoNotCacheDenials", func() {
+					service.DenialCaching = DoNotCacheDenials
+					allowed = false
+					for i := 0; i < 2; i++ {
+						result, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+						Expect(err).To(BeNil())
+						Expect(result.Allowed()).To(BeFalse())
+						Expect(result.Cached).To(BeFalse())
+						Expect(result.TTL).To(Equal(time.Duration(0)))
+					}
+					Expect(verifications).To(Equal(2))
+
+					allowed = true
+					service.VerifyTokenWithResult("abc", VerificationOption{})
+					result, _ := service.VerifyTokenWithResult("abc", VerificationOption{})
+					Expect(result.Cached).To(BeTrue())
+					Expect(verifications).To(Equal(3))
+				})
+
+				It("caches the denials for the NotAllowedTTL of the option", func() {
+					ttls := &ttlCache{Cache: service.Cache, ttls: map[string]time.Duration{}}
+					service.Cache = ttls
+					notAllowedTTL := 5 * time.Second
+					allowed = false
+					result, err := service.VerifyTokenWithResult("abc", VerificationOption{NotAllowedTTL: &notAllowedTTL})
+					Expect(err).To(BeNil())
+					Expect(result.Allowed()).To(BeFalse())
+					Expect(result.TTL).To(Equal(notAllowedTTL))
+					Expect(ttls.ttls).To(ContainElement(notAllowedTTL))
+
+					result, err = service.VerifyTokenWithResult("abc", VerificationOption{NotAllowedTTL: &notAllowedTTL})
+					Expect(err).To(BeNil())
+					Expect(result.Cached).To(BeTrue())
+					Expect(verifications).To(Equal(1))
+				})
+
+				It("does not apply the NotAllowedTTL to the allowed results", func() {
+					ttls := &ttlCache{Cache: service.Cache, ttls: map[string]time.Duration{}}
+					service.Cache = ttls
+					notAllowedTTL := 5 * time.Second
+					result, err := service.VerifyTokenWithResult("abc", VerificationOption{NotAllowedTTL: &notAllowedTTL})
+					Expect(err).To(BeNil())
+					Expect(result.Allowed()).To(BeTrue())
+					Expect(result.TTL).To(Equal(time.Duration(service.DefaultExpTime) * time.Second))
+				})
+
+				It("does not cache the denials with a NotAllowedTTL <= 0", func() {
+					notAllowedTTL := time.Duration(0)
+					allowed = false
+					for i := 0; i < 2; i++ {
+						result, err := service.VerifyTokenWithResult("abc", VerificationOption{NotAllowedTTL: &notAllowedTTL})
+						Expect(err).To(BeNil())
+						Expect(result.Allowed()).To(BeFalse())
+						Expect(result.Cached).To(BeFalse())
+						Expect(result.TTL).To(Equal(time.Duration(0)))
+					}
+					Expect(verifications).To(Equal(2))
+				})
+
+				It("never caches the outcome of a 500 response", func() {
+					for _, caching := range []DenialCaching{CacheDenials, DoNotCacheDenials} {
+						service.DenialCaching = caching
+						status = http.StatusInternalServerError
+						verifications = 0
+						for i := 0; i < 2; i++ {
+							result, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+							Expect(err).To(BeNil())
+							Expect(result.Allowed()).To(BeFalse())
+							Expect(result.StatusCode).To(Equal(http.StatusInternalServerError))
+						}
+						Expect(verifications).To(Equal(2))
+					}
+				})
+			})
+
+			Context("with the reason of a denial", func() {
+				var response string
+				BeforeEach(func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						if r.RequestURI == "/" {
+							fmt.Fprintf(w, `{"access_token":"def"}`)
+						} else if r.RequestURI == "/v" {
+							fmt.Fprintf(w, response)
+						}
+					}
+				})
+
+				It("reports the reason of a fresh and a cached denial", func() {
+					response = `{"allowed":false,"reason":"token revoked"}`
+					result, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+					Expect(err).To(BeNil())
+					Expect(result.Allowed()).To(BeFalse())
+					Expect(result.Reason).To(Equal("token revoked"))
+
+					result, err = service.VerifyTokenWithResult("abc", VerificationOption{})
+					Expect(err).To(BeNil())
+					Expect(result.Cached).To(BeTrue())
+					Expect(result.Reason).To(Equal("token revoked"))
+					Expect(result.Response).To(Equal(map[string]interface{}{"allowed": false, "reason": "token revoked"}))
+				})
+
+				It("reports the error field as the reason", func() {
+					response = `{"allowed":false,"error":"insufficient scope"}`
+					result, _ := service.VerifyTokenWithResult("abc", VerificationOption{})
+					Expect(result.Reason).To(Equal("insufficient scope"))
+				})
+
+				It("sanitizes the reason", func() {
+					response = fmt.Sprintf(`{"allowed":false,"reason":"bad\r\ntoken%s"}`, strings.Repeat("x", 300))
+					result, _ := service.VerifyTokenWithResult("abc", VerificationOption{})
+					Expect(result.Reason).To(HavePrefix("badtoken"))
+					Expect(result.Reason).To(HaveLen(200))
+				})
+
+				It("reports no reason for an allowed token or a denial without a reason", func() {
+					response = `{"allowed":true,"reason":"ok"}`
+					result, _ := service.VerifyTokenWithResult("abc", VerificationOption{})
+					Expect(result.Reason).To(Equal(""))
+
+					response = `{"allowed":false}`
+					result, _ = service.VerifyTokenWithResult("xyz", VerificationOption{})
+					Expect(result.Reason).To(Equal(""))
+					result, _ = service.VerifyTokenWithResult("xyz", VerificationOption{})
+					Expect(result.Response).To(Equal(notAllowedResponse))
+				})
+			})
+
+			It("reports the status of a denied response", func() {
+				allowed = false
+				result, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.Allowed()).To(BeFalse())
+				Expect(result.StatusCode).To(Equal(http.StatusOK))
+			})
+
+			It("reports the status of an error response", func() {
+				status = http.StatusNotFound
+				result, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).NotTo(BeNil())
+				Expect(result.Allowed()).To(BeFalse())
+				Expect(result.StatusCode).To(Equal(http.StatusNotFound))
+
+				status = http.StatusInternalServerError
+				result, err = service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(result.Allowed()).To(BeFalse())
+				Expect(result.StatusCode).To(Equal(http.StatusInternalServerError))
+			})
+
+			It("reports no status on connection error", func() {
+				service.TokenVerifyURL = ""
+				result, err := service.VerifyTokenWithResult("abc", VerificationOption{})
+				Expect(err).NotTo(BeNil())
+				Expect(result.Allowed()).To(BeFalse())
+				Expect(result.StatusCode).To(Equal(0))
+			})
+		})
+
+		Describe("#ErrorCode", func() {
+			It("returns 401 without an error", func() {
+				Expect(service.ErrorCode(nil)).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("returns 503 when SAND is rate limiting the verification", func() {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.RequestURI == "/" {
+						fmt.Fprintf(w, `{"access_token":"def"}`)
+					} else if r.RequestURI == "/v" {
+						w.WriteHeader(http.StatusTooManyRequests)
+					}
+				}
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(MatchError(UnavailableError{Message: "Error response from the authentication service: 429 - ", StatusCode: 429}))
+				Expect(service.ErrorCode(err)).To(Equal(http.StatusServiceUnavailable))
+			})
+
+			It("returns 503 when the token endpoint is unavailable", func() {
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				unavailableErr, yes := err.(UnavailableError)
+				Expect(yes).To(BeTrue())
+				Expect(unavailableErr.StatusCode).To(Equal(http.StatusServiceUnavailable))
+				Expect(service.ErrorCode(err)).To(Equal(http.StatusServiceUnavailable))
+			})
+
+			It("returns 503 for a connection error with a 503 status", func() {
+				err := ConnectionError{Message: "unavailable", StatusCode: http.StatusServiceUnavailable}
+				Expect(service.ErrorCode(err)).To(Equal(http.StatusServiceUnavailable))
+			})
+
+			It("returns 502 when SAND cannot be dialed", func() {
+				ts.Close()
+				_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				_, yes := err.(ConnectionError)
+				Expect(yes).To(BeTrue())
+				Expect(service.ErrorCode(err)).To(Equal(http.StatusBadGateway))
+			})
+
+			It("returns 400 for an invalid request", func() {
+				Expect(service.ErrorCode(InvalidRequestError{"duplicate"})).To(Equal(http.StatusBadRequest))
+			})
+
+			It("returns 502 for other errors", func() {
+				Expect(service.ErrorCode(AuthenticationError{"denied"})).To(Equal(http.StatusBadGateway))
+			})
+		})
+
+		Describe("#verifyToken", func() {
+			minusOne := -1
+			Context("with empty token", func() {
+				It("returns nil", func() {
+					t, err := service.verifyToken("", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
+					Expect(t).To(BeNil())
+					Expect(err).To(BeNil())
+				})
+			})
+
+			Context("with an error response", func() {
+				It("returns an error", func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						w.WriteHeader(http.StatusNotFound)
+					}
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
+					Expect(t).To(BeNil())
+					_, yes := err.(AuthenticationError)
+					Expect(yes).To(BeTrue())
+				})
+			})
+
+			Context("with a valid token and valid response", func() {
+				It("returns allowed response", func() {
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
+					Expect(err).To(BeNil())
+					Expect(t).To(Equal(map[string]interface{}{"allowed": true}))
+				})
+			})
+
+			Context("with an AuthorizationScheme", func() {
+				It("sends the access token with the scheme", func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						if r.RequestURI == "/" {
+							fmt.Fprintf(w, `{"access_token":"def"}`)
+						} else if r.RequestURI == "/v" {
+							Expect(r.Header.Get("Authorization")).To(Equal("bearer def"))
+							fmt.Fprintf(w, `{"allowed":true}`)
+						}
+					}
+					service.AuthorizationScheme = "bearer"
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &minusOne})
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(true))
+				})
+			})
+
+			Context("with VerifyHeaders", func() {
+				var overrides []string
+				BeforeEach(func() {
+					overrides = nil
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						if r.RequestURI == "/" {
+							fmt.Fprintf(w, `{"access_token":"def"}`)
+						} else if r.RequestURI == "/v" {
+							overrides = append(overrides, r.Header.Get("X-HTTP-Method-Override"))
+							Expect(r.Header.Get("Authorization")).To(Equal("Bearer def"))
+							fmt.Fprintf(w, `{"allowed":true}`)
+						}
+					}
+					service.VerifyHeaders = http.Header{
+						"x-http-method-override": {"POST"},
+						"Authorization":          {"Bearer other"},
+					}
+				})
+
+				It("sends the headers with the verification request", func() {
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &minusOne})
+					Expect(err).To(BeNil())
+					Expect(t).To(Equal(map[string]interface{}{"allowed": true}))
+					Expect(overrides).To(Equal([]string{"POST"}))
+				})
+
+				It("lets BeforeVerify replace the headers", func() {
+					service.BeforeVerify = func(r *http.Request) error {
+						r.Header.Set("X-HTTP-Method-Override", "PUT")
+						return nil
+					}
+					_, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &minusOne})
+					Expect(err).To(BeNil())
+					Expect(overrides).To(Equal([]string{"PUT"}))
+				})
+
+				It("sends the headers with the retried verification request", func() {
+					service.Transport = &flakyTransport{base: http.DefaultTransport, path: "/v", failures: 1}
+					one := 1
+					_, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &one})
+					Expect(err).To(BeNil())
+					Expect(overrides).To(Equal([]string{"POST"}))
+				})
+			})
+
+			Context("with a BeforeVerify hook", func() {
+				It("sends the request modified by the hook", func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						var resp map[string]interface{}
+						if r.RequestURI == "/" {
+							resp = map[string]interface{}{"access_token": "def"}
+						} else if r.RequestURI == "/v" {
+							resp = map[string]interface{}{"allowed": r.Header.Get("X-Signature") == "signed"}
+						}
+						exp, _ := json.Marshal(resp)
+						fmt.Fprintf(w, string(exp))
+					}
+					service.BeforeVerify = func(r *http.Request) error {
+						r.Header.Set("X-Signature", "signed")
+						return nil
+					}
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
+					Expect(err).To(BeNil())
+					Expect(t).To(Equal(map[string]interface{}{"allowed": true}))
+				})
+
+				It("aborts the verification on error", func() {
+					service.BeforeVerify = func(r *http.Request) error {
+						return errors.New("failed to sign")
+					}
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
+					Expect(t).To(BeNil())
+					Expect(err).To(MatchError("failed to sign"))
+				})
+			})
+
+			Context("with a connection error when verifying the token", func() {
+				var transport *flakyTransport
+				BeforeEach(func() {
+					transport = &flakyTransport{base: http.DefaultTransport, path: "/v", failures: 1}
+					service.Transport = transport
+				})
+
+				It("retries the verification", func() {
+					one := 1
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &one})
+					Expect(err).To(BeNil())
+					Expect(t).To(Equal(map[string]interface{}{"allowed": true}))
+					Expect(transport.failures).To(Equal(0))
+				})
+
+				It("stops retrying before the deadline of the context is exceeded", func() {
+					transport.failures = 5
+					five := 5
+					ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+					defer cancel()
+					t1 := time.Now()
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &five, RequestContext: ctx})
+					Expect(time.Since(t1)).To(BeNumerically("<", 2500*time.Millisecond))
+					Expect(t).To(BeNil())
+					Expect(err).To(MatchError(ContainSubstring("Service failed to verify the token")))
+					Expect(transport.failures).To(Equal(3))
+				})
+
+				It("stops retrying once the context is canceled", func() {
+					transport.failures = 5
+					five := 5
+					ctx, cancel := context.WithCancel(context.Background())
+					time.AfterFunc(200*time.Millisecond, cancel)
+					t1 := time.Now()
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &five, RequestContext: ctx})
+					Expect(time.Since(t1)).To(BeNumerically("<", 800*time.Millisecond))
+					Expect(t).To(BeNil())
+					Expect(err).NotTo(BeNil())
+					Expect(transport.failures).To(Equal(4))
+				})
+
+				It("does not retry a canceled request", func() {
+					transport.failures = 5
+					transport.err = context.Canceled
+					five := 5
+					t1 := time.Now()
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &five})
+					Expect(time.Since(t1)).To(BeNumerically("<", 500*time.Millisecond))
+					Expect(t).To(BeNil())
+					Expect(err).To(MatchError(ContainSubstring("context canceled")))
+					Expect(transport.failures).To(Equal(4))
+				})
+
+				It("does not retry an error other than a connection failure", func() {
+					transport.failures = 5
+					transport.err = errors.New("malformed HTTP response")
+					five := 5
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &five})
+					Expect(t).To(BeNil())
+					Expect(err).To(MatchError(ContainSubstring("malformed HTTP response")))
+					Expect(transport.failures).To(Equal(4))
+				})
+
+				It("returns the error without retry", func() {
+					zero := 0
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &zero})
+					Expect(t).To(BeNil())
+					Expect(err).To(MatchError(ContainSubstring("Service failed to verify the token")))
+				})
+			})
+
+			Context("with RetryVerifyStatuses", func() {
+				var statuses []int
+				var verifications int
+				BeforeEach(func() {
+					statuses, verifications = nil, 0
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						if r.RequestURI == "/" {
+							fmt.Fprintf(w, `{"access_token":"def"}`)
+						} else if r.RequestURI == "/v" {
+							verifications++
+							if len(statuses) > 0 {
+								w.WriteHeader(statuses[0])
+								statuses = statuses[1:]
+								return
+							}
+							fmt.Fprintf(w, `{"allowed":true}`)
+						}
+					}
+					service.RetryVerifyStatuses = []int{http.StatusServiceUnavailable}
+				})
+
+				It("retries the verification on the statuses", func() {
+					statuses = []int{http.StatusServiceUnavailable}
+					one := 1
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &one})
+					Expect(err).To(BeNil())
+					Expect(t).To(Equal(map[string]interface{}{"allowed": true}))
+					Expect(verifications).To(Equal(2))
+				})
+
+				It("returns the last response after the retries", func() {
+					statuses = []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+					one := 1
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &one})
+					Expect(t).To(BeNil())
+					Expect(err).To(BeAssignableToTypeOf(UnavailableError{}))
+					Expect(verifications).To(Equal(2))
+				})
+
+				It("does not retry the other statuses or without retries", func() {
+					statuses = []int{http.StatusInternalServerError}
+					one := 1
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &one})
+					Expect(err).To(BeNil())
+					Expect(t).To(BeNil())
+					Expect(verifications).To(Equal(1))
+
+					statuses = []int{http.StatusServiceUnavailable}
+					_, err = service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &minusOne})
+					Expect(err).To(BeAssignableToTypeOf(UnavailableError{}))
+					Expect(verifications).To(Equal(2))
+				})
+			})
+
+			Context("with UseNonce", func() {
+				var echo func(string) string
+				BeforeEach(func() {
+					service.UseNonce = true
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						var resp map[string]interface{}
+						if r.RequestURI == "/" {
+							resp = map[string]interface{}{"access_token": "def"}
+						} else if r.RequestURI == "/v" {
+							var body map[string]interface{}
+							json.NewDecoder(r.Body).Decode(&body)
+							nonce, _ := body["nonce"].(string)
+							Expect(nonce).NotTo(BeEmpty())
+							resp = map[string]interface{}{"allowed": true, "nonce": echo(nonce)}
+						}
+						exp, _ := json.Marshal(resp)
+						fmt.Fprintf(w, string(exp))
+					}
+				})
+
+				It("accepts the response with the matching nonce", func() {
+					echo = func(nonce string) string { return nonce }
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &minusOne})
+					Expect(err).To(BeNil())
+					Expect(t["allowed"]).To(Equal(true))
+				})
+
+				It("rejects the response with a mismatched nonce", func() {
+					echo = func(nonce string) string { return "replayed" }
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &minusOne})
+					Expect(t).To(BeNil())
+					Expect(err).To(MatchError(ContainSubstring("Nonce mismatch")))
+					_, yes := err.(AuthenticationError)
+					Expect(yes).To(BeTrue())
+				})
+
+				It("does not cache the response with a mismatched nonce", func() {
+					echo = func(nonce string) string { return "replayed" }
+					t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+					Expect(t).To(Equal(notAllowedResponse))
+					Expect(err).To(HaveOccurred())
+					Expect(service.Cache.Read(service.verificationCacheKey("abc", VerificationOption{TargetScopes: []string{}, Resource: "r"}))).To(BeNil())
+				})
+			})
+
+			Context("with empty target scopes", func() {
+				var body map[string]interface{}
+				BeforeEach(func() {
+					body = nil
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						var resp map[string]interface{}
+						if r.RequestURI == "/" {
+							resp = map[string]interface{}{"access_token": "def"}
+						} else if r.RequestURI == "/v" {
+							json.NewDecoder(r.Body).Decode(&body)
+							resp = map[string]interface{}{"allowed": true}
+						}
+						exp, _ := json.Marshal(resp)
+						fmt.Fprintf(w, string(exp))
+					}
+				})
+
+				It("sends an empty list by default", func() {
+					_, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{}, Resource: "resource", NumRetry: &minusOne})
+					Expect(err).To(BeNil())
+					Expect(body).To(HaveKeyWithValue("scopes", []interface{}{}))
+				})
+
+				It("omits the scopes with EmptyScopesOmitted", func() {
+					service.EmptyScopeBehavior = EmptyScopesOmitted
+					_, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{}, Resource: "resource", NumRetry: &minusOne})
+					Expect(err).To(BeNil())
+					Expect(body).NotTo(HaveKey("scopes"))
+					Expect(body).To(HaveKeyWithValue("token", "abc"))
+				})
+
+				It("sends the wildcard with EmptyScopesAsWildcard", func() {
+					service.EmptyScopeBehavior = EmptyScopesAsWildcard
+					_, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{}, Resource: "resource", NumRetry: &minusOne})
+					Expect(err).To(BeNil())
+					Expect(body).To(HaveKeyWithValue("scopes", []interface{}{"*"}))
+				})
+
+				It("sends the fields with the names in RequestFieldNames", func() {
+					service.RequestFieldNames = map[string]string{"token": "client_token", "scopes": "permissions"}
+					_, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"a"}, Resource: "resource", NumRetry: &minusOne})
+					Expect(err).To(BeNil())
+					Expect(body).To(HaveKeyWithValue("client_token", "abc"))
+					Expect(body).To(HaveKeyWithValue("permissions", []interface{}{"a"}))
+					Expect(body).To(HaveKeyWithValue("resource", "resource"))
+					Expect(body).NotTo(HaveKey("token"))
+					Expect(body).NotTo(HaveKey("scopes"))
+				})
+
+				It("sends non-empty scopes as they are", func() {
+					service.EmptyScopeBehavior = EmptyScopesAsWildcard
+					_, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"a"}, Resource: "resource", NumRetry: &minusOne})
+					Expect(err).To(BeNil())
+					Expect(body).To(HaveKeyWithValue("scopes", []interface{}{"a"}))
+				})
+			})
+
+			Context("with VerifyEncoding", func() {
+				var contentType string
+				var form url.Values
+				var body map[string]interface{}
+				BeforeEach(func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						if r.RequestURI == "/" {
+							fmt.Fprintf(w, `{"access_token":"def"}`)
+						} else if r.RequestURI == "/v" {
+							contentType = r.Header.Get("Content-Type")
+							if contentType == "application/x-www-form-urlencoded" {
+								r.ParseForm()
+								form = r.PostForm
+							} else {
+								json.NewDecoder(r.Body).Decode(&body)
+							}
+							fmt.Fprintf(w, `{"allowed":true}`)
+						}
+					}
+				})
+
+				It("sends the body as JSON by default", func() {
+					_, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"a", "b"}, Resource: "resource", NumRetry: &minusOne})
+					Expect(err).To(BeNil())
+					Expect(contentType).To(Equal("application/json"))
+					Expect(body).To(HaveKeyWithValue("token", "abc"))
+					Expect(body).To(HaveKeyWithValue("scopes", []interface{}{"a", "b"}))
+				})
+
+				It("sends the JSON Content-Type with the retried request", func() {
+					service.Transport = &flakyTransport{base: http.DefaultTransport, path: "/v", failures: 1}
+					one := 1
+					_, err := service.verifyToken("abc", VerificationOption{Resource: "resource", NumRetry: &one})
+					Expect(err).To(BeNil())
+					Expect(contentType).To(Equal("application/json"))
+				})
+
+				It("sends the body as a form with VerifyAsForm", func() {
+					service.VerifyEncoding = VerifyAsForm
+					_, err := service.verifyToken("abc", VerificationOption{
+						TargetScopes: []string{"a", "b"},
+						Resource:     "resource",
+						Action:       "read",
+						Context:      map[string]interface{}{"k": "v"},
+						NumRetry:     &minusOne,
+					})
+					Expect(err).To(BeNil())
+					Expect(contentType).To(Equal("application/x-www-form-urlencoded"))
+					Expect(form.Get("token")).To(Equal("abc"))
+					Expect(form["scopes"]).To(Equal([]string{"a", "b"}))
+					Expect(form.Get("resource")).To(Equal("resource"))
+					Expect(form.Get("action")).To(Equal("read"))
+					Expect(form.Get("context")).To(Equal(`{"k":"v"}`))
+				})
+
+				It("omits an empty context from the form", func() {
+					service.VerifyEncoding = VerifyAsForm
+					_, err := service.verifyToken("abc", VerificationOption{Resource: "resource", NumRetry: &minusOne})
+					Expect(err).To(BeNil())
+					Expect(form).NotTo(HaveKey("context"))
+					Expect(form.Get("token")).To(Equal("abc"))
+				})
+			})
+
+			Context("with 500 response when verifying a token", func() {
+				It("returns nil", func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						var resp map[string]interface{}
+						if r.RequestURI == "/" {
+							resp = map[string]interface{}{"access_token": "def"}
+							exp, _ := json.Marshal(resp)
+							fmt.Fprintf(w, string(exp))
+						} else if r.RequestURI == "/v" {
+							w.WriteHeader(http.StatusInternalServerError)
+						}
+					}
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
+					Expect(err).To(BeNil())
+					Expect(t).To(BeNil())
+				})
+			})
+
+			Context("with an invalid json response when verifying token", func() {
+				It("returns an error", func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						var resp map[string]interface{}
+						if r.RequestURI == "/" {
+							resp = map[string]interface{}{"access_token": "def"}
+							exp, _ := json.Marshal(resp)
+							fmt.Fprintf(w, string(exp))
+						} else if r.RequestURI == "/v" {
+							Expect(r.Header.Get("Authorization")).To(Equal("Bearer def"))
+							fmt.Fprintf(w, "bad")
+						}
+					}
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
+					Expect(err).NotTo(BeNil())
+					Expect(t).To(BeNil())
+				})
+			})
+
+			Context("with a proxy blocking the request", func() {
+				It("returns an error getting token", func() {
+					service.TokenURL = "http://sand.test"
+					service.TokenVerifyURL = service.TokenURL + "/v"
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
+					Expect(t).To(BeNil())
+					Expect(err).To(MatchError(ConnectionError{Message: "oauth2: cannot fetch token: 403 Forbidden\nResponse: ", StatusCode: 403}))
+					Expect(service.ErrorCode(err)).To(Equal(http.StatusBadGateway))
+				})
+
+				It("returns an error verifying token", func() {
+					service.TokenVerifyURL = "http://sand.test/v"
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
+					Expect(t).To(BeNil())
+					Expect(err).To(MatchError(ConnectionError{Message: "Error response from the authentication service: 403 - ", StatusCode: 403}))
+				})
+			})
+
+			Context("with the server responding 403 through a proxy", func() {
+				var proxy *httptest.Server
+				BeforeEach(func() {
+					//The proxy forwards the requests with their absolute URLs to the server
+					proxy = httptest.NewServer(&httputil.ReverseProxy{Director: func(*http.Request) {}})
+					proxyURL, _ := url.Parse(proxy.URL)
+					service.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+				})
+				AfterEach(func() {
+					proxy.Close()
+				})
+
+				It("returns the 403 of the OAuth2 server as an AuthenticationError", func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						w.Header().Set("Content-Type", "application/json")
+						w.WriteHeader(http.StatusForbidden)
+						fmt.Fprintf(w, `{"error":"access_denied"}`)
+					}
+					_, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &minusOne})
+					_, yes := err.(AuthenticationError)
+					Expect(yes).To(BeTrue())
+				})
+
+				It("returns the 403 of SAND as an AuthenticationError", func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						if r.RequestURI == "/" {
+							fmt.Fprintf(w, `{"access_token":"def"}`)
+						} else if r.RequestURI == "/v" {
+							w.WriteHeader(http.StatusForbidden)
+							fmt.Fprintf(w, `{"error":"forbidden"}`)
+						}
+					}
+					_, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &minusOne})
+					Expect(err).To(MatchError(AuthenticationError{Message: `Error response from the authentication service: 403 - {"error":"forbidden"}`}))
+					_, yes := err.(ConnectionError)
+					Expect(yes).To(BeFalse())
+				})
+
+				It("returns a 407 of the proxy as a ConnectionError", func() {
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						if r.RequestURI == "/" {
+							fmt.Fprintf(w, `{"access_token":"def"}`)
+						} else if r.RequestURI == "/v" {
+							w.WriteHeader(http.StatusProxyAuthRequired)
+							fmt.Fprintf(w, `{"error":"proxy"}`)
+						}
+					}
+					_, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &minusOne})
+					connErr, yes := err.(ConnectionError)
+					Expect(yes).To(BeTrue())
+					Expect(connErr.StatusCode).To(Equal(http.StatusProxyAuthRequired))
+				})
+			})
+
+			Context("with the authentication service not running", func() {
+				It("returns a connection error getting token", func() {
+					closed := httptest.NewServer(http.NotFoundHandler())
+					closed.Close()
+					service.TokenURL = closed.URL
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &minusOne})
+					Expect(t).To(BeNil())
+					connErr, yes := err.(ConnectionError)
+					Expect(yes).To(BeTrue())
+					Expect(connErr.StatusCode).To(Equal(0))
+				})
+
+				It("returns a connection error verifying token", func() {
+					closed := httptest.NewServer(http.NotFoundHandler())
+					closed.Close()
+					service.TokenVerifyURL = closed.URL + "/v"
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Resource: "resource", NumRetry: &minusOne})
+					Expect(t).To(BeNil())
+					Expect(err).To(MatchError(ContainSubstring("Service failed to verify the token")))
+					_, yes := err.(ConnectionError)
+					Expect(yes).To(BeTrue())
+				})
+			})
+
+			Context("with a TLS server whose version is too old", func() {
+				var (
+					ss *httptest.Server
+				)
+				BeforeEach(func() {
+					ss = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						w.Header().Set("Content-Type", "application/json")
+						handler(w, r)
+					}))
+					ss.TLS = &tls.Config{
+						MaxVersion: tls.VersionTLS11,
+					}
+					ss.StartTLS()
+				})
+				AfterEach(func() {
+					ss.Close()
+				})
+
+				It("returns an error getting token", func() {
+					service.TokenURL = ss.URL
+					service.TokenVerifyURL = service.TokenURL + "/v"
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
+					Expect(t).To(BeNil())
+					Expect(err).To(MatchError(AuthenticationError{
+						Message: fmt.Sprintf("Post \"%s\": remote error: tls: protocol version not supported", service.TokenURL),
+					}))
+				})
+
+				It("returns an error verifying token", func() {
+					service.TokenVerifyURL = ss.URL + "/v"
+					t, err := service.verifyToken("abc", VerificationOption{TargetScopes: []string{"scope"}, Action: "", Resource: "resource", Context: nil, NumRetry: &minusOne})
+					Expect(t).To(BeNil())
+					Expect(err).To(MatchError(AuthenticationError{
+						Message: fmt.Sprintf("Service failed to verify the token: Post \"%s\": remote error: tls: protocol version not supported", service.TokenVerifyURL),
+					}))
+				})
+			})
+		})
+	})
+
+	Describe("#numericExpiryTime", func() {
+		It("returns the time difference without losing precision", func() {
+			//2^53 + 1 cannot be represented by a float64
+			const exp = 9007199254740993
+			before := time.Now().Unix()
+			ttl := service.numericExpiryTime(json.Number("9007199254740993"))
+			after := time.Now().Unix()
+			Expect(exp - int64(ttl)).To(BeNumerically(">=", before))
+			Expect(exp - int64(ttl)).To(BeNumerically("<=", after))
+		})
+
+		It("returns the default expiry time for a past or invalid exp", func() {
+			past := time.Now().Add(-100 * time.Second).Unix()
+			Expect(service.numericExpiryTime(json.Number(fmt.Sprint(past)))).To(Equal(service.DefaultExpTime))
+			Expect(service.numericExpiryTime(json.Number("1.5"))).To(Equal(service.DefaultExpTime))
+		})
+	})
+
+	Describe("#expiryTime", func() {
+		Context("with future expiration time", func() {
+			It("returns the time difference", func() {
+				futureTime := time.Now().Add(time.Duration(100) * time.Second)
+				t := futureTime.Format("2006-01-02T15:04:05.00-07:00")
+				Expect(service.expiryTime(t)).To(BeNumerically("<=", 100))
+			})
+		})
+
+		Context("with past expiration time", func() {
+			It("returns the default expiry time", func() {
+				theTime := time.Now()
+				t := theTime.Format("2006-01-02T15:04:05.00-07:00")
+				Expect(service.expiryTime(t)).To(Equal(service.DefaultExpTime))
+
+				theTime = time.Now().Add(time.Duration(-100) * time.Second)
+				t = theTime.Format("2006-01-02T15:04:05.00-07:00")
+				Expect(service.expiryTime(t)).To(Equal(service.DefaultExpTime))
+			})
+		})
+
+		Context("with invalid time string", func() {
+			It("returns the default expiry time", func() {
+				Expect(service.expiryTime("a")).To(Equal(service.DefaultExpTime))
+			})
+		})
+	})
+
+	Describe("#buildOption", func() {
+		BeforeEach(func() {
 			service.Context = map[string]interface{}{"test": "default"}
 		})
 		Context("with prefilled option", func() {
@@ -428,3 +2670,67 @@ var _ = Describe("Service", func() {
 		})
 	})
 })
+
+//recordingTransport records the URLs of the requests that go through it
+type recordingTransport struct {
+	base http.RoundTripper
+	urls []string
+}
+
+func (t *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.urls = append(t.urls, r.URL.String())
+	return t.base.RoundTrip(r)
+}
+
+//accessCache records the keys that are read and written
+type accessCache struct {
+	cache.Cache
+	reads  []string
+	writes []string
+}
+
+func (c *accessCache) Read(key string) interface{} {
+	c.reads = append(c.reads, key)
+	return c.Cache.Read(key)
+}
+
+func (c *accessCache) Write(key string, value interface{}, exp time.Duration) error {
+	c.writes = append(c.writes, key)
+	return c.Cache.Write(key, value, exp)
+}
+
+//boundedCache evicts the oldest items when it has more than size items
+type boundedCache struct {
+	cache.Cache
+	size int
+	keys []string
+}
+
+func (c *boundedCache) Write(key string, value interface{}, exp time.Duration) error {
+	c.keys = append(c.keys, key)
+	for len(c.keys) > c.size {
+		c.Cache.Delete(c.keys[0])
+		c.keys = c.keys[1:]
+	}
+	return c.Cache.Write(key, value, exp)
+}
+
+//flakyTransport fails the requests to the path with err, or a connection error if
+//err is nil, for the given number of times
+type flakyTransport struct {
+	base     http.RoundTripper
+	path     string
+	failures int
+	err      error
+}
+
+func (t *flakyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Path == t.path && t.failures > 0 {
+		t.failures--
+		if t.err != nil {
+			return nil, t.err
+		}
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	return t.base.RoundTrip(r)
+}
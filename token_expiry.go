@@ -0,0 +1,49 @@
+package sand
+
+import (
+	"sync"
+	"time"
+)
+
+//tokenExpiries keeps the expiry times of the tokens cached by a client, so that a
+//cache miss because of an expired token can be told apart from a token that was
+//never cached or was evicted.
+type tokenExpiries struct {
+	sync.Mutex
+	times map[string]time.Time
+}
+
+func newTokenExpiries() *tokenExpiries {
+	return &tokenExpiries{times: map[string]time.Time{}}
+}
+
+//recordTokenExpiry records the time when the token cached with the key expires.
+//A zero time means that the token does not expire.
+func (c *Client) recordTokenExpiry(key string, expiry time.Time) {
+	if c.expiries == nil {
+		return
+	}
+	c.expiries.Lock()
+	defer c.expiries.Unlock()
+	if expiry.IsZero() {
+		delete(c.expiries.times, key)
+		return
+	}
+	c.expiries.times[key] = expiry
+}
+
+//tokenMissed is called when the token of the key is not found in the cache. It calls
+//OnTokenExpired if the token was cached by the client and has expired.
+func (c *Client) tokenMissed(key string) {
+	if c.expiries == nil {
+		return
+	}
+	c.expiries.Lock()
+	expiry, ok := c.expiries.times[key]
+	delete(c.expiries.times, key)
+	c.expiries.Unlock()
+
+	if ok && !time.Now().Before(expiry) && c.OnTokenExpired != nil {
+		c.OnTokenExpired(key)
+	}
+}
@@ -0,0 +1,79 @@
+package sand
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/coupa/sand-go/cache"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OnTokenExpired", func() {
+	var (
+		client    *Client
+		ts        *httptest.Server
+		expiresIn int
+		expired   []string
+		key       string
+	)
+
+	BeforeEach(func() {
+		client, _ = NewClientWithCache("i", "s", "u", cache.NewGoCache(time.Hour, time.Hour))
+		client.DefaultRetryCount = 0
+		expiresIn = 2
+		expired = nil
+		client.OnTokenExpired = func(cacheKey string) {
+			expired = append(expired, cacheKey)
+		}
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":"abc","expires_in":%d}`, expiresIn)
+		}))
+		client.TokenURL = ts.URL
+		key = client.cacheKey("resource", []string{"scope"}, "")
+	})
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	Context("with a token that was never cached", func() {
+		It("is not called", func() {
+			_, err := client.Token("resource", []string{"scope"}, -1)
+			Expect(err).To(BeNil())
+			Expect(expired).To(BeEmpty())
+		})
+	})
+
+	Context("with an expired token", func() {
+		It("is called with the cache key once", func() {
+			_, err := client.Token("resource", []string{"scope"}, -1)
+			Expect(err).To(BeNil())
+			time.Sleep(2100 * time.Millisecond)
+
+			expiresIn = 3600
+			_, err = client.Token("resource", []string{"scope"}, -1)
+			Expect(err).To(BeNil())
+			Expect(expired).To(Equal([]string{key}))
+
+			_, err = client.Token("resource", []string{"scope"}, -1)
+			Expect(err).To(BeNil())
+			Expect(expired).To(Equal([]string{key}))
+		})
+	})
+
+	Context("with an evicted token", func() {
+		It("is not called", func() {
+			_, err := client.Token("resource", []string{"scope"}, -1)
+			Expect(err).To(BeNil())
+			client.Cache.Delete(key)
+
+			_, err = client.Token("resource", []string{"scope"}, -1)
+			Expect(err).To(BeNil())
+			Expect(expired).To(BeEmpty())
+		})
+	})
+})
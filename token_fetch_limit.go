@@ -0,0 +1,45 @@
+package sand
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+//tokenFetchLimiter limits the number of concurrent token fetches of a client to
+//MaxConcurrentTokenFetches.
+type tokenFetchLimiter struct {
+	sync.Mutex
+	slots chan struct{}
+}
+
+func newTokenFetchLimiter() *tokenFetchLimiter {
+	return &tokenFetchLimiter{}
+}
+
+//slotsFor returns the slots of the limiter, recreating them if the limit has changed
+func (l *tokenFetchLimiter) slotsFor(limit int) chan struct{} {
+	l.Lock()
+	defer l.Unlock()
+	if cap(l.slots) != limit {
+		l.slots = make(chan struct{}, limit)
+	}
+	return l.slots
+}
+
+//fetchToken gets a token from the source once a fetch slot is free. The callers
+//beyond MaxConcurrentTokenFetches block until a slot is freed or ctx is done.
+func (c *Client) fetchToken(ctx context.Context, source oauth2.TokenSource) (*oauth2.Token, error) {
+	if c.MaxConcurrentTokenFetches <= 0 || c.fetchLimiter == nil {
+		return source.Token()
+	}
+	slots := c.fetchLimiter.slotsFor(c.MaxConcurrentTokenFetches)
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-slots }()
+	return source.Token()
+}
@@ -0,0 +1,120 @@
+package sand
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/coupa/sand-go/cache"
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MaxConcurrentTokenFetches", func() {
+	var (
+		client   *Client
+		ts       *httptest.Server
+		mutex    sync.Mutex
+		inFlight int
+		peak     int
+		requests int
+		target   int
+	)
+
+	BeforeEach(func() {
+		client, _ = NewClientWithCache("i", "s", "u", cache.NewGoCache(time.Hour, time.Hour))
+		client.DefaultRetryCount = 0
+		inFlight, peak, requests, target = 0, 0, 0, 1
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			inFlight++
+			requests++
+			if inFlight > peak {
+				peak = inFlight
+			}
+			mutex.Unlock()
+
+			//Hold the request until target requests are in flight, so that the peak
+			//doesn't depend on how fast the requests are sent
+			deadline := time.Now().Add(2 * time.Second)
+			for time.Now().Before(deadline) {
+				mutex.Lock()
+				reached := inFlight >= target
+				mutex.Unlock()
+				if reached {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			time.Sleep(20 * time.Millisecond)
+
+			mutex.Lock()
+			inFlight--
+			mutex.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":"abc","expires_in":3600}`)
+		}))
+		client.TokenURL = ts.URL
+	})
+	AfterEach(func() {
+		ts.Close()
+		client.Close()
+	})
+
+	//fetchAll gets the tokens of n different cache keys at the same time
+	fetchAll := func(n int) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				token, err := client.Token(fmt.Sprintf("resource-%d", i), []string{"scope"}, -1)
+				Expect(err).To(BeNil())
+				Expect(token).To(Equal("abc"))
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	Context("with a limit", func() {
+		It("keeps the concurrent token requests under the limit", func() {
+			client.MaxConcurrentTokenFetches = 2
+			target = 2
+			fetchAll(10)
+			Expect(requests).To(Equal(10))
+			Expect(peak).To(Equal(2))
+		})
+
+		It("stops waiting for a free slot when the context is done", func() {
+			client.MaxConcurrentTokenFetches = 1
+			//Hold the first request until the second one gives up
+			target = 2
+			go client.OAuth2TokenWithoutCaching(nil, -1)
+			Eventually(func() int {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return requests
+			}, 5*time.Second).Should(Equal(1))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := client.OAuth2TokenWithContext(ctx, "other", nil, 0)
+			Expect(err).To(HaveOccurred())
+			Expect(requests).To(Equal(1))
+		})
+	})
+
+	Context("without a limit", func() {
+		It("doesn't limit the concurrent token requests", func() {
+			target = 3
+			fetchAll(10)
+			Expect(requests).To(Equal(10))
+			Expect(peak).To(BeNumerically(">", 2))
+		})
+	})
+})
@@ -0,0 +1,125 @@
+package sand
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+const (
+	//minMaintainerWait is the minimum wait between two token fetches of the maintainer
+	minMaintainerWait = time.Second
+)
+
+//tokenMaintainer keeps a warm service access token by refreshing it in the background
+type tokenMaintainer struct {
+	mutex sync.RWMutex
+	token *oauth2.Token
+
+	//ctx is canceled to stop the maintainer, which also interrupts a refresh in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+//StartTokenMaintainer fetches the service access token and starts a background
+//goroutine that refreshes it refreshBefore its expiry, so that token verification
+//never blocks on fetching the service access token. If the initial fetch fails,
+//the error is returned and the maintainer is not started.
+//It should be called once before the service starts verifying tokens, and be
+//stopped with StopTokenMaintainer.
+func (s *Service) StartTokenMaintainer(refreshBefore time.Duration) error {
+	token, err := s.OAuth2TokenWithoutCaching(s.Scopes, -1)
+	if err != nil {
+		return err
+	}
+	s.StopTokenMaintainer()
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &tokenMaintainer{
+		token:  token,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	s.maintainer = m
+	go s.maintainToken(m, refreshBefore)
+	return nil
+}
+
+//StopTokenMaintainer stops the background refresh of the service access token.
+//Afterwards the service access token is fetched on demand again. A refresh in
+//progress is canceled, so it does not wait for the OAuth2 server or the backoff.
+func (s *Service) StopTokenMaintainer() {
+	if s.maintainer == nil {
+		return
+	}
+	s.maintainer.cancel()
+	<-s.maintainer.done
+}
+
+//maintainToken refreshes the token of the maintainer until it is stopped.
+func (s *Service) maintainToken(m *tokenMaintainer, refreshBefore time.Duration) {
+	defer close(m.done)
+	for {
+		wait := s.refreshWait(m.current(), refreshBefore)
+		if !sleepContext(m.ctx, wait) {
+			m.set(nil)
+			return
+		}
+		token, err := s.oauth2TokenWithoutCaching(m.ctx, "", s.Scopes, -1)
+		if m.ctx.Err() != nil {
+			m.set(nil)
+			return
+		}
+		if err != nil {
+			log.Errorf("Sand token maintainer: failed to refresh the service access token: %v", err)
+			continue
+		}
+		m.set(token)
+	}
+}
+
+//refreshWait computes how long to wait before refreshing the token. Tokens without
+//an expiry time are refreshed after DefaultExpTime.
+func (s *Service) refreshWait(token *oauth2.Token, refreshBefore time.Duration) time.Duration {
+	var wait time.Duration
+	if token == nil {
+		wait = minMaintainerWait
+	} else if token.Expiry.IsZero() {
+		wait = time.Duration(s.DefaultExpTime) * time.Second
+	} else {
+		wait = time.Until(token.Expiry) - refreshBefore
+	}
+	if wait < minMaintainerWait {
+		wait = minMaintainerWait
+	}
+	return wait
+}
+
+//maintainedToken returns the access token kept by the maintainer, or an empty
+//string if the maintainer is not running or its token is no longer valid.
+func (s *Service) maintainedToken() string {
+	if s.maintainer == nil {
+		return ""
+	}
+	token := s.maintainer.current()
+	if token == nil || !token.Valid() {
+		return ""
+	}
+	return token.AccessToken
+}
+
+func (m *tokenMaintainer) current() *oauth2.Token {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.token
+}
+
+func (m *tokenMaintainer) set(token *oauth2.Token) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.token = token
+}
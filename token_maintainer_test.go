@@ -0,0 +1,147 @@
+package sand
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/coupa/sand-go/cache"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TokenMaintainer", func() {
+	var (
+		service     *Service
+		ts          *httptest.Server
+		tokenCount  int32
+		tokenExpiry int
+		slowRefresh int32
+	)
+
+	BeforeEach(func() {
+		caches = map[time.Duration]cache.Cache{}
+		service, _ = NewService("i", "s", "u", "r", "/v", []string{"scope"})
+		service.DefaultRetryCount = 0
+		service.Cache = nil
+		atomic.StoreInt32(&tokenCount, 0)
+		atomic.StoreInt32(&slowRefresh, 0)
+		tokenExpiry = 3600
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.RequestURI == "/" {
+				n := atomic.AddInt32(&tokenCount, 1)
+				if n > 1 && atomic.LoadInt32(&slowRefresh) == 1 {
+					//Hang until the client gives up on the refresh, which the server
+					//notices only after the body is read
+					r.ParseForm()
+					select {
+					case <-r.Context().Done():
+					case <-time.After(10 * time.Second):
+					}
+					return
+				}
+				fmt.Fprintf(w, `{"access_token":"def%d","expires_in":%d}`, n, tokenExpiry)
+			} else if r.RequestURI == "/v" {
+				fmt.Fprintf(w, `{"allowed":true}`)
+			}
+		}))
+		service.TokenURL = ts.URL
+		service.TokenVerifyURL = ts.URL + "/v"
+	})
+	AfterEach(func() {
+		service.StopTokenMaintainer()
+		ts.Close()
+	})
+
+	Context("when started", func() {
+		It("does not fetch the service access token when verifying tokens", func() {
+			Expect(service.StartTokenMaintainer(time.Minute)).To(Succeed())
+			Expect(atomic.LoadInt32(&tokenCount)).To(Equal(int32(1)))
+
+			for i := 0; i < 3; i++ {
+				t, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(t["allowed"]).To(Equal(true))
+			}
+			Expect(atomic.LoadInt32(&tokenCount)).To(Equal(int32(1)))
+		})
+
+		It("refreshes the token before it expires", func() {
+			tokenExpiry = 12
+			Expect(service.StartTokenMaintainer(11 * time.Second)).To(Succeed())
+			Expect(service.maintainedToken()).To(Equal("def1"))
+			Eventually(service.maintainedToken, 3*time.Second).Should(Equal("def2"))
+		})
+
+		It("returns the error if the initial token fetch fails", func() {
+			service.TokenURL = ""
+			Expect(service.StartTokenMaintainer(time.Second)).NotTo(Succeed())
+			Expect(service.maintainedToken()).To(Equal(""))
+		})
+	})
+
+	Context("when the service is closed", func() {
+		It("stops the maintainer", func() {
+			Expect(service.StartTokenMaintainer(time.Minute)).To(Succeed())
+			Expect(service.Close()).To(Succeed())
+			Expect(service.maintainedToken()).To(Equal(""))
+		})
+
+		It("leaves no goroutines of the closed services", func() {
+			before := runtime.NumGoroutine()
+			for i := 0; i < 1000; i++ {
+				s, err := NewService("i", "s", ts.URL, "r", ts.URL+"/v", []string{"scope"})
+				Expect(err).To(BeNil())
+				s.Cache = cache.NewGoCache(time.Hour, time.Minute)
+				s.AccessTokenCache = cache.NewGoCache(time.Hour, time.Minute)
+				Expect(s.StartTokenMaintainer(time.Minute)).To(Succeed())
+				_, err = s.VerifyTokenWithCache("abc", VerificationOption{})
+				Expect(err).To(BeNil())
+				Expect(s.Close()).To(Succeed())
+			}
+			Eventually(runtime.NumGoroutine, 5*time.Second).Should(BeNumerically("<=", before))
+		})
+
+		It("returns while the maintainer is refreshing from a slow OAuth2 server", func() {
+			atomic.StoreInt32(&slowRefresh, 1)
+			tokenExpiry = 1
+			Expect(service.StartTokenMaintainer(time.Minute)).To(Succeed())
+			Eventually(func() int32 { return atomic.LoadInt32(&tokenCount) }, 3*time.Second).Should(Equal(int32(2)))
+
+			closed := make(chan error)
+			go func() {
+				closed <- service.Close()
+			}()
+			Eventually(closed, time.Second).Should(Receive(BeNil()))
+		})
+	})
+
+	Context("when stopped", func() {
+		It("fetches the service access token on demand", func() {
+			Expect(service.StartTokenMaintainer(time.Minute)).To(Succeed())
+			service.StopTokenMaintainer()
+			Expect(service.maintainedToken()).To(Equal(""))
+
+			_, err := service.VerifyTokenWithCache("abc", VerificationOption{})
+			Expect(err).To(BeNil())
+			Expect(atomic.LoadInt32(&tokenCount)).To(Equal(int32(2)))
+		})
+
+		It("cancels a refresh that is stuck on the OAuth2 server", func() {
+			atomic.StoreInt32(&slowRefresh, 1)
+			tokenExpiry = 1
+			service.DefaultRetryCount = 3
+			Expect(service.StartTokenMaintainer(time.Minute)).To(Succeed())
+			Eventually(func() int32 { return atomic.LoadInt32(&tokenCount) }, 3*time.Second).Should(Equal(int32(2)))
+
+			t1 := time.Now()
+			service.StopTokenMaintainer()
+			Expect(time.Since(t1)).To(BeNumerically("<", 500*time.Millisecond))
+			Expect(service.maintainedToken()).To(Equal(""))
+		})
+	})
+})
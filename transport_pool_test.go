@@ -0,0 +1,72 @@
+package sand
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("transportPool", func() {
+	var client *Client
+
+	BeforeEach(func() {
+		client, _ = NewClient("i", "s", "u")
+	})
+
+	It("reuses the transport of the client", func() {
+		transport := client.httpTransport()
+		Expect(client.httpTransport()).To(BeIdenticalTo(transport))
+		Expect(transport.(*http.Transport).TLSClientConfig.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+	})
+
+	It("uses another transport for another SSLMinVersion", func() {
+		transport := client.httpTransport()
+		client.SSLMinVersion = tls.VersionTLS13
+		other := client.httpTransport()
+		Expect(other).NotTo(BeIdenticalTo(transport))
+		Expect(other.(*http.Transport).TLSClientConfig.MinVersion).To(Equal(uint16(tls.VersionTLS13)))
+	})
+
+	It("shares the transports with the services of the client", func() {
+		service, err := NewServiceFromClient(client, "r", "/v", nil)
+		Expect(err).To(BeNil())
+		Expect(service.httpTransport()).To(BeIdenticalTo(client.httpTransport()))
+	})
+
+	It("skips the TLS verification only for the calls with ContextWithInsecureSkipVerify", func() {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":"abc"}`)
+		}))
+		defer ts.Close()
+		client.TokenURL = ts.URL
+
+		token, err := client.OAuth2TokenWithContext(ContextWithInsecureSkipVerify(context.Background()), "", nil, 0)
+		Expect(err).To(BeNil())
+		Expect(token.AccessToken).To(Equal("abc"))
+
+		_, err = client.OAuth2TokenWithContext(context.Background(), "", nil, 0)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("certificate"))
+		Expect(client.httpTransport().(*http.Transport).TLSClientConfig.InsecureSkipVerify).To(BeFalse())
+	})
+
+	It("does not skip the TLS verification of a custom Transport", func() {
+		transport := &http.Transport{}
+		client.Transport = transport
+		Expect(client.contextTransport(ContextWithInsecureSkipVerify(context.Background()))).To(BeIdenticalTo(transport))
+	})
+
+	It("does not keep the connections alive without the pool", func() {
+		c := &Client{SSLMinVersion: tls.VersionTLS12}
+		transport := c.httpTransport().(*http.Transport)
+		Expect(transport.DisableKeepAlives).To(BeTrue())
+		Expect(c.httpTransport()).NotTo(BeIdenticalTo(transport))
+	})
+})
@@ -1,16 +1,140 @@
 package sand
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"sort"
 	"strings"
+	"time"
 
+	"golang.org/x/net/context"
 )
 
-//ExtractToken extracts a bearer token from the Authorization header.
-//The "bearer" keyword is case-insensitive
+//NormalizeScopes merges the scope lists into one sorted list without duplicates or
+//empty scopes, e.g., to combine the scopes required by several middleware layers.
+//The tokens are requested and cached with the normalized scopes, so the same scopes
+//in any order share a token. It returns an empty list if there are no scopes.
+func NormalizeScopes(scopes ...[]string) []string {
+	seen := map[string]bool{}
+	rv := []string{}
+	for _, list := range scopes {
+		for _, scope := range list {
+			if scope != "" && !seen[scope] {
+				seen[scope] = true
+				rv = append(rv, scope)
+			}
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+//ExtractToken extracts a bearer token from the Authorization header. The header must
+//consist of the case-insensitive "bearer" scheme, one or more spaces and a token made
+//of the characters allowed by RFC 6750, i.e., letters, digits, "-", ".", "_", "~",
+//"+" and "/" followed by optional "=" padding. Leading and trailing spaces and tabs
+//are ignored. It returns "" for any other header, e.g., with another scheme, an empty
+//token, content after the token or other whitespace such as newlines.
 func ExtractToken(authHeader string) string {
-	values := strings.Split(strings.Trim(authHeader, " "), " ")
-	if len(values) > 1 && strings.ToLower(values[0]) == "bearer" {
-		return values[1]
+	header := strings.Trim(authHeader, " \t")
+	const scheme = "bearer"
+	if len(header) <= len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) || header[len(scheme)] != ' ' {
+		return ""
+	}
+	token := strings.TrimLeft(header[len(scheme):], " ")
+	if !isBearerToken(token) {
+		return ""
+	}
+	return token
+}
+
+//isBearerToken checks if the token matches the b64token syntax of RFC 6750
+func isBearerToken(token string) bool {
+	i := 0
+	for i < len(token) && isTokenChar(token[i]) {
+		i++
+	}
+	if i == 0 {
+		return false
+	}
+	for i < len(token) && token[i] == '=' {
+		i++
+	}
+	return i == len(token)
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("-._~+/", c) >= 0
+}
+
+//ExtractRequestToken extracts a bearer token from the Authorization header of a request.
+//If the request has no Authorization header, it extracts the token from the "access_token"
+//field of a form-encoded body as described in RFC 6750 section 2.2. Extracting the token
+//from the body parses the form with r.ParseForm, which consumes r.Body, so the handler
+//must read the form fields from r.PostForm or r.Form instead of the body afterwards.
+func ExtractRequestToken(r *http.Request) string {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		return ExtractToken(authHeader)
 	}
-	return ""
+	if r.Method == "GET" || r.Method == "" {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return ""
+	}
+	return r.PostFormValue("access_token")
+}
+
+//exceedsDeadline checks if ctx is done or waiting for the duration would exceed the
+//deadline of ctx. It is used to stop retrying once ctx is canceled or the deadline is near.
+func exceedsDeadline(ctx context.Context, wait time.Duration) bool {
+	if ctx == nil {
+		return false
+	}
+	if ctx.Err() != nil {
+		return true
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && time.Now().Add(wait).After(deadline)
+}
+
+//sleepContext waits for the duration unless ctx is done first, in which case it returns
+//false so that the caller stops retrying.
+func sleepContext(ctx context.Context, wait time.Duration) bool {
+	if ctx == nil {
+		time.Sleep(wait)
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//newNonce generates a random nonce
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+//SHA256Hex returns the hex-encoded SHA-256 hash of s. It is the default hash of the
+//tokens in the cache keys of services, see Service.TokenKeyHash.
+func SHA256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
 }
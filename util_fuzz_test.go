@@ -0,0 +1,37 @@
+//go:build go1.18
+// +build go1.18
+
+package sand_test
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/coupa/sand-go"
+)
+
+func FuzzExtractToken(f *testing.F) {
+	for _, seed := range []string{"", "Bearer abc", " bearer abc ", "Bearer  abc", "Bearer abc d",
+		"Bearer abc\nX: y", "Bearer\u00a0abc", "Basic abc", "Bearer abc==", "Bearer =", "bearer"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, header string) {
+		token := ExtractToken(header)
+		if token == "" {
+			return
+		}
+		//The token must be the whole rest of the header after the scheme and spaces
+		trimmed := strings.Trim(header, " \t")
+		if !strings.HasSuffix(trimmed, token) {
+			t.Fatalf("ExtractToken(%q) = %q is not the end of the header", header, token)
+		}
+		scheme := strings.TrimRight(strings.TrimSuffix(trimmed, token), " ")
+		if !strings.EqualFold(scheme, "bearer") || len(scheme) == len(trimmed)-len(token) {
+			t.Fatalf("ExtractToken(%q) = %q without a bearer scheme", header, token)
+		}
+		padded := strings.TrimRight(token, "=")
+		if padded == "" || strings.Trim(padded, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-._~+/") != "" {
+			t.Fatalf("ExtractToken(%q) = %q has invalid characters", header, token)
+		}
+	})
+}
@@ -1,6 +1,11 @@
 package sand_test
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
 	. "github.com/coupa/sand-go"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -10,7 +15,9 @@ var _ = Describe("Util", func() {
 	Describe("#ExtractToken", func() {
 		Context("with invalid bearer string", func() {
 			It("should return the empty string", func() {
-				tests := []string{"", " ", "abc", "abc ", "bearer ", "Bearer ", "bear abc"}
+				tests := []string{"", " ", "abc", "abc ", "bearer ", "Bearer ", "bear abc", "Bearerabc",
+					" Bearer abc d ", "Bearer abc\nX-Injected: 1", "Bearer\tabc", "Bearer\u00a0abc", "Bearer abc\u2003",
+					"Bearer ab c", "Bearer =abc", "Bearer abc=d", "Basic abc", "Bearer a\x00bc"}
 				for _, t := range tests {
 					Expect(ExtractToken(t)).To(Equal(""))
 				}
@@ -18,11 +25,68 @@ var _ = Describe("Util", func() {
 		})
 		Context("with valid bearer string", func() {
 			It("should return the token", func() {
-				tests := []string{"Bearer abc", "bearer abc", " Bearer abc", " bearer abc", " Bearer abc d "}
+				tests := []string{"Bearer abc", "bearer abc", " Bearer abc", " bearer abc", "BEARER abc", "Bearer  abc", "\tBearer abc\t "}
 				for _, t := range tests {
 					Expect(ExtractToken(t)).To(Equal("abc"))
 				}
+				Expect(ExtractToken("Bearer a-b.c_d~e+f/g==")).To(Equal("a-b.c_d~e+f/g=="))
+				long := strings.Repeat("a", 1<<20)
+				Expect(ExtractToken("Bearer " + long)).To(Equal(long))
 			})
 		})
 	})
+
+	Describe("#ExtractRequestToken", func() {
+		form := func(method, contentType string) *http.Request {
+			r, _ := http.NewRequest(method, "/", strings.NewReader(url.Values{"access_token": {"abc"}}.Encode()))
+			r.Header.Set("Content-Type", contentType)
+			return r
+		}
+		It("should return the token in the Authorization header", func() {
+			r := form("POST", "application/x-www-form-urlencoded")
+			r.Header.Set("Authorization", "Bearer def")
+			Expect(ExtractRequestToken(r)).To(Equal("def"))
+		})
+		It("should return the token in the access_token form field without the Authorization header", func() {
+			Expect(ExtractRequestToken(form("POST", "application/x-www-form-urlencoded"))).To(Equal("abc"))
+			Expect(ExtractRequestToken(form("PUT", "application/x-www-form-urlencoded; charset=utf-8"))).To(Equal("abc"))
+		})
+		It("should leave the parsed form in PostForm after consuming the body", func() {
+			r := form("POST", "application/x-www-form-urlencoded")
+			Expect(ExtractRequestToken(r)).To(Equal("abc"))
+			body, _ := ioutil.ReadAll(r.Body)
+			Expect(body).To(BeEmpty())
+			Expect(r.PostForm.Get("access_token")).To(Equal("abc"))
+		})
+		It("should return the empty string without a form-encoded body", func() {
+			Expect(ExtractRequestToken(form("GET", "application/x-www-form-urlencoded"))).To(Equal(""))
+			Expect(ExtractRequestToken(form("POST", "application/json"))).To(Equal(""))
+			Expect(ExtractRequestToken(form("POST", ""))).To(Equal(""))
+		})
+	})
+
+	Describe("#NormalizeScopes", func() {
+		It("merges the scopes without duplicates", func() {
+			Expect(NormalizeScopes([]string{"a", "a", "b"}, []string{"b", "c", ""})).To(Equal([]string{"a", "b", "c"}))
+		})
+
+		It("sorts the scopes regardless of their order", func() {
+			Expect(NormalizeScopes([]string{"c", "a"}, []string{"b"})).To(Equal([]string{"a", "b", "c"}))
+			Expect(NormalizeScopes([]string{"b"}, []string{"a", "c"})).To(Equal(NormalizeScopes([]string{"c", "b", "a"})))
+		})
+
+		It("returns an empty list without scopes", func() {
+			Expect(NormalizeScopes()).To(Equal([]string{}))
+			Expect(NormalizeScopes(nil, []string{})).To(Equal([]string{}))
+			Expect(NormalizeScopes([]string{""})).To(Equal([]string{}))
+		})
+	})
+
+	Describe("#SHA256Hex", func() {
+		It("returns distinct stable hashes", func() {
+			Expect(SHA256Hex("abc")).To(Equal("ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"))
+			Expect(SHA256Hex("abc")).To(Equal(SHA256Hex("abc")))
+			Expect(SHA256Hex("abd")).NotTo(Equal(SHA256Hex("abc")))
+		})
+	})
 })